@@ -0,0 +1,138 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinHostPort(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:30005", joinHostPort("127.0.0.1", 30005))
+	assert.Equal(t, "[::1]:30005", joinHostPort("::1", 30005))
+	assert.Equal(t, "unix:///run/readsb/beast.sock", joinHostPort("unix:///run/readsb/beast.sock", 30005))
+	assert.Equal(t, "serial:///dev/ttyUSB0?baud=3000000", joinHostPort("serial:///dev/ttyUSB0?baud=3000000", 30005))
+}
+
+func TestJoinSourcePorts(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:30005", joinSourcePorts("127.0.0.1", 30005))
+	assert.Equal(t, "readsb:30005,[::1]:30005,192.168.1.20:30105,unix:///run/beast.sock",
+		joinSourcePorts("readsb, ::1,192.168.1.20:30105,unix:///run/beast.sock", 30005))
+	assert.Equal(t, "serial:///dev/ttyUSB0?baud=3000000&flow=none,[fd00::1]:30005",
+		joinSourcePorts("serial:///dev/ttyUSB0?baud=3000000&flow=none,[fd00::1]:30005", 30005))
+}
+
+func TestParseSocketMode(t *testing.T) {
+	mode, err := parseSocketMode("0660")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), mode)
+
+	_, err = parseSocketMode("rw-rw----")
+	require.Error(t, err)
+
+	_, err = parseSocketMode("4755")
+	require.Error(t, err)
+}
+
+func TestParseSocketOwner(t *testing.T) {
+	uid, gid, err := parseSocketOwner("")
+	require.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, -1, gid)
+
+	uid, gid, err = parseSocketOwner("1000:1001")
+	require.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 1001, gid)
+
+	uid, gid, err = parseSocketOwner(":1001")
+	require.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, 1001, gid)
+
+	uid, gid, err = parseSocketOwner("root")
+	require.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, -1, gid)
+
+	_, _, err = parseSocketOwner("no-such-user-pw-feeder")
+	require.Error(t, err)
+}
+
+func TestParsePins(t *testing.T) {
+	pins, err := parsePins([]string{
+		"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+	})
+	require.NoError(t, err)
+	require.Len(t, pins, 2)
+	assert.Equal(t, pins[0], pins[1])
+
+	_, err = parsePins([]string{"sha256/abc"})
+	require.Error(t, err)
+}
+
+func TestParseECHConfig(t *testing.T) {
+	list, err := parseECHConfig("")
+	require.NoError(t, err)
+	assert.Nil(t, list)
+
+	list, err = parseECHConfig("AAP+DQA=")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0x03, 0xfe, 0x0d, 0x00}, list)
+
+	_, err = parseECHConfig("AAr+DQA=")
+	require.Error(t, err)
+
+	_, err = parseECHConfig("not base64!")
+	require.Error(t, err)
+}
+
+func TestParseBindAddr(t *testing.T) {
+	ip, err := parseBindAddr("")
+	require.NoError(t, err)
+	assert.Nil(t, ip)
+
+	ip, err = parseBindAddr(" 2001:db8::1 ")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip.String())
+
+	_, err = parseBindAddr("eth0")
+	require.Error(t, err)
+}
+
+func TestParseFwmark(t *testing.T) {
+	mark, err := parseFwmark("")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), mark)
+
+	mark, err = parseFwmark("0x64")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(100), mark)
+
+	mark, err = parseFwmark("100")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(100), mark)
+
+	_, err = parseFwmark("0x100000000")
+	require.Error(t, err)
+}
@@ -20,12 +20,17 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os/signal"
 	"pw-feeder/lib/atc_status"
 	"pw-feeder/lib/connproxy"
+	"pw-feeder/lib/network"
+	"pw-feeder/lib/stunnel"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
@@ -38,14 +43,32 @@ import (
 const (
 	atcStatusIntervalSeconds = 300
 	metricsShutdownTimeout   = 5 * time.Second
+
+	// clientCertExpiryWarning is how close to expiry the client certificate
+	// must be for startup to warn about it.
+	clientCertExpiryWarning = 30 * 24 * time.Hour
+
+	// sessionHistorySize is the number of recent tunnel sessions kept for the
+	// sessions endpoint.
+	sessionHistorySize = 64
 )
 
 // runFeeder prepares, starts, and gracefully stops the feeder services.
 func runFeeder(parentCtx context.Context, command *cli.Command) error {
 	cfg := configFromCommand(command)
 	redactList[cfg.apiKey] = "[API_KEY_REDACTED]"
+	redactProxyCredentials(cfg)
 	logStartup(cfg)
 
+	// TCP_USER_TIMEOUT is only available on Linux, so its default is dropped
+	// quietly elsewhere.
+	if err := cfg.liveness.Check(); err != nil {
+		if command.IsSet(flagTCPUserTimeout) {
+			log.Warn().Err(err).Msg("ignoring the TCP user timeout")
+		}
+		cfg.liveness.UserTimeout = 0
+	}
+
 	// set up cancel function to stop goroutines
 	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
@@ -54,10 +77,19 @@ func runFeeder(parentCtx context.Context, command *cli.Command) error {
 	runCtx, stopSignals := signal.NotifyContext(ctx, syscall.SIGTERM)
 	defer stopSignals()
 
+	trust, err := prepareTrust(cfg)
+	if err != nil {
+		return err
+	}
+
 	metrics, err := prepareMetrics(runCtx, cfg)
 	if err != nil {
 		return err
 	}
+	err = registerClientCertMetrics(metrics.Registerer(), trust.clientCert)
+	if err != nil {
+		return err
+	}
 
 	mlatListener, err := prepareMLATListener(cfg)
 	if err != nil {
@@ -69,22 +101,67 @@ func runFeeder(parentCtx context.Context, command *cli.Command) error {
 		}()
 	}
 
+	// Expose recent tunnel sessions alongside the metrics.
+	history := connproxy.NewSessionHistory(sessionHistorySize)
+	metrics.Handle("/sessions", history)
+
+	// Share one circuit breaker per plane.watch host between the tunnels.
+	breakers, unregisterBreakers := connproxy.NewCircuitBreakers(metrics.Registerer(), cfg.circuitFailures, cfg.circuitOpenTime, log.Logger)
+	defer unregisterBreakers()
+
 	err = metrics.Start()
 	if err != nil {
 		return err
 	}
 
-	workers := startFeederServices(runCtx, cfg, mlatListener, metrics.Registerer())
-	runErr := waitForShutdown(runCtx, metrics.Errors())
+	// Exit when plane.watch rejects the API key, if configured to.
+	var (
+		authRejected   chan struct{}
+		onAuthRejected func()
+	)
+	if cfg.exitOnAuthReject {
+		authRejected = make(chan struct{}, 1)
+		onAuthRejected = func() {
+			select {
+			case authRejected <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	workers := startFeederServices(runCtx, cfg, trust, mlatListener, metrics.Registerer(), history, breakers, onAuthRejected)
+	runErr := waitForShutdown(runCtx, metrics.Errors(), authRejected)
 
 	// Stop the feeder services before shutting down their metrics endpoint.
 	cancel()
 	shutdownErr := shutdownMetrics(metrics)
 	workers.Wait()
 
+	// Return a configuration error unwrapped so it sets the exit code.
+	if shutdownErr == nil {
+		return runErr
+	}
 	return errors.Join(runErr, shutdownErr)
 }
 
+// redactProxyCredentials adds the credentials of the configured and
+// environment proxies to the log redaction list.
+func redactProxyCredentials(cfg feederConfig) {
+	proxies := network.EnvironmentProxies()
+	if cfg.proxy != nil {
+		proxies = append(proxies, cfg.proxy)
+	}
+	for _, u := range proxies {
+		username, password := network.ProxyCredentials(u)
+		if username != "" {
+			redactList[username] = "[PROXY_USERNAME_REDACTED]"
+		}
+		if password != "" {
+			redactList[password] = "[PROXY_PASSWORD_REDACTED]"
+		}
+	}
+}
+
 // logStartup reports the feeder build and version information.
 func logStartup(cfg feederConfig) {
 	log.Info().
@@ -98,19 +175,181 @@ func prepareMLATListener(cfg feederConfig) (net.Listener, error) {
 	if !cfg.mlatEnabled {
 		return nil, nil
 	}
-	return net.Listen("tcp", cfg.mlatListen)
+	return network.Listen(
+		cfg.mlatListen,
+		network.WithSocketMode(cfg.mlatSocketMode),
+		network.WithSocketOwner(cfg.mlatSocketUID, cfg.mlatSocketGID),
+		network.WithListenLiveness(cfg.liveness),
+	)
+}
+
+// trustConfig holds how plane.watch servers are verified and authenticated to.
+type trustConfig struct {
+	// feedOpts verify and authenticate to the feed-in servers.
+	feedOpts []stunnel.Option
+	// atcClient makes ATC API requests.
+	atcClient *http.Client
+	// clientCert is presented to the feed-in servers, if configured.
+	clientCert *stunnel.ClientCertificate
+	// dialOpts apply to every outbound connection, including those to the
+	// local data sources. Connections to plane.watch are also bound as
+	// bindDialOptions describes.
+	dialOpts []network.DialOption
+}
+
+// prepareTrust loads the configured CA file, pins and client certificate,
+// selects how the API key is presented to the feed-in servers, and routes
+// connections to plane.watch through the configured proxy, address families
+// and resolver.
+func prepareTrust(cfg feederConfig) (trustConfig, error) {
+	var (
+		trust trustConfig
+		roots *x509.CertPool
+		err   error
+	)
+
+	if cfg.caFile != "" {
+		roots, err = stunnel.LoadRootCAs(cfg.caFile, cfg.caFileReplace)
+		if err != nil {
+			return trust, cli.Exit(fmt.Sprintf("Could not load the CA file: %s", err), ExitcodeConfigError)
+		}
+	} else if cfg.caFileReplace {
+		return trust, cli.Exit(fmt.Sprintf("--%s needs --%s", flagCAFileReplace, flagCAFile), ExitcodeConfigError)
+	}
+
+	trust.feedOpts = []stunnel.Option{
+		stunnel.WithRootCAs(roots),
+		stunnel.WithPins(cfg.feedPins...),
+		stunnel.WithAuthMode(cfg.authMode),
+		stunnel.WithECHConfigList(cfg.echConfig),
+	}
+	if cfg.echDNSLookup {
+		trust.feedOpts = append(trust.feedOpts, stunnel.WithECHLookup())
+	}
+	if cfg.echFallback {
+		trust.feedOpts = append(trust.feedOpts, stunnel.WithECHFallback())
+	}
+
+	if cfg.tlsCert != "" || cfg.tlsKey != "" {
+		if cfg.tlsCert == "" || cfg.tlsKey == "" {
+			return trust, cli.Exit(fmt.Sprintf("--%s and --%s must be used together", flagTLSCert, flagTLSKey), ExitcodeConfigError)
+		}
+		trust.clientCert, err = stunnel.LoadClientCertificate(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			return trust, cli.Exit(fmt.Sprintf("Could not load the client certificate: %s", err), ExitcodeConfigError)
+		}
+		warnClientCertExpiry(trust.clientCert.NotAfter(), time.Now())
+		trust.feedOpts = append(trust.feedOpts, stunnel.WithClientCertificate(trust.clientCert))
+	}
+
+	trust.dialOpts, err = outboundDialOptions(cfg)
+	if err != nil {
+		return trust, cli.Exit(fmt.Sprintf("Could not use the resolver: %s", err), ExitcodeConfigError)
+	}
+
+	// Both the feed-in and ATC connections use the same proxy, so that
+	// NO_PROXY and ALL_PROXY apply to them alike.
+	dialer := network.NewDialer(append(
+		slices.Concat(trust.dialOpts, bindDialOptions(cfg)),
+		network.WithProxy(cfg.proxy),
+		network.WithProxyFromEnvironment(),
+	)...)
+	err = dialer.CheckBind()
+	if err != nil {
+		return trust, cli.Exit(fmt.Sprintf("Could not bind outbound connections as configured: %s", err), ExitcodeConfigError)
+	}
+	trust.feedOpts = append(trust.feedOpts, stunnel.WithDialer(dialer))
+
+	tlsConfig, err := stunnel.NewTLSConfig("", false, stunnel.WithRootCAs(roots), stunnel.WithPins(cfg.atcPins...))
+	if err != nil {
+		return trust, fmt.Errorf("could not prepare ATC API TLS configuration: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	transport.TLSClientConfig = tlsConfig
+	trust.atcClient = &http.Client{Transport: transport}
+
+	return trust, nil
+}
+
+// outboundDialOptions returns the address family, liveness and resolver
+// options shared by every outbound connection. The resolver remembers the
+// addresses each host last resolved to for up to cfg.dnsCacheTTL, so
+// reconnects survive an outage of the DNS resolver.
+func outboundDialOptions(cfg feederConfig) ([]network.DialOption, error) {
+	opts := []network.DialOption{
+		network.WithIPFamily(cfg.ipFamily),
+		network.WithLiveness(cfg.liveness),
+	}
+
+	// Queries to a DNS-over-HTTPS server leave over the same link as the
+	// connections to plane.watch, but its host name uses the system resolver.
+	resolver, err := network.ParseResolver(cfg.resolver, slices.Concat(opts, bindDialOptions(cfg))...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.dnsCacheTTL > 0 {
+		resolver = network.NewCachingResolver(resolver, cfg.dnsCacheTTL)
+	}
+	return append(opts, network.WithResolver(resolver)), nil
+}
+
+// bindDialOptions returns the source address, interface and firewall mark
+// options for connections to plane.watch. The local data sources are often on
+// another link, so they are not bound.
+func bindDialOptions(cfg feederConfig) []network.DialOption {
+	return []network.DialOption{
+		network.WithBindAddress(cfg.bindAddr),
+		network.WithBindInterface(cfg.bindInterface),
+		network.WithFwmark(cfg.fwmark),
+	}
+}
+
+// warnClientCertExpiry warns when a client certificate expiring at notAfter
+// has expired or will expire within clientCertExpiryWarning of now.
+func warnClientCertExpiry(notAfter, now time.Time) {
+	remaining := notAfter.Sub(now)
+	switch {
+	case remaining <= 0:
+		log.Warn().Time("expires", notAfter).Msg("client certificate has expired")
+	case remaining < clientCertExpiryWarning:
+		log.Warn().Time("expires", notAfter).Str("remaining", remaining.Round(time.Hour).String()).Msg("client certificate expires soon")
+	}
 }
 
 // startFeederServices starts the BEAST proxy, optional MLAT proxy, and ATC
-// status updater.
+// status updater. The tunnels share breakers, and onAuthRejected, if not nil,
+// is called when plane.watch rejects the API key.
 func startFeederServices(
 	ctx context.Context,
 	cfg feederConfig,
+	trust trustConfig,
 	mlatListener net.Listener,
 	reg prometheus.Registerer,
+	history *connproxy.SessionHistory,
+	breakers *connproxy.CircuitBreakers,
+	onAuthRejected func(),
 ) *sync.WaitGroup {
 	workers := &sync.WaitGroup{}
 
+	proxyOpts := []connproxy.Option{
+		connproxy.WithSessionHistory(history),
+		connproxy.WithCoalescing(cfg.coalesceDelay, cfg.coalesceBytes),
+		connproxy.WithHeartbeat(cfg.heartbeatInterval, cfg.heartbeatMisses),
+		connproxy.WithBeastSettings(cfg.beastSettings),
+		connproxy.WithSourceFailover(cfg.beastStallTimeout, cfg.beastHoldDown),
+		connproxy.WithAuthRejection(connproxy.DefaultAuthRejectedBackoff, onAuthRejected),
+		connproxy.WithBackoff(cfg.backoffMax, cfg.backoffJitter),
+		connproxy.WithCircuitBreakers(breakers),
+		connproxy.WithQueue(cfg.queueDepth, cfg.queuePolicy),
+		connproxy.WithTLSOptions(trust.feedOpts...),
+		connproxy.WithLocalDialOptions(trust.dialOpts...),
+	}
+	if cfg.endpointShuffle {
+		proxyOpts = append(proxyOpts, connproxy.WithEndpointShuffle(cfg.apiKey))
+	}
+
 	workers.Go(func() {
 		connproxy.ProxyBEASTConnection(
 			ctx,
@@ -120,6 +359,7 @@ func startFeederServices(
 			cfg.apiKey,
 			cfg.insecure,
 			reg,
+			proxyOpts...,
 		)
 	})
 
@@ -133,6 +373,7 @@ func startFeederServices(
 				cfg.apiKey,
 				cfg.insecure,
 				reg,
+				proxyOpts...,
 			)
 		})
 	}
@@ -144,21 +385,24 @@ func startFeederServices(
 			cfg.apiKey,
 			atcStatusIntervalSeconds,
 			reg,
+			atc_status.WithHTTPClient(trust.atcClient),
 		)
 	})
 
 	return workers
 }
 
-// waitForShutdown waits for a shutdown signal, parent cancellation, or metrics
-// server failure.
-func waitForShutdown(ctx context.Context, metricsErrors <-chan error) error {
+// waitForShutdown waits for a shutdown signal, parent cancellation, metrics
+// server failure, or plane.watch rejecting the API key.
+func waitForShutdown(ctx context.Context, metricsErrors <-chan error, authRejected <-chan struct{}) error {
 	select {
 	case <-ctx.Done():
 		log.Info().Msg("shutdown requested, stopping")
 		return nil
 	case err := <-metricsErrors:
 		return fmt.Errorf("metrics listener failed: %w", err)
+	case <-authRejected:
+		return cli.Exit("plane.watch rejected the API key, please check the arguments or environment file in your docker-compose.yml and try again", ExitcodeConfigError)
 	}
 }
 
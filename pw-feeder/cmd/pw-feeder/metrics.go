@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"pw-feeder/lib/stunnel"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,6 +36,7 @@ import (
 // metricsService owns the Prometheus registry and HTTP server lifecycle.
 type metricsService struct {
 	registry *prometheus.Registry
+	mux      *http.ServeMux
 	server   *http.Server
 	errCh    chan error
 }
@@ -61,6 +63,7 @@ func prepareMetrics(ctx context.Context, cfg feederConfig) (*metricsService, err
 	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 
 	service.registry = registry
+	service.mux = mux
 	service.errCh = make(chan error, 1)
 	service.server = &http.Server{
 		Addr:              cfg.metricsAddress,
@@ -74,6 +77,26 @@ func prepareMetrics(ctx context.Context, cfg feederConfig) (*metricsService, err
 	return service, nil
 }
 
+// registerClientCertMetrics exports when the client certificate expires. It
+// does nothing when metrics are disabled or no certificate is configured.
+func registerClientCertMetrics(reg prometheus.Registerer, cert *stunnel.ClientCertificate) error {
+	if reg == nil || cert == nil {
+		return nil
+	}
+	err := reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "pwfeeder",
+		Subsystem: "tls",
+		Name:      "client_certificate_expiry_timestamp_seconds",
+		Help:      "Unix time at which the client certificate presented to plane.watch expires.",
+	}, func() float64 {
+		return float64(cert.NotAfter().Unix())
+	}))
+	if err != nil {
+		return fmt.Errorf("could not register client certificate metrics: %w", err)
+	}
+	return nil
+}
+
 // Start binds and starts the metrics HTTP server. Binding synchronously ensures
 // address errors are reported before the feeder services start.
 func (service *metricsService) Start() error {
@@ -97,6 +120,15 @@ func (service *metricsService) Start() error {
 	return nil
 }
 
+// Handle registers an additional handler on the metrics HTTP server. It must be
+// called before Start, and does nothing when metrics are disabled.
+func (service *metricsService) Handle(pattern string, handler http.Handler) {
+	if service == nil || service.mux == nil {
+		return
+	}
+	service.mux.Handle(pattern, handler)
+}
+
 // Registerer returns the registry used by feeder services, or nil when metrics
 // are disabled.
 func (service *metricsService) Registerer() prometheus.Registerer {
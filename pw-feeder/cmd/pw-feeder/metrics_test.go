@@ -21,9 +21,12 @@ package main
 import (
 	"context"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -72,3 +75,32 @@ func TestMetricsServiceReportsBindErrors(t *testing.T) {
 	require.Error(t, err)
 	assert.ErrorContains(t, err, "could not start metrics listener")
 }
+
+func TestMetricsServiceHandle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	service, err := prepareMetrics(ctx, feederConfig{
+		metricsEnabled: true,
+		metricsAddress: "127.0.0.1:0",
+	})
+	require.NoError(t, err)
+
+	service.Handle("/sessions", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	rec := httptest.NewRecorder()
+	service.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+
+	// Handlers are ignored when metrics are disabled.
+	disabled, err := prepareMetrics(ctx, feederConfig{})
+	require.NoError(t, err)
+	disabled.Handle("/sessions", http.NotFoundHandler())
+}
+
+func TestRegisterClientCertMetricsDisabled(t *testing.T) {
+	require.NoError(t, registerClientCertMetrics(nil, nil))
+	require.NoError(t, registerClientCertMetrics(prometheus.NewRegistry(), nil))
+}
@@ -83,8 +83,31 @@ var (
 	mu sync.RWMutex
 )
 
-// getStatusFromATC retrieves the current feeder status from the ATC API.
-func (S *ATCStatus) getStatusFromATC(atcUrl, apiKey string) error {
+type (
+	// Option configures Start.
+	Option func(*options)
+
+	// options contains the optional settings for the status check.
+	options struct {
+		// client makes the requests to the ATC API.
+		client *http.Client
+	}
+)
+
+// WithHTTPClient returns an Option that makes ATC API requests with client,
+// for example to verify the server with custom roots or pins.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// getStatusFromATC retrieves the current feeder status from the ATC API using
+// client, or http.DefaultClient when client is nil.
+func (S *ATCStatus) getStatusFromATC(client *http.Client, atcUrl, apiKey string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
 
 	// Build the ATC API request URL.
 	requestURL, err := url.JoinPath(atcUrl, "api", "v1", "feeders", apiKey, "status.json")
@@ -92,7 +115,7 @@ func (S *ATCStatus) getStatusFromATC(atcUrl, apiKey string) error {
 		log.Err(err).Str("url", requestURL).Str("atcurl", atcUrl).Msg("could not form request URL")
 		return err
 	}
-	res, err := http.Get(requestURL)
+	res, err := client.Get(requestURL)
 	if err != nil {
 		log.Err(err).Str("url", requestURL).Msg("error making feeder status http request")
 		return err
@@ -146,7 +169,13 @@ func Start(
 	atcUrl, apiKey string,
 	interval int,
 	reg prometheus.Registerer,
+	opts ...Option,
 ) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	ctx, cancelFunc = context.WithCancel(parentContext)
 	S := ATCStatus{}
 
@@ -209,7 +238,7 @@ func Start(
 		case <-time.After(time.Duration((interval - 60 + randSeconds)) * time.Second):
 
 			// Get the current status from ATC.
-			err := S.getStatusFromATC(atcUrl, apiKey)
+			err := S.getStatusFromATC(o.client, atcUrl, apiKey)
 
 			// Log the status when the request succeeds.
 			if err == nil {
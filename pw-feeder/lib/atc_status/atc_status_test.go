@@ -150,7 +150,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// Check the result.
 		require.Error(t, err)
@@ -158,6 +158,26 @@ func TestGetStatusFromATC(t *testing.T) {
 
 	})
 
+	t.Run("custom http client", func(t *testing.T) {
+		// Serve the status over TLS with a certificate only the server's own
+		// client trusts.
+		plainServer := PrepMockATCServer(t, MockServerTestScenarioWorking)
+		plainServer.Close()
+		testServer := httptest.NewTLSServer(plainServer.Config.Handler)
+		t.Cleanup(func() {
+			testServer.Close()
+		})
+
+		// The default client does not trust the test certificate.
+		S := ATCStatus{}
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
+		require.Error(t, err)
+
+		err = S.getStatusFromATC(testServer.Client(), testServer.URL, TestFeederAPIKey.String())
+		require.NoError(t, err)
+		assert.True(t, S.Status.ADSB.Connected)
+	})
+
 	t.Run("bad request", func(t *testing.T) {
 		// Start the test server.
 		testServer := PrepMockATCServer(t, MockServerTestScenarioBadRequest)
@@ -167,7 +187,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// Check the result.
 		require.Error(t, err)
@@ -183,7 +203,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// Check the result.
 		require.Error(t, err)
@@ -198,7 +218,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// Check the result.
 		require.Error(t, err)
@@ -214,7 +234,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// The response is truncated at the configured limit and cannot be decoded.
 		require.Error(t, err)
@@ -229,7 +249,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// Check the result.
 		require.NoError(t, err)
@@ -246,7 +266,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// Check the result.
 		require.NoError(t, err)
@@ -263,7 +283,7 @@ func TestGetStatusFromATC(t *testing.T) {
 
 		// Retrieve the feeder status.
 		S := ATCStatus{}
-		err := S.getStatusFromATC(testServer.URL, TestFeederAPIKey.String())
+		err := S.getStatusFromATC(nil, testServer.URL, TestFeederAPIKey.String())
 
 		// Check the result.
 		require.NoError(t, err)
@@ -18,19 +18,44 @@
 
 package backoff
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxDelay is the longest delay the default method returns unless
+// WithMaxDelay is used.
+const DefaultMaxDelay = 30 * time.Second
 
 type (
 	// BackerOff tracks retry attempts and calculates the delay before each retry.
+	// It is safe for concurrent use.
 	BackerOff struct {
 		// method calculates a delay from the current attempt number.
 		method Method
 		// resetAfter specifies how long inactivity must last before attempts reset.
 		resetAfter time.Duration
+		// maxDelay caps each delay, when it is positive.
+		maxDelay time.Duration
+		// jitter randomises each delay.
+		jitter Jitter
+		// randInt64N returns a random number in [0, n), so tests can replace it.
+		randInt64N func(n int64) int64
+		// notify is called with each calculated delay, if set.
+		notify func(delay time.Duration)
+
+		// mu protects the fields below.
+		mu sync.Mutex
 		// lastAttempt records when the most recent delay was calculated.
 		lastAttempt time.Time
 		// attempt is the number passed to method for the next delay calculation.
 		attempt int64
+		// previous is the most recent delay, used by decorrelated jitter.
+		previous time.Duration
 	}
 
 	// Method calculates a backoff duration for a retry attempt.
@@ -38,8 +63,53 @@ type (
 
 	// Option configures a BackerOff.
 	Option func(*BackerOff)
+
+	// Jitter selects how each delay is randomised, so that many clients
+	// failing at once do not all retry at the same moment.
+	Jitter int
 )
 
+const (
+	// JitterNone uses each delay as calculated.
+	JitterNone Jitter = iota
+	// JitterFull waits a random time between zero and the delay.
+	JitterFull
+	// JitterEqual waits half the delay plus a random time up to the other
+	// half.
+	JitterEqual
+	// JitterDecorrelated waits a random time between the first delay and
+	// three times the previous wait, so consecutive waits are not correlated.
+	// An attempt the method gives no delay is still retried straight away.
+	JitterDecorrelated
+)
+
+// jitterNames maps each Jitter to its name.
+var jitterNames = map[Jitter]string{
+	JitterNone:         "none",
+	JitterFull:         "full",
+	JitterEqual:        "equal",
+	JitterDecorrelated: "decorrelated",
+}
+
+// String returns the name of the jitter.
+func (j Jitter) String() string {
+	if name, ok := jitterNames[j]; ok {
+		return name
+	}
+	return fmt.Sprintf("Jitter(%d)", int(j))
+}
+
+// ParseJitter parses a jitter name: none, full, equal or decorrelated.
+func ParseJitter(s string) (Jitter, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for j, name := range jitterNames {
+		if name == s {
+			return j, nil
+		}
+	}
+	return JitterNone, fmt.Errorf("unknown jitter %q, expected none, full, equal or decorrelated", s)
+}
+
 // WithMethod returns an Option that sets the backoff calculation method.
 func WithMethod(method Method) Option {
 	return func(bo *BackerOff) {
@@ -55,13 +125,43 @@ func WithResetAfter(d time.Duration) Option {
 	}
 }
 
+// WithNotify returns an Option that calls fn with every delay calculated by
+// BackOff, for example to export the current delay as a metric.
+func WithNotify(fn func(delay time.Duration)) Option {
+	return func(bo *BackerOff) {
+		bo.notify = fn
+	}
+}
+
+// WithMaxDelay returns an Option that caps every delay at d, including after
+// jitter. A non-positive d removes the cap, leaving only the method's own.
+func WithMaxDelay(d time.Duration) Option {
+	return func(bo *BackerOff) {
+		bo.maxDelay = d
+	}
+}
+
+// WithJitter returns an Option that randomises every delay with j.
+func WithJitter(j Jitter) Option {
+	return func(bo *BackerOff) {
+		bo.jitter = j
+	}
+}
+
 // DefaultMethodExponentialBackoff returns the default delay for an attempt.
 // The first attempt has no delay, and subsequent delays are capped at 30 seconds.
 func DefaultMethodExponentialBackoff(attempt int64) time.Duration {
+	return min(quadraticBackoff(attempt), DefaultMaxDelay)
+}
+
+// quadraticBackoff returns attempt squared seconds, without a cap.
+func quadraticBackoff(attempt int64) time.Duration {
 	if attempt == 0 {
 		return 0
 	}
-	return min(time.Duration(attempt*attempt)*time.Second, time.Second*30)
+	// Stop growing well before the multiplication could overflow.
+	attempt = min(attempt, 1<<14)
+	return time.Duration(attempt*attempt) * time.Second
 }
 
 // New returns a BackerOff configured with the supplied options.
@@ -69,24 +169,114 @@ func New(opts ...Option) *BackerOff {
 	// Set the defaults.
 	bo := &BackerOff{
 		resetAfter: 30 * time.Second,
-		method:     DefaultMethodExponentialBackoff,
+		randInt64N: rand.Int64N,
 	}
 	for _, opt := range opts {
 		opt(bo)
 	}
+	// The default method is capped at DefaultMaxDelay unless another cap is
+	// given. Methods set with WithMethod are only capped by WithMaxDelay.
+	if bo.method == nil {
+		bo.method = quadraticBackoff
+		if bo.maxDelay <= 0 {
+			bo.maxDelay = DefaultMaxDelay
+		}
+	}
 	return bo
 }
 
 // BackOff returns the delay for the next retry and records the attempt.
 // It resets the attempt counter after the configured period of inactivity.
 func (bo *BackerOff) BackOff() time.Duration {
+	bo.mu.Lock()
 	if bo.lastAttempt.Add(bo.resetAfter).Before(time.Now()) {
 		bo.attempt = 0
+		bo.previous = 0
 	}
 
-	sleepyTime := bo.method(bo.attempt)
+	sleepyTime := bo.jittered(bo.capped(bo.method(bo.attempt)))
 	bo.attempt++
 	bo.lastAttempt = time.Now()
+	bo.previous = sleepyTime
+	bo.mu.Unlock()
+
+	if bo.notify != nil {
+		bo.notify(sleepyTime)
+	}
 
 	return sleepyTime
 }
+
+// Attempts returns the number of delays calculated since the attempt counter
+// last reset, or 0 once the inactivity period has passed.
+func (bo *BackerOff) Attempts() int64 {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	if bo.lastAttempt.Add(bo.resetAfter).Before(time.Now()) {
+		return 0
+	}
+	return bo.attempt
+}
+
+// Wait calculates the delay for the next retry and sleeps for it. It returns
+// early with the context's error when ctx is cancelled.
+func (bo *BackerOff) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return Sleep(ctx, bo.BackOff())
+}
+
+// Sleep pauses for d, returning early with the context's error when ctx is
+// cancelled.
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// capped limits d to the maximum delay. bo.mu must be held.
+func (bo *BackerOff) capped(d time.Duration) time.Duration {
+	if bo.maxDelay > 0 {
+		return min(d, bo.maxDelay)
+	}
+	return d
+}
+
+// jittered randomises d. bo.mu must be held.
+func (bo *BackerOff) jittered(d time.Duration) time.Duration {
+	switch bo.jitter {
+	case JitterFull:
+		return bo.between(0, d)
+	case JitterEqual:
+		return bo.between(d/2, d)
+	case JitterDecorrelated:
+		if d == 0 {
+			return 0
+		}
+		base := bo.capped(bo.method(1))
+		hi := max(base, 3*bo.previous)
+		if bo.maxDelay <= 0 {
+			// Without a cap, stay within the method's own delay.
+			hi = min(hi, max(base, d))
+		}
+		return bo.capped(bo.between(base, hi))
+	}
+	return d
+}
+
+// between returns a random duration in [lo, hi]. bo.mu must be held.
+func (bo *BackerOff) between(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	return lo + time.Duration(bo.randInt64N(int64(hi-lo)+1))
+}
@@ -19,11 +19,13 @@
 package backoff
 
 import (
+	"context"
 	"testing"
 	"testing/synctest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TestBackerOff_BackOff verifies delay calculation and inactivity resets.
@@ -43,3 +45,155 @@ func TestBackerOff_BackOff(t *testing.T) {
 		}
 	})
 }
+
+// TestBackerOff_WithNotify verifies that each calculated delay is reported.
+func TestBackerOff_WithNotify(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var delays []time.Duration
+		bo := New(WithNotify(func(delay time.Duration) {
+			delays = append(delays, delay)
+		}))
+		bo.BackOff()
+		bo.BackOff()
+		bo.BackOff()
+		assert.Equal(t, []time.Duration{0, time.Second, 4 * time.Second}, delays)
+	})
+}
+
+// TestBackerOff_WithMaxDelay verifies the cap can be raised or lowered.
+func TestBackerOff_WithMaxDelay(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bo := New(WithMaxDelay(10 * time.Second))
+		var delays []time.Duration
+		for range 6 {
+			delays = append(delays, bo.BackOff())
+		}
+		assert.Equal(t, []time.Duration{0, time.Second, 4 * time.Second, 9 * time.Second, 10 * time.Second, 10 * time.Second}, delays)
+
+		bo = New(WithMaxDelay(time.Minute))
+		delays = nil
+		for range 10 {
+			delays = append(delays, bo.BackOff())
+		}
+		assert.Equal(t, 49*time.Second, delays[7])
+		assert.Equal(t, time.Minute, delays[9])
+	})
+}
+
+// TestBackerOff_WithMethodUncapped verifies a custom method's delays are not
+// capped unless WithMaxDelay is used.
+func TestBackerOff_WithMethodUncapped(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		method := func(attempt int64) time.Duration {
+			return time.Duration(attempt) * time.Minute
+		}
+		bo := New(WithMethod(method))
+		bo.BackOff()
+		assert.Equal(t, time.Minute, bo.BackOff())
+		assert.Equal(t, 2*time.Minute, bo.BackOff())
+
+		bo = New(WithMethod(method), WithMaxDelay(90*time.Second))
+		bo.BackOff()
+		assert.Equal(t, time.Minute, bo.BackOff())
+		assert.Equal(t, 90*time.Second, bo.BackOff())
+	})
+}
+
+// TestBackerOff_WithJitter verifies each jitter keeps delays within its
+// bounds.
+func TestBackerOff_WithJitter(t *testing.T) {
+	tests := []struct {
+		jitter Jitter
+		// bounds returns the allowed range for a delay given the unjittered
+		// delay and the previous delay.
+		bounds func(d, previous time.Duration) (time.Duration, time.Duration)
+	}{
+		{jitter: JitterNone, bounds: func(d, _ time.Duration) (time.Duration, time.Duration) { return d, d }},
+		{jitter: JitterFull, bounds: func(d, _ time.Duration) (time.Duration, time.Duration) { return 0, d }},
+		{jitter: JitterEqual, bounds: func(d, _ time.Duration) (time.Duration, time.Duration) { return d / 2, d }},
+		{jitter: JitterDecorrelated, bounds: func(d, previous time.Duration) (time.Duration, time.Duration) {
+			if d == 0 {
+				return 0, 0
+			}
+			return time.Second, min(max(time.Second, 3*previous), DefaultMaxDelay)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.jitter.String(), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				bo := New(WithJitter(tt.jitter))
+				var previous time.Duration
+				distinct := map[time.Duration]bool{}
+				for attempt := range int64(20) {
+					delay := bo.BackOff()
+					lo, hi := tt.bounds(DefaultMethodExponentialBackoff(attempt), previous)
+					assert.GreaterOrEqual(t, delay, lo, "attempt %d", attempt)
+					assert.LessOrEqual(t, delay, hi, "attempt %d", attempt)
+					distinct[delay] = true
+					previous = delay
+				}
+				if tt.jitter != JitterNone {
+					assert.Greater(t, len(distinct), 8, "delays should be randomised")
+				}
+			})
+		})
+	}
+}
+
+// TestBackerOff_Attempts verifies the attempt counter and its reset.
+func TestBackerOff_Attempts(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bo := New(WithResetAfter(time.Minute))
+		assert.Equal(t, int64(0), bo.Attempts())
+		bo.BackOff()
+		bo.BackOff()
+		assert.Equal(t, int64(2), bo.Attempts())
+		time.Sleep(61 * time.Second)
+		assert.Equal(t, int64(0), bo.Attempts())
+		bo.BackOff()
+		assert.Equal(t, int64(1), bo.Attempts())
+	})
+}
+
+// TestBackerOff_Wait verifies Wait sleeps for each delay and stops early when
+// the context is cancelled.
+func TestBackerOff_Wait(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bo := New()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		start := time.Now()
+		require.NoError(t, bo.Wait(ctx))
+		require.NoError(t, bo.Wait(ctx))
+		assert.Equal(t, time.Second, time.Since(start))
+
+		// Cancel part way through the 4 second delay.
+		go func() {
+			time.Sleep(time.Second)
+			cancel()
+		}()
+		start = time.Now()
+		assert.ErrorIs(t, bo.Wait(ctx), context.Canceled)
+		assert.Equal(t, time.Second, time.Since(start))
+
+		// A cancelled context does not record another attempt.
+		assert.ErrorIs(t, bo.Wait(ctx), context.Canceled)
+		assert.Equal(t, int64(3), bo.Attempts())
+	})
+}
+
+// TestParseJitter verifies jitter names round trip.
+func TestParseJitter(t *testing.T) {
+	for _, j := range []Jitter{JitterNone, JitterFull, JitterEqual, JitterDecorrelated} {
+		parsed, err := ParseJitter(j.String())
+		require.NoError(t, err)
+		assert.Equal(t, j, parsed)
+	}
+	parsed, err := ParseJitter(" Full ")
+	require.NoError(t, err)
+	assert.Equal(t, JitterFull, parsed)
+
+	_, err = ParseJitter("random")
+	assert.Error(t, err)
+}
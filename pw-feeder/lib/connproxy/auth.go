@@ -0,0 +1,146 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	authRejectedMetricName = "auth_rejected"
+	authRejectedMetricHelp = "Whether plane.watch is rejecting the feeder's API key, 1 while it is."
+
+	// DefaultAuthRejectedBackoff is how long the feeder waits between
+	// attempts while plane.watch is rejecting its API key.
+	DefaultAuthRejectedBackoff = 30 * time.Minute
+
+	// authImmediateClose is how soon after the TLS handshake completes a
+	// close by plane.watch counts as immediate.
+	authImmediateClose = 2 * time.Second
+
+	// authRejectedCloses is how many immediate closes in a row are taken to
+	// mean the API key was rejected.
+	authRejectedCloses = 5
+)
+
+// authMonitor recognises plane.watch rejecting the feeder's API key, either
+// with a TLS alert or by repeatedly closing the tunnel straight after the
+// handshake. It is used by a single proxy loop.
+type authMonitor struct {
+	// gauge reports whether the key is being rejected.
+	gauge prometheus.Gauge
+	// onRejected, if set, is called each time the key becomes rejected.
+	onRejected func()
+	// logger reports changes.
+	logger zerolog.Logger
+	// closes counts immediate closes in a row.
+	closes int
+	// rejected is set while the key is being rejected.
+	rejected bool
+}
+
+// newAuthMonitor returns an authMonitor for protocol that calls onRejected,
+// and registers its gauge with reg when it is not nil. The returned function
+// unregisters it.
+func newAuthMonitor(reg prometheus.Registerer, protocol string, onRejected func(), logger zerolog.Logger) (*authMonitor, func()) {
+	protocol = strings.ToLower(protocol)
+	m := &authMonitor{
+		gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        authRejectedMetricName,
+			Help:        authRejectedMetricHelp,
+			ConstLabels: prometheus.Labels{"protocol": protocol},
+		}),
+		onRejected: onRejected,
+		logger:     logger,
+	}
+	return m, registerMetrics(reg, "", protocol, []metricSpec{
+		{name: authRejectedMetricName, collector: m.gauge},
+	}, logger)
+}
+
+// observe updates the monitor with a session that ended after connecting, or
+// trying to connect, to plane.watch. It reports whether the key is being
+// rejected.
+func (m *authMonitor) observe(s Session) bool {
+	switch {
+	case s.CloseReason == CloseReasonAuthRejected:
+		m.closes = authRejectedCloses
+	case immediateClose(s):
+		m.closes++
+	case keyAccepted(s):
+		m.closes = 0
+		if m.rejected {
+			m.rejected = false
+			m.gauge.Set(0)
+			m.logger.Info().Msg("plane.watch has accepted the API key")
+		}
+		return false
+	case s.Established:
+		// A session ended by the feeder, or reset early by plane.watch, says
+		// nothing about the key either way.
+		return m.rejected
+	default:
+		// Failing to reach plane.watch says nothing about the key, but it
+		// does mean the closes before it were more likely a server restart.
+		m.closes = 0
+		return m.rejected
+	}
+
+	if m.closes < authRejectedCloses || m.rejected {
+		return m.rejected
+	}
+	m.rejected = true
+	m.gauge.Set(1)
+	m.logger.Error().
+		Str("reason", string(s.CloseReason)).
+		Msg("your API key was rejected by plane.watch, please check the API key in your configuration")
+	if m.onRejected != nil {
+		m.onRejected()
+	}
+	return true
+}
+
+// immediateClose reports whether plane.watch cleanly closed the established
+// session s soon after the handshake, without sending anything. Resets are
+// not counted, as a server going away is more likely than a rejected key.
+func immediateClose(s Session) bool {
+	if !s.Established || s.BytesRemoteToLocal > 0 || s.Duration() >= authImmediateClose {
+		return false
+	}
+	return s.CloseReason == CloseReasonRemoteEOF
+}
+
+// keyAccepted reports whether the established session s shows plane.watch
+// accepted the key, either by sending something or by keeping the tunnel open
+// past authImmediateClose until it closed it.
+func keyAccepted(s Session) bool {
+	if !s.Established {
+		return false
+	}
+	if s.BytesRemoteToLocal > 0 {
+		return true
+	}
+	remoteClose := s.CloseReason == CloseReasonRemoteEOF || s.CloseReason == CloseReasonRemoteReset
+	return remoteClose && s.Duration() >= authImmediateClose
+}
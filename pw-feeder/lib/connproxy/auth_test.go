@@ -0,0 +1,196 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"net"
+	"pw-feeder/lib/backoff"
+	"pw-feeder/lib/stunnel"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestAuthMonitor verifies repeated immediate closes and TLS alerts are
+// recognised as a rejected API key, and that a working session clears it.
+func TestAuthMonitor(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	calls := 0
+	m, unregister := newAuthMonitor(reg, "BEAST", func() { calls++ }, zerolog.Nop())
+
+	start := time.Now()
+	established := start.Add(10 * time.Second)
+	immediate := Session{Start: start, EstablishedAt: established, End: established.Add(time.Second), Established: true, CloseReason: CloseReasonRemoteEOF}
+	long := Session{Start: start, EstablishedAt: established, End: established.Add(time.Minute), Established: true, CloseReason: CloseReasonRemoteEOF}
+	dialFailed := Session{Start: start, End: start, CloseReason: CloseReasonDialTimeout}
+	alert := Session{Start: start, End: start, CloseReason: CloseReasonAuthRejected}
+
+	for range authRejectedCloses - 1 {
+		assert.False(t, m.observe(immediate))
+	}
+	assert.True(t, m.observe(immediate))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.gauge))
+
+	// The key stays rejected until a session works.
+	assert.True(t, m.observe(immediate))
+	assert.True(t, m.observe(dialFailed))
+	assert.Equal(t, 1, calls, "the handler should only be called when the key becomes rejected")
+	assert.False(t, m.observe(long))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.gauge))
+
+	// Closes that are not immediate, that carried data or that were resets do
+	// not count, and a failed connection starts the count again.
+	withData := immediate
+	withData.BytesRemoteToLocal = 10
+	localClose := immediate
+	localClose.CloseReason = CloseReasonLocalEOF
+	reset := immediate
+	reset.CloseReason = CloseReasonRemoteReset
+	for range authRejectedCloses {
+		assert.False(t, m.observe(withData))
+		assert.False(t, m.observe(localClose))
+		assert.False(t, m.observe(reset))
+	}
+	for range authRejectedCloses - 1 {
+		assert.False(t, m.observe(immediate))
+	}
+	assert.False(t, m.observe(dialFailed))
+	assert.False(t, m.observe(immediate))
+
+	// A long session ended by the feeder neither counts nor clears the count.
+	localLong := long
+	localLong.CloseReason = CloseReasonLocalEOF
+	for range authRejectedCloses - 2 {
+		assert.False(t, m.observe(immediate))
+	}
+	assert.False(t, m.observe(localLong))
+	assert.True(t, m.observe(immediate))
+	assert.Equal(t, 2, calls)
+	assert.True(t, m.observe(localLong), "a session ended by the feeder should not clear a rejected key")
+	assert.False(t, m.observe(long))
+
+	// A TLS alert rejects the key straight away.
+	assert.True(t, m.observe(alert))
+	assert.Equal(t, 3, calls)
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, metricFamilies, 1)
+	assert.Equal(t, "pwfeeder_auth_rejected", metricFamilies[0].GetName())
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
+
+// TestProxyBEASTConnectionAuthRejected verifies the proxy stops retrying at
+// the normal rate once plane.watch keeps closing the tunnel straight away,
+// and that it still stops promptly when cancelled.
+func TestProxyBEASTConnectionAuthRejected(t *testing.T) {
+	connectToPlaneWatchOriginal := connectToPlaneWatch
+	sniffTimeoutOriginal := sniffTimeout
+	t.Cleanup(func() {
+		connectToPlaneWatch = connectToPlaneWatchOriginal
+		sniffTimeout = sniffTimeoutOriginal
+	})
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return net.Dial("tcp4", addr)
+	}
+	sniffTimeout = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	// Start a mock plane.watch server that closes every tunnel straight away.
+	nl, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = nl.Close()
+	}()
+	var accepted atomic.Int32
+	wg.Go(func() {
+		for {
+			c, err := nl.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			_ = c.Close()
+		}
+	})
+
+	// Start a mock BEAST provider that keeps every connection open.
+	bp, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = bp.Close()
+	}()
+	wg.Go(func() {
+		for {
+			c, err := bp.Accept()
+			if err != nil {
+				return
+			}
+			context.AfterFunc(ctx, func() {
+				_ = c.Close()
+			})
+		}
+	})
+
+	rejected := make(chan struct{}, 1)
+	reg := prometheus.NewRegistry()
+	done := make(chan struct{})
+	wg.Go(func() {
+		defer close(done)
+		ProxyBEASTConnection(ctx, "BEAST", bp.Addr().String(), nl.Addr().String(), TestClientAPIKey.String(), false, reg,
+			WithAuthRejection(time.Hour, func() { rejected <- struct{}{} }),
+			WithBackoff(10*time.Millisecond, backoff.JitterNone),
+		)
+	})
+
+	select {
+	case <-rejected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the API key was not recognised as rejected")
+	}
+	assert.EqualValues(t, authRejectedCloses, accepted.Load())
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, authRejectedCloses, accepted.Load(), "the proxy should be waiting out the long backoff")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the proxy did not stop while waiting out the long backoff")
+	}
+	_ = nl.Close()
+	_ = bp.Close()
+	wg.Wait()
+}
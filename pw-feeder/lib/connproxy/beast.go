@@ -0,0 +1,390 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// beastEscape starts each BEAST frame, and is doubled when it appears
+	// within one.
+	beastEscape = 0x1a
+
+	// beastOptionFrame is the frame type of a receiver option command sent
+	// to a BEAST source.
+	beastOptionFrame = '1'
+
+	// beastTimestampSize is the size of the timestamp that starts each frame.
+	beastTimestampSize = 6
+
+	// beastVerifyFrames is how many frames from each connection are checked
+	// against the requested receiver options.
+	beastVerifyFrames = 1000
+
+	// beastVerifyBytes is how much of each connection is checked against the
+	// requested receiver options, when fewer frames arrive.
+	beastVerifyBytes = 64 * 1024
+
+	// beastSettingsWriteTimeout bounds sending the receiver options.
+	beastSettingsWriteTimeout = 5 * time.Second
+)
+
+// beastFrameLengths maps the BEAST frame types whose length is known to the
+// number of bytes following the type, before escaping: a 6 byte timestamp, a
+// signal level and the message.
+var beastFrameLengths = map[byte]int{
+	'1': beastTimestampSize + 1 + 2,
+	'2': beastTimestampSize + 1 + 7,
+	'3': beastTimestampSize + 1 + 14,
+}
+
+// beastScanState is where a beastScanner is within the stream.
+type beastScanState int
+
+const (
+	// beastBetweenFrames follows a complete frame.
+	beastBetweenFrames beastScanState = iota
+	// beastFrameType follows the escape byte that starts a frame.
+	beastFrameType
+	// beastInFrame is within a frame of known length.
+	beastInFrame
+	// beastUnknown is within a frame of unknown type or length, until the
+	// next frame starts.
+	beastUnknown
+)
+
+// beastScanner follows a BEAST stream across reads or writes, so a heartbeat
+// is only inserted between two frames, and optionally decodes each frame.
+type beastScanner struct {
+	// onFrame, if set, is called with the type and unescaped contents of
+	// each complete frame of known length. body is reused afterwards.
+	onFrame func(frameType byte, body []byte)
+	// state is where the scanner is within the stream.
+	state beastScanState
+	// frameType is the type of the current frame.
+	frameType byte
+	// remaining is the number of unescaped bytes left in the current frame.
+	remaining int
+	// escaped is set when the last byte was an escape byte within a frame.
+	escaped bool
+	// body collects the current frame when onFrame is set.
+	body []byte
+}
+
+// scan advances the scanner over p.
+func (s *beastScanner) scan(p []byte) {
+	for _, b := range p {
+		switch s.state {
+		case beastBetweenFrames:
+			if b == beastEscape {
+				s.state = beastFrameType
+			} else {
+				s.state = beastUnknown
+			}
+
+		case beastFrameType:
+			s.startFrame(b)
+
+		case beastInFrame, beastUnknown:
+			if s.escaped {
+				s.escaped = false
+				if b != beastEscape {
+					// A lone escape byte started a new frame.
+					s.startFrame(b)
+					continue
+				}
+			} else if b == beastEscape {
+				s.escaped = true
+				continue
+			}
+			if s.state == beastInFrame {
+				if s.onFrame != nil {
+					s.body = append(s.body, b)
+				}
+				s.remaining--
+				if s.remaining == 0 {
+					s.state = beastBetweenFrames
+					if s.onFrame != nil {
+						s.onFrame(s.frameType, s.body)
+					}
+				}
+			}
+		}
+	}
+}
+
+// startFrame begins a frame of type t.
+func (s *beastScanner) startFrame(t byte) {
+	length, ok := beastFrameLengths[t]
+	if !ok {
+		s.state = beastUnknown
+		return
+	}
+	s.state = beastInFrame
+	s.frameType = t
+	s.remaining = length
+	s.body = s.body[:0]
+}
+
+// betweenFrames reports whether the stream ended with a complete frame.
+func (s *beastScanner) betweenFrames() bool {
+	return s.state == beastBetweenFrames
+}
+
+// cut advances the scanner over p and returns the length of the longest
+// prefix of p that does not end within a frame of known length or on an escape
+// byte. Splitting the stream there never separates part of a frame from the
+// rest of it, other than within a frame of unknown type.
+func (s *beastScanner) cut(p []byte) int {
+	end := 0
+	for i := range p {
+		s.scan(p[i : i+1])
+		if s.state == beastBetweenFrames || (s.state == beastUnknown && !s.escaped) {
+			end = i + 1
+		}
+	}
+	return end
+}
+
+// beastSetting is a receiver option understood by Mode-S Beast hardware and
+// beast-splitter. It is set by sending the option letter for on or off.
+type beastSetting struct {
+	// name identifies the setting in ParseBeastSettings.
+	name string
+	// on is the option letter that enables the setting.
+	on byte
+	// off is the option letter that disables the setting.
+	off byte
+}
+
+// beastSettingTable lists the receiver options in the order they are sent.
+var beastSettingTable = []beastSetting{
+	{name: "binary", on: 'C', off: 'c'},
+	{name: "filter", on: 'D', off: 'd'},
+	{name: "mlat", on: 'E', off: 'e'},
+	{name: "crc", on: 'f', off: 'F'},
+	{name: "gps", on: 'G', off: 'g'},
+	{name: "rts", on: 'H', off: 'h'},
+	{name: "fec", on: 'i', off: 'I'},
+	{name: "modeac", on: 'J', off: 'j'},
+}
+
+// BeastSettings are the receiver options sent to a BEAST source when it is
+// connected, as option letters in the order they are sent. The zero value
+// sends nothing.
+type BeastSettings struct {
+	// letters are the option letters to send.
+	letters []byte
+}
+
+// ParseBeastSettings parses a comma separated list of receiver options. Each
+// of binary, filter (only DF11, DF17 and DF18), mlat, crc, gps (GPS rather
+// than 12 MHz timestamps), rts, fec and modeac is enabled by its name and
+// disabled with a "no" prefix, as in "modeac,nofilter,gps". Options not
+// listed are left as the source has them.
+func ParseBeastSettings(s string) (BeastSettings, error) {
+	requested := make(map[string]byte)
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		name, disable := strings.CutPrefix(field, "no")
+		i := slices.IndexFunc(beastSettingTable, func(setting beastSetting) bool {
+			return setting.name == name
+		})
+		if i < 0 {
+			// Names that themselves start with "no" are not prefixed.
+			name, disable = field, false
+			i = slices.IndexFunc(beastSettingTable, func(setting beastSetting) bool {
+				return setting.name == name
+			})
+		}
+		if i < 0 {
+			return BeastSettings{}, fmt.Errorf("unknown BEAST receiver option %q", field)
+		}
+		if _, ok := requested[name]; ok {
+			return BeastSettings{}, fmt.Errorf("BEAST receiver option %q is set more than once", name)
+		}
+		letter := beastSettingTable[i].on
+		if disable {
+			letter = beastSettingTable[i].off
+		}
+		requested[name] = letter
+	}
+
+	settings := BeastSettings{}
+	for _, setting := range beastSettingTable {
+		if letter, ok := requested[setting.name]; ok {
+			settings.letters = append(settings.letters, letter)
+		}
+	}
+	return settings, nil
+}
+
+// String returns the settings in the form ParseBeastSettings accepts.
+func (s BeastSettings) String() string {
+	names := make([]string, 0, len(s.letters))
+	for _, setting := range beastSettingTable {
+		switch {
+		case s.has(setting.on):
+			names = append(names, setting.name)
+		case s.has(setting.off):
+			names = append(names, "no"+setting.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// has reports whether letter is sent.
+func (s BeastSettings) has(letter byte) bool {
+	return slices.Contains(s.letters, letter)
+}
+
+// command returns the option frames that apply the settings.
+func (s BeastSettings) command() []byte {
+	cmd := make([]byte, 0, 3*len(s.letters))
+	for _, letter := range s.letters {
+		cmd = append(cmd, beastEscape, beastOptionFrame, letter)
+	}
+	return cmd
+}
+
+// send writes the settings to conn, which must be a newly connected BEAST
+// source. Nothing is written when no settings are configured.
+func (s BeastSettings) send(conn net.Conn) error {
+	if len(s.letters) == 0 {
+		return nil
+	}
+	err := conn.SetWriteDeadline(time.Now().Add(beastSettingsWriteTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(s.command())
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(time.Time{})
+}
+
+// beastVerifier checks the first frames read from a BEAST source against the
+// requested receiver options, and logs a warning for each option the stream
+// does not match. It is only read from by a single goroutine.
+type beastVerifier struct {
+	net.Conn
+
+	// settings are the requested receiver options.
+	settings BeastSettings
+	// logger reports mismatches.
+	logger zerolog.Logger
+	// scanner decodes the frames read.
+	scanner beastScanner
+	// frames counts the frames checked.
+	frames int
+	// bytes counts the bytes checked.
+	bytes int
+	// reported holds the options already reported as mismatched.
+	reported map[string]bool
+	// done is set once enough of the stream has been checked.
+	done bool
+}
+
+// newBeastVerifier wraps conn, checking what is read from it against
+// settings.
+func newBeastVerifier(conn net.Conn, settings BeastSettings, logger zerolog.Logger) *beastVerifier {
+	v := &beastVerifier{
+		Conn:     conn,
+		settings: settings,
+		logger:   logger,
+		reported: make(map[string]bool),
+	}
+	v.scanner.onFrame = v.check
+	return v
+}
+
+// Read reads from the source, checking the data until enough has been seen.
+func (v *beastVerifier) Read(b []byte) (int, error) {
+	n, err := v.Conn.Read(b)
+	if !v.done && n > 0 {
+		v.scanner.scan(b[:n])
+		v.bytes += n
+		if v.frames >= beastVerifyFrames || v.bytes >= beastVerifyBytes {
+			v.finish()
+		}
+	}
+	return n, err
+}
+
+// check compares a decoded frame with the requested options.
+func (v *beastVerifier) check(frameType byte, body []byte) {
+	v.frames++
+	message := body[beastTimestampSize+1:]
+
+	switch frameType {
+	case '1':
+		// Zero Mode A/C frames are heartbeats, not replies.
+		if v.settings.has('j') && slices.ContainsFunc(message, func(b byte) bool { return b != 0 }) {
+			v.mismatch("modeac", "Mode A/C replies are being received")
+		}
+	case '2', '3':
+		if df := message[0] >> 3; v.settings.has('D') && df != 11 && df != 17 && df != 18 {
+			v.mismatch("filter", fmt.Sprintf("DF%d messages are being received", df))
+		}
+	}
+
+	if v.settings.has('G') {
+		// GPS timestamps hold seconds since midnight in the top 18 bits
+		// and nanoseconds in the bottom 30.
+		ts := binary.BigEndian.Uint64(append([]byte{0, 0}, body[:beastTimestampSize]...))
+		if ts>>30 >= 86400 || ts&(1<<30-1) >= 1e9 {
+			v.mismatch("gps", "timestamps are not GPS time of day")
+		}
+	}
+}
+
+// finish stops checking, reporting a stream with no BEAST frames when binary
+// output was not turned off.
+func (v *beastVerifier) finish() {
+	v.done = true
+	if v.frames == 0 && !v.settings.has('c') {
+		v.mismatch("binary", fmt.Sprintf("no BEAST frames were found in the first %d bytes", v.bytes))
+	}
+	v.scanner.onFrame = nil
+}
+
+// mismatch reports that the stream does not match the option called name,
+// once per connection.
+func (v *beastVerifier) mismatch(name, detail string) {
+	if v.reported[name] {
+		return
+	}
+	v.reported[name] = true
+	v.logger.Warn().
+		Str("option", name).
+		Str("detail", detail).
+		Msg("BEAST source output does not match the requested receiver option")
+}
@@ -0,0 +1,270 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"pw-feeder/lib/stunnel"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestBeastScanner verifies frame boundaries are followed across writes,
+// escaped bytes and frames of unknown length.
+func TestBeastScanner(t *testing.T) {
+	modeS := []byte{beastEscape, '2', 1, 2, 3, 4, 5, 6, 0x80, 0x5d, 0x40, 0x62, 0x1e, 0x1a, 0x1a, 0x12, 0x34}
+
+	tests := []struct {
+		name   string
+		writes [][]byte
+		want   bool
+	}{
+		{name: "nothing written", want: true},
+		{name: "complete frame", writes: [][]byte{modeS}, want: true},
+		{name: "frame split across writes", writes: [][]byte{modeS[:5], modeS[5:]}, want: true},
+		{name: "split between escaped bytes", writes: [][]byte{modeS[:14], modeS[14:]}, want: true},
+		{name: "partial frame", writes: [][]byte{modeS[:len(modeS)-1]}, want: false},
+		{name: "heartbeat", writes: [][]byte{beastHeartbeat}, want: true},
+		{name: "unknown frame type", writes: [][]byte{{beastEscape, '4', 1, 2, 3}}, want: false},
+		{name: "resynchronised after unknown frame", writes: [][]byte{{beastEscape, '4', 1, 2, 3}, modeS}, want: true},
+		{name: "not BEAST", writes: [][]byte{[]byte("hello")}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := beastScanner{}
+			for _, w := range tt.writes {
+				s.scan(w)
+			}
+			assert.Equal(t, tt.want, s.betweenFrames())
+		})
+	}
+}
+
+// TestBeastScannerFrames verifies complete frames are decoded without their
+// escaping.
+func TestBeastScannerFrames(t *testing.T) {
+	type frame struct {
+		frameType byte
+		body      []byte
+	}
+	var frames []frame
+	s := beastScanner{onFrame: func(frameType byte, body []byte) {
+		frames = append(frames, frame{frameType, bytes.Clone(body)})
+	}}
+
+	s.scan([]byte{beastEscape, '2', 1, 2, 3, 4, 5, 6, 0x80, 0x5d, 0x40, 0x62, 0x1e, 0x1a})
+	s.scan([]byte{0x1a, 0x12, 0x34, beastEscape, '4', 9, beastEscape, '1', 0, 0, 0, 0, 0, 0, 0, 0})
+	s.scan([]byte{0})
+
+	assert.Equal(t, []frame{
+		{'2', []byte{1, 2, 3, 4, 5, 6, 0x80, 0x5d, 0x40, 0x62, 0x1e, 0x1a, 0x12, 0x34}},
+		{'1', []byte{0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}, frames)
+}
+
+// TestParseBeastSettings verifies receiver options are parsed into the
+// option letters beast-splitter understands.
+func TestParseBeastSettings(t *testing.T) {
+	tests := []struct {
+		in      string
+		command []byte
+		str     string
+		wantErr bool
+	}{
+		{in: "", str: ""},
+		{in: "modeac", command: []byte{beastEscape, '1', 'J'}, str: "modeac"},
+		{in: "nomodeac", command: []byte{beastEscape, '1', 'j'}, str: "nomodeac"},
+		{
+			in:      " GPS, nocrc ,modeac,filter",
+			command: []byte{beastEscape, '1', 'D', beastEscape, '1', 'F', beastEscape, '1', 'G', beastEscape, '1', 'J'},
+			str:     "filter,nocrc,gps,modeac",
+		},
+		{in: "crc,nofec", command: []byte{beastEscape, '1', 'f', beastEscape, '1', 'I'}, str: "crc,nofec"},
+		{in: "binary,mlat,rts", command: []byte{beastEscape, '1', 'C', beastEscape, '1', 'E', beastEscape, '1', 'H'}, str: "binary,mlat,rts"},
+		{in: "avr", wantErr: true},
+		{in: "no", wantErr: true},
+		{in: "modeac,nomodeac", wantErr: true},
+		{in: "crc,crc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			settings, err := ParseBeastSettings(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.str, settings.String())
+			if tt.command == nil {
+				assert.Empty(t, settings.command())
+			} else {
+				assert.Equal(t, tt.command, settings.command())
+			}
+		})
+	}
+}
+
+// TestBeastVerifier verifies a warning is logged for each requested receiver
+// option the source's data does not match.
+func TestBeastVerifier(t *testing.T) {
+	modeS := []byte{beastEscape, '3', 0, 0, 0, 0, 0, 1, 0x40, 0x8d, 0x4c, 0xa2, 0x47, 0x58, 0x99, 0x11, 0x05, 0x0b, 0x62, 0x61, 0xe3, 0x73, 0x66}
+	surveillance := []byte{beastEscape, '2', 0, 0, 0, 0, 0, 1, 0x40, 0x28, 0x00, 0x00, 0x1c, 0x1e, 0x73, 0x66}
+	modeAC := []byte{beastEscape, '1', 0, 0, 0, 0, 0, 1, 0x40, 0x12, 0x34}
+	// 86400 seconds past midnight is not a GPS time of day.
+	badTime := []byte{beastEscape, '1', 0x54, 0x60, 0x00, 0x00, 0x00, 0x00, 0x40, 0, 0}
+
+	tests := []struct {
+		name     string
+		settings string
+		data     []byte
+		want     []string
+	}{
+		{name: "matching", settings: "modeac,filter,gps", data: joinFrames(modeS, modeAC)},
+		{name: "mode a/c disabled", settings: "nomodeac", data: joinFrames(modeS, modeAC, modeAC), want: []string{"modeac"}},
+		{name: "heartbeats are not mode a/c", settings: "nomodeac", data: joinFrames(beastHeartbeat, modeS)},
+		{name: "filtered", settings: "filter", data: joinFrames(modeS, surveillance), want: []string{"filter"}},
+		{name: "gps", settings: "gps", data: joinFrames(modeS, badTime), want: []string{"gps"}},
+		{name: "not beast", settings: "crc", data: bytes.Repeat([]byte("*8d4ca2475899;\n"), beastVerifyBytes/15+1), want: []string{"binary"}},
+		{name: "binary disabled", settings: "nobinary", data: bytes.Repeat([]byte("*8d4ca2475899;\n"), beastVerifyBytes/15+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := ParseBeastSettings(tt.settings)
+			require.NoError(t, err)
+
+			out := bytes.Buffer{}
+			c1, c2 := net.Pipe()
+			defer func() {
+				_ = c1.Close()
+			}()
+			v := newBeastVerifier(c1, settings, zerolog.New(&out))
+			go func() {
+				_, _ = c2.Write(tt.data)
+				_ = c2.Close()
+			}()
+			data, err := io.ReadAll(v)
+			require.NoError(t, err)
+			assert.Equal(t, tt.data, data)
+
+			var got []string
+			for _, name := range []string{"binary", "filter", "gps", "modeac"} {
+				if bytes.Contains(out.Bytes(), []byte(`"option":"`+name+`"`)) {
+					got = append(got, name)
+				}
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, len(tt.want), bytes.Count(out.Bytes(), []byte("\n")), out.String())
+		})
+	}
+}
+
+// joinFrames joins frames into one stream.
+func joinFrames(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+// TestProxyBEASTConnectionSettings verifies the receiver options are sent to
+// the BEAST source before its data is forwarded, on every connection.
+func TestProxyBEASTConnectionSettings(t *testing.T) {
+	connectToPlaneWatchOriginal := connectToPlaneWatch
+	t.Cleanup(func() {
+		connectToPlaneWatch = connectToPlaneWatchOriginal
+	})
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return net.Dial("tcp4", addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	frame := []byte{beastEscape, '1', 1, 2, 3, 4, 5, 6, 0x40, 0x12, 0x34}
+	settings, err := ParseBeastSettings("modeac,nocrc")
+	require.NoError(t, err)
+
+	// Start a mock plane.watch server that accepts each tunnel and reads
+	// the frame.
+	nl, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = nl.Close()
+	}()
+	wg.Go(func() {
+		for {
+			c, err := nl.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, len(frame))
+			_, err = io.ReadFull(c, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, frame, buf)
+			_ = c.Close()
+		}
+	})
+
+	// Start a mock BEAST provider that records what it is sent before each
+	// frame, then closes the connection.
+	bp, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = bp.Close()
+	}()
+	received := make(chan []byte, 2)
+	wg.Go(func() {
+		for range 2 {
+			c, err := bp.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			buf := make([]byte, len(settings.command()))
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = io.ReadFull(c, buf)
+			assert.NoError(t, err)
+			received <- buf
+			_, err = c.Write(frame)
+			assert.NoError(t, err)
+			_, _ = io.Copy(io.Discard, c)
+			_ = c.Close()
+		}
+	})
+
+	wg.Go(func() {
+		ProxyBEASTConnection(ctx, "BEAST", bp.Addr().String(), nl.Addr().String(), TestClientAPIKey.String(), false, prometheus.NewRegistry(),
+			WithBeastSettings(settings),
+		)
+	})
+
+	want := []byte{beastEscape, '1', 'F', beastEscape, '1', 'J'}
+	assert.Equal(t, want, <-received)
+	assert.Equal(t, want, <-received)
+
+	cancel()
+	_ = nl.Close()
+	_ = bp.Close()
+	wg.Wait()
+}
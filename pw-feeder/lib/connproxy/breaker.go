@@ -0,0 +1,341 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	circuitBreakerStateMetricName = "circuit_breaker_state"
+	circuitBreakerStateMetricHelp = "The state of the circuit breaker for each plane.watch host, with a value of 1 for the current state."
+
+	circuitBreakerTripsMetricName = "circuit_breaker_trips_total"
+	circuitBreakerTripsMetricHelp = "Total number of times the circuit breaker for each plane.watch host opened."
+
+	// DefaultCircuitFailures is the number of failed connections in a row to
+	// a plane.watch host after which its circuit breaker opens, when no other
+	// number is configured.
+	DefaultCircuitFailures = 5
+
+	// DefaultCircuitOpenTime is how long a circuit breaker stays open before
+	// a probe connection is allowed, when no other time is configured.
+	DefaultCircuitOpenTime = time.Minute
+)
+
+// circuitProbeWait is how long a connection is held back while another
+// tunnel's probe of a half-open host is in progress. It is a variable so
+// tests can shorten it.
+var circuitProbeWait = 5 * time.Second
+
+// circuitState is the state of a circuit breaker.
+type circuitState string
+
+const (
+	// circuitClosed allows connections.
+	circuitClosed circuitState = "closed"
+	// circuitOpen refuses connections until the open time has passed.
+	circuitOpen circuitState = "open"
+	// circuitHalfOpen allows a single probe connection, which decides
+	// whether the breaker closes or opens again.
+	circuitHalfOpen circuitState = "half_open"
+)
+
+// circuitStates lists every circuit breaker state.
+var circuitStates = []circuitState{circuitClosed, circuitOpen, circuitHalfOpen}
+
+// errCircuitOpen is returned instead of connecting to a plane.watch host whose
+// circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitOpenError reports when a host whose circuit breaker is open may be
+// tried again.
+type circuitOpenError struct {
+	// host is the plane.watch host.
+	host string
+	// retryAt is when a connection to host may next be allowed.
+	retryAt time.Time
+}
+
+// Error describes the host and when it is retried.
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s for %s, retrying at %s", errCircuitOpen, e.host, e.retryAt.Format(time.TimeOnly))
+}
+
+// Unwrap returns errCircuitOpen.
+func (e *circuitOpenError) Unwrap() error {
+	return errCircuitOpen
+}
+
+// circuitRetryAt returns when the connection that failed with err may be
+// retried, if it was refused by an open circuit breaker.
+func circuitRetryAt(err error) (time.Time, bool) {
+	var openErr *circuitOpenError
+	if !errors.As(err, &openErr) {
+		return time.Time{}, false
+	}
+	return openErr.retryAt, true
+}
+
+// circuitBreaker tracks connections to a single plane.watch host.
+type circuitBreaker struct {
+	// state is the current state.
+	state circuitState
+	// failures counts failed connections in a row while closed.
+	failures int
+	// openUntil is when an open breaker allows a probe.
+	openUntil time.Time
+	// probing is set while the probe of a half-open breaker is in progress.
+	probing bool
+}
+
+// CircuitBreakers stops every tunnel connecting to a plane.watch host after
+// repeated failures to connect to it, so an outage does not cause a stream of
+// DNS lookups and TLS handshakes. Each host has its own breaker, shared by the
+// tunnels whatever port they connect to. Once a breaker has been open for the
+// open time, a single probe connection is allowed, and its result closes the
+// breaker or opens it again. It is safe for concurrent use, and a nil
+// CircuitBreakers allows every connection.
+type CircuitBreakers struct {
+	// failures is the number of failed connections in a row that opens a
+	// breaker.
+	failures int
+	// openTime is how long a breaker stays open before a probe is allowed.
+	openTime time.Duration
+	// mu protects breakers.
+	mu sync.Mutex
+	// breakers holds the breaker for each host.
+	breakers map[string]*circuitBreaker
+	// states reports the state of each breaker.
+	states *prometheus.GaugeVec
+	// trips counts breakers opening.
+	trips *prometheus.CounterVec
+	// logger records state changes.
+	logger zerolog.Logger
+}
+
+// NewCircuitBreakers returns CircuitBreakers that open after failures failed
+// connections in a row and allow a probe after openTime. A non-positive
+// openTime selects DefaultCircuitOpenTime, and a non-positive failures
+// disables the breakers by returning nil. It registers the breaker
+// collectors with reg when it is not nil, and the returned function
+// unregisters them.
+func NewCircuitBreakers(reg prometheus.Registerer, failures int, openTime time.Duration, logger zerolog.Logger) (*CircuitBreakers, func()) {
+	if failures <= 0 {
+		return nil, func() {}
+	}
+	if openTime <= 0 {
+		openTime = DefaultCircuitOpenTime
+	}
+
+	cb := &CircuitBreakers{
+		failures: failures,
+		openTime: openTime,
+		breakers: make(map[string]*circuitBreaker),
+		states: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      circuitBreakerStateMetricName,
+			Help:      circuitBreakerStateMetricHelp,
+		}, []string{"host", "state"}),
+		trips: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      circuitBreakerTripsMetricName,
+			Help:      circuitBreakerTripsMetricHelp,
+		}, []string{"host"}),
+		logger: logger,
+	}
+	metrics := []metricSpec{
+		{name: circuitBreakerStateMetricName, collector: cb.states},
+		{name: circuitBreakerTripsMetricName, collector: cb.trips},
+	}
+
+	return cb, registerMetrics(reg, "", "", metrics, logger)
+}
+
+// dial connects to addr with dial unless the circuit breaker for its host is
+// open, and records the result. A connection cancelled with ctx says nothing
+// about the host, so it is not recorded.
+func (cb *CircuitBreakers) dial(ctx context.Context, addr string, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	if cb == nil {
+		return dial(ctx, addr)
+	}
+	host := circuitHost(addr)
+	if err := cb.allow(host); err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx, addr)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled)) {
+		cb.abandon(host)
+		return conn, err
+	}
+	cb.record(host, err)
+	return conn, err
+}
+
+// check returns a circuitOpenError if the breakers of every host in addrs
+// refuse connections, without taking a probe. The error reports the earliest
+// time one of them may be tried.
+func (cb *CircuitBreakers) check(addrs []string) error {
+	if cb == nil || len(addrs) == 0 {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	var earliest *circuitOpenError
+	now := time.Now()
+	for _, addr := range addrs {
+		host := circuitHost(addr)
+		b, ok := cb.breakers[host]
+		if !ok {
+			return nil
+		}
+		var retryAt time.Time
+		switch {
+		case b.state == circuitOpen && now.Before(b.openUntil):
+			retryAt = b.openUntil
+		case b.state == circuitHalfOpen && b.probing:
+			retryAt = now.Add(circuitProbeWait)
+		default:
+			return nil
+		}
+		if earliest == nil || retryAt.Before(earliest.retryAt) {
+			earliest = &circuitOpenError{host: host, retryAt: retryAt}
+		}
+	}
+	return earliest
+}
+
+// allow returns a circuitOpenError if a connection to host must not be made
+// now. It moves an open breaker whose open time has passed to half-open, and
+// lets the caller make its probe.
+func (cb *CircuitBreakers) allow(host string) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b := cb.breaker(host)
+
+	switch b.state {
+	case circuitOpen:
+		if time.Now().Before(b.openUntil) {
+			return &circuitOpenError{host: host, retryAt: b.openUntil}
+		}
+		cb.setState(host, b, circuitHalfOpen)
+		cb.logger.Info().Str("host", host).Msg("trying a connection to plane.watch to see whether it has recovered")
+	case circuitHalfOpen:
+		if b.probing {
+			return &circuitOpenError{host: host, retryAt: time.Now().Add(circuitProbeWait)}
+		}
+	default:
+		return nil
+	}
+	b.probing = true
+	return nil
+}
+
+// abandon releases the probe of host, if one was in progress, after a
+// connection was cancelled, so another connection can make it.
+func (cb *CircuitBreakers) abandon(host string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.breaker(host).probing = false
+}
+
+// record updates the breaker for host with the result of a connection.
+func (cb *CircuitBreakers) record(host string, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b := cb.breaker(host)
+
+	if err == nil {
+		b.failures = 0
+		b.probing = false
+		if b.state != circuitClosed {
+			cb.setState(host, b, circuitClosed)
+			cb.logger.Info().Str("host", host).Msg("plane.watch is accepting connections again, resuming all tunnels")
+		}
+		return
+	}
+
+	switch b.state {
+	case circuitClosed:
+		b.failures++
+		if b.failures < cb.failures {
+			return
+		}
+	case circuitHalfOpen:
+		if !b.probing {
+			return
+		}
+	default:
+		// A connection started before the breaker opened has failed too.
+		return
+	}
+	b.failures = 0
+	b.probing = false
+	b.openUntil = time.Now().Add(cb.openTime)
+	cb.setState(host, b, circuitOpen)
+	cb.trips.WithLabelValues(host).Inc()
+	cb.logger.Warn().
+		Err(err).
+		Str("host", host).
+		Time("retry_at", b.openUntil).
+		Msg("plane.watch could not be reached repeatedly, pausing all tunnels to it")
+}
+
+// breaker returns the breaker for host, creating a closed one if there is
+// none. cb.mu must be held.
+func (cb *CircuitBreakers) breaker(host string) *circuitBreaker {
+	b, ok := cb.breakers[host]
+	if !ok {
+		b = &circuitBreaker{}
+		cb.breakers[host] = b
+		cb.setState(host, b, circuitClosed)
+	}
+	return b
+}
+
+// setState moves b, the breaker for host, to state. cb.mu must be held.
+func (cb *CircuitBreakers) setState(host string, b *circuitBreaker, state circuitState) {
+	b.state = state
+	for _, s := range circuitStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		cb.states.WithLabelValues(host, string(s)).Set(value)
+	}
+}
+
+// circuitHost returns the host that addr connects to, which identifies its
+// circuit breaker.
+func circuitHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestCircuitBreakers verifies a breaker opens after repeated failures for
+// every port on the host, allows a single probe once the open time has
+// passed, and closes when the probe succeeds.
+func TestCircuitBreakers(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	cb, unregister := NewCircuitBreakers(reg, 2, 50*time.Millisecond, zerolog.Nop())
+	require.NotNil(t, cb)
+
+	dials := 0
+	failing := func(_ context.Context, addr string) (net.Conn, error) {
+		dials++
+		return nil, assert.AnError
+	}
+
+	for range 2 {
+		_, err := cb.dial(t.Context(), "feed.example:12345", failing)
+		assert.ErrorIs(t, err, assert.AnError)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(cb.states.WithLabelValues("feed.example", string(circuitOpen))))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cb.trips.WithLabelValues("feed.example")))
+
+	// Other ports on the host are paused too, without connecting.
+	_, err := cb.dial(t.Context(), "feed.example:12346", failing)
+	assert.ErrorIs(t, err, errCircuitOpen)
+	assert.Equal(t, CloseReasonCircuitOpen, classifyDialError(err))
+	retryAt, ok := circuitRetryAt(err)
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(50*time.Millisecond), retryAt, 50*time.Millisecond)
+	assert.Equal(t, 2, dials)
+
+	// Other hosts are unaffected.
+	_, err = cb.dial(t.Context(), "other.example:12345", failing)
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, 3, dials)
+
+	// Only one probe is allowed once the breaker is half-open.
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, cb.allow("feed.example"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cb.states.WithLabelValues("feed.example", string(circuitHalfOpen))))
+	err = cb.allow("feed.example")
+	assert.ErrorIs(t, err, errCircuitOpen)
+
+	cb.record("feed.example", nil)
+	assert.NoError(t, cb.allow("feed.example"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cb.states.WithLabelValues("feed.example", string(circuitClosed))))
+	assert.Equal(t, 0.0, testutil.ToFloat64(cb.states.WithLabelValues("feed.example", string(circuitOpen))))
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Len(t, metricFamilies, 2)
+	problems, err := promlint.NewWithMetricFamilies(metricFamilies).Lint()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
+
+// TestCircuitBreakersProbeFails verifies a failed probe opens the breaker
+// again, while failures of connections started before it opened do not.
+func TestCircuitBreakersProbeFails(t *testing.T) {
+	cb, _ := NewCircuitBreakers(nil, 1, 20*time.Millisecond, zerolog.Nop())
+
+	require.NoError(t, cb.allow("feed.example"))
+	require.NoError(t, cb.allow("feed.example"))
+	cb.record("feed.example", assert.AnError)
+	cb.record("feed.example", assert.AnError)
+	assert.Equal(t, 1.0, testutil.ToFloat64(cb.trips.WithLabelValues("feed.example")))
+
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, cb.allow("feed.example"))
+	cb.record("feed.example", assert.AnError)
+	assert.Equal(t, 2.0, testutil.ToFloat64(cb.trips.WithLabelValues("feed.example")))
+	assert.ErrorIs(t, cb.allow("feed.example"), errCircuitOpen)
+}
+
+// TestCircuitBreakersCancelled verifies cancelled connections are not
+// counted as failures, and do not keep a probe from being made.
+func TestCircuitBreakersCancelled(t *testing.T) {
+	cb, _ := NewCircuitBreakers(nil, 1, 20*time.Millisecond, zerolog.Nop())
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	cancelled := func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, ctx.Err()
+	}
+
+	for range 3 {
+		_, err := cb.dial(ctx, "feed.example:12345", cancelled)
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.NoError(t, cb.allow("feed.example"))
+	assert.Equal(t, 0.0, testutil.ToFloat64(cb.trips.WithLabelValues("feed.example")))
+
+	// A probe cancelled while half-open lets the next connection probe.
+	cb.record("feed.example", assert.AnError)
+	time.Sleep(30 * time.Millisecond)
+	_, err := cb.dial(ctx, "feed.example:12345", cancelled)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoError(t, cb.allow("feed.example"))
+}
+
+// TestCircuitBreakersCheck verifies a tunnel is only held back when every
+// endpoint's breaker refuses connections, and that checking takes no probe.
+func TestCircuitBreakersCheck(t *testing.T) {
+	cb, _ := NewCircuitBreakers(nil, 1, 20*time.Millisecond, zerolog.Nop())
+	addrs := []string{"a.example:12345", "b.example:12345"}
+	assert.NoError(t, cb.check(addrs))
+
+	cb.record("a.example", assert.AnError)
+	assert.NoError(t, cb.check(addrs))
+	cb.record("b.example", assert.AnError)
+	err := cb.check(addrs)
+	assert.ErrorIs(t, err, errCircuitOpen)
+	_, ok := circuitRetryAt(err)
+	assert.True(t, ok)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, cb.check(addrs))
+	require.NoError(t, cb.allow("a.example"))
+	require.NoError(t, cb.allow("b.example"))
+	assert.ErrorIs(t, cb.check(addrs), errCircuitOpen, "both probes are in progress")
+
+	var nilBreakers *CircuitBreakers
+	assert.NoError(t, nilBreakers.check(addrs))
+}
+
+// TestCircuitBreakersDisabled verifies that without a failure threshold every
+// connection is made.
+func TestCircuitBreakersDisabled(t *testing.T) {
+	cb, unregister := NewCircuitBreakers(prometheus.NewRegistry(), 0, time.Minute, zerolog.Nop())
+	defer unregister()
+	assert.Nil(t, cb)
+
+	for range 10 {
+		_, err := cb.dial(t.Context(), "feed.example:12345", func(_ context.Context, addr string) (net.Conn, error) {
+			return nil, assert.AnError
+		})
+		assert.ErrorIs(t, err, assert.AnError)
+	}
+}
+
+// TestEndpointSetCircuitOpen verifies an endpoint refused by its circuit
+// breaker is not backed off, as it was never tried.
+func TestEndpointSetCircuitOpen(t *testing.T) {
+	es, unregister := newEndpointSet("a:1,b:1", "", nil, "BEAST", zerolog.Nop())
+	defer unregister()
+
+	_, _, err := es.connect(t.Context(), func(_ context.Context, addr string) (net.Conn, error) {
+		return nil, &circuitOpenError{host: addr, retryAt: time.Now().Add(time.Minute)}
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, errCircuitOpen)
+	_, ok := circuitRetryAt(err)
+	assert.True(t, ok)
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for _, e := range es.endpoints {
+		assert.True(t, e.retryAt.IsZero(), e.addr)
+	}
+}
+
+// TestProxyBEASTConnectionCircuitOpen verifies the local source is not
+// connected to while the breaker for plane.watch is open.
+func TestProxyBEASTConnectionCircuitOpen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	// Start a mock BEAST provider that counts its connections.
+	bp, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = bp.Close()
+	}()
+	var accepted atomic.Int32
+	wg.Go(func() {
+		for {
+			c, err := bp.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			_ = c.Close()
+		}
+	})
+
+	cb, _ := NewCircuitBreakers(nil, 1, time.Hour, zerolog.Nop())
+	cb.record("feed.example", assert.AnError)
+
+	history := NewSessionHistory(8)
+	done := make(chan struct{})
+	wg.Go(func() {
+		defer close(done)
+		ProxyBEASTConnection(ctx, "BEAST", bp.Addr().String(), "feed.example:12345", TestClientAPIKey.String(), false, nil,
+			WithCircuitBreakers(cb),
+			WithSessionHistory(history),
+		)
+	})
+
+	require.Eventually(t, func() bool {
+		return len(history.Sessions()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, CloseReasonCircuitOpen, history.Sessions()[0].CloseReason)
+	assert.Zero(t, accepted.Load())
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the proxy did not stop while the circuit was open")
+	}
+	_ = bp.Close()
+	wg.Wait()
+}
@@ -0,0 +1,262 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultCoalesceBytes is the flush threshold used when coalescing is
+	// enabled without a byte threshold. It matches the largest TLS record
+	// payload, so a full buffer is sent as a single record.
+	DefaultCoalesceBytes = 16 * 1024
+
+	// tlsMaxRecordPayload is the largest plaintext payload of a TLS record.
+	tlsMaxRecordPayload = 16 * 1024
+
+	// tlsRecordOverhead estimates the bytes added to each TLS record: a 5 byte
+	// header, a 1 byte inner content type and a 16 byte AEAD tag in TLS 1.3.
+	tlsRecordOverhead = 22
+
+	// coalesceCloseTimeout is how long closing a coalescing writer may spend
+	// flushing the data it holds.
+	coalesceCloseTimeout = time.Second
+
+	tunnelCoalescedWriteSizeMetricName = "coalesced_write_size_bytes"
+	tunnelCoalescedWriteSizeMetricHelp = "Size of the writes made to the plane.watch TLS connection by the coalescing writer. Writes over 16 KiB are sent as more than one TLS record."
+
+	tunnelCoalesceSavedMetricName = "coalesce_saved_bytes_total"
+	tunnelCoalesceSavedMetricHelp = "Estimated TLS record overhead avoided by coalescing writes to plane.watch."
+)
+
+// writeSizeBuckets spans a single short BEAST frame through to a full TLS
+// record.
+var writeSizeBuckets = prometheus.ExponentialBuckets(16, 2, 11)
+
+// coalesceMetrics holds the collectors updated by coalescing writers. The
+// collectors are usable whether or not they were registered.
+type coalesceMetrics struct {
+	// writeSize observes the size of each write to the TLS connection.
+	writeSize prometheus.Histogram
+	// saved counts the record overhead avoided by coalescing.
+	saved prometheus.Counter
+}
+
+// newCoalesceMetrics creates the coalescing collectors for protocol and
+// registers them with reg when it is not nil. The returned function
+// unregisters them.
+func newCoalesceMetrics(reg prometheus.Registerer, protocol string, logger zerolog.Logger) (*coalesceMetrics, func()) {
+	protocol = strings.ToLower(protocol)
+	constLabels := prometheus.Labels{"protocol": protocol}
+
+	m := &coalesceMetrics{
+		writeSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelCoalescedWriteSizeMetricName,
+			Help:        tunnelCoalescedWriteSizeMetricHelp,
+			ConstLabels: constLabels,
+			Buckets:     writeSizeBuckets,
+		}),
+		saved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelCoalesceSavedMetricName,
+			Help:        tunnelCoalesceSavedMetricHelp,
+			ConstLabels: constLabels,
+		}),
+	}
+
+	metrics := []metricSpec{
+		{name: tunnelCoalescedWriteSizeMetricName, collector: m.writeSize},
+		{name: tunnelCoalesceSavedMetricName, collector: m.saved},
+	}
+
+	return m, registerMetrics(reg, tunnelMetricsSubsystem, protocol, metrics, logger)
+}
+
+// tlsRecords returns the number of TLS records needed to send n bytes.
+func tlsRecords(n int) int {
+	return (n + tlsMaxRecordPayload - 1) / tlsMaxRecordPayload
+}
+
+// pendingChunk is a chunk of buffered data that a data mover read at readAt.
+type pendingChunk struct {
+	// n is the size of the chunk.
+	n int
+	// readAt is when the chunk was read.
+	readAt time.Time
+}
+
+// coalescingConn buffers small writes to a connection and sends them as a
+// single write, so a TLS connection carries fewer, larger records. Buffered
+// data is flushed once it reaches maxBytes or maxDelay after the first byte
+// was buffered, whichever comes first. Data written by a data mover is
+// observed by its forwarding stats when it is flushed, not when it is
+// buffered.
+type coalescingConn struct {
+	net.Conn
+
+	// maxDelay is the longest data may wait in the buffer.
+	maxDelay time.Duration
+	// maxBytes is the buffer size that triggers an immediate flush.
+	maxBytes int
+	// metrics observes each flush.
+	metrics *coalesceMetrics
+
+	// mu serialises writes to the underlying connection and protects the
+	// fields below.
+	mu sync.Mutex
+	// buf holds data waiting to be flushed.
+	buf []byte
+	// records is the number of TLS records the buffered data would have used
+	// without coalescing.
+	records int
+	// fs observes the buffered chunks in pending once they are flushed.
+	fs *forwardingStats
+	// pending are the buffered chunks written by a data mover.
+	pending []pendingChunk
+	// timer flushes the buffer after maxDelay.
+	timer *time.Timer
+	// err is the first error returned by the underlying connection.
+	err error
+}
+
+// newCoalescingConn wraps conn in a coalescing writer.
+func newCoalescingConn(conn net.Conn, maxDelay time.Duration, maxBytes int, metrics *coalesceMetrics) *coalescingConn {
+	if maxBytes <= 0 {
+		maxBytes = DefaultCoalesceBytes
+	}
+	c := &coalescingConn{
+		Conn:     conn,
+		maxDelay: maxDelay,
+		maxBytes: maxBytes,
+		metrics:  metrics,
+		buf:      make([]byte, 0, maxBytes),
+	}
+	c.timer = time.AfterFunc(maxDelay, c.flushTimer)
+	c.timer.Stop()
+	return c
+}
+
+// Write buffers p and flushes the buffer if it has reached the byte
+// threshold. An error from an earlier flush is returned instead of buffering.
+func (c *coalescingConn) Write(p []byte) (int, error) {
+	return c.writeForwarded(p, nil, time.Time{})
+}
+
+// writeForwarded buffers p like Write, and observes it with fs, if it is not
+// nil, once it has been flushed.
+func (c *coalescingConn) writeForwarded(p []byte, fs *forwardingStats, readAt time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		fs.written(len(p), readAt)
+		return 0, c.err
+	}
+	if fs != nil {
+		c.fs = fs
+		c.pending = append(c.pending, pendingChunk{n: len(p), readAt: readAt})
+	}
+
+	// Large writes gain nothing from buffering when nothing is waiting.
+	if len(c.buf) == 0 && len(p) >= c.maxBytes {
+		c.records = tlsRecords(len(p))
+		return c.writeLocked(p)
+	}
+
+	if len(c.buf) == 0 {
+		c.timer.Reset(c.maxDelay)
+	}
+	c.buf = append(c.buf, p...)
+	c.records += tlsRecords(len(p))
+
+	if len(c.buf) >= c.maxBytes {
+		c.timer.Stop()
+		if _, err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flushTimer flushes the buffer when maxDelay has elapsed.
+func (c *coalescingConn) flushTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		_, _ = c.flushLocked()
+	}
+}
+
+// flushLocked writes the buffered data to the underlying connection. c.mu must
+// be held.
+func (c *coalescingConn) flushLocked() (int, error) {
+	if len(c.buf) == 0 {
+		return 0, nil
+	}
+	n, err := c.writeLocked(c.buf)
+	c.buf = c.buf[:0]
+	return n, err
+}
+
+// writeLocked writes p to the underlying connection as a single write,
+// observes the pending chunks it carries and records the overhead saved by
+// coalescing. c.mu must be held.
+func (c *coalescingConn) writeLocked(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.err = err
+	}
+	for _, chunk := range c.pending {
+		c.fs.written(chunk.n, chunk.readAt)
+	}
+	c.pending = c.pending[:0]
+	c.metrics.writeSize.Observe(float64(len(p)))
+	c.metrics.saved.Add(float64((c.records - tlsRecords(len(p))) * tlsRecordOverhead))
+	c.records = 0
+	return n, err
+}
+
+// Close flushes any buffered data and closes the underlying connection. The
+// flush, and any write already in progress, is given coalesceCloseTimeout to
+// finish before the connection is closed regardless.
+func (c *coalescingConn) Close() error {
+	c.timer.Stop()
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(coalesceCloseTimeout))
+
+	c.mu.Lock()
+	if c.err == nil {
+		_, _ = c.flushLocked()
+	}
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
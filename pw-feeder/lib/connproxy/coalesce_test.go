@@ -0,0 +1,199 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingConn is a net.Conn that sends each write to a channel.
+type recordingConn struct {
+	net.Conn
+	// writes receives a copy of each write.
+	writes chan []byte
+	// err is returned by every write when set.
+	err error
+}
+
+// Write records p.
+func (c *recordingConn) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.writes <- bytes.Clone(p)
+	return len(p), nil
+}
+
+// Close does nothing.
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+// SetWriteDeadline does nothing.
+func (c *recordingConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// TestCoalescingConn verifies when buffered writes are flushed and the
+// overhead they save.
+func TestCoalescingConn(t *testing.T) {
+	frame := []byte{0x1a, '2', 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}
+
+	t.Run("flushes at byte threshold", func(t *testing.T) {
+		conn := &recordingConn{writes: make(chan []byte, 1)}
+		m, _ := newCoalesceMetrics(nil, "BEAST", zerolog.Nop())
+		c := newCoalescingConn(conn, time.Hour, 3*len(frame), m)
+		defer func() { _ = c.Close() }()
+
+		for range 2 {
+			n, err := c.Write(frame)
+			require.NoError(t, err)
+			assert.Equal(t, len(frame), n)
+		}
+		assert.Empty(t, conn.writes)
+
+		_, err := c.Write(frame)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat(frame, 3), <-conn.writes)
+		assert.Equal(t, float64(2*tlsRecordOverhead), testutil.ToFloat64(m.saved))
+	})
+
+	t.Run("flushes after max delay", func(t *testing.T) {
+		conn := &recordingConn{writes: make(chan []byte, 1)}
+		m, _ := newCoalesceMetrics(nil, "BEAST", zerolog.Nop())
+		c := newCoalescingConn(conn, 20*time.Millisecond, 0, m)
+		defer func() { _ = c.Close() }()
+
+		start := time.Now()
+		_, err := c.Write(frame)
+		require.NoError(t, err)
+		_, err = c.Write(frame)
+		require.NoError(t, err)
+
+		select {
+		case got := <-conn.writes:
+			assert.Equal(t, bytes.Repeat(frame, 2), got)
+			assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+		case <-time.After(time.Second):
+			t.Fatal("buffer was not flushed")
+		}
+		assert.Equal(t, float64(tlsRecordOverhead), testutil.ToFloat64(m.saved))
+	})
+
+	t.Run("large write bypasses buffer", func(t *testing.T) {
+		conn := &recordingConn{writes: make(chan []byte, 1)}
+		m, _ := newCoalesceMetrics(nil, "BEAST", zerolog.Nop())
+		c := newCoalescingConn(conn, time.Hour, len(frame), m)
+		defer func() { _ = c.Close() }()
+
+		large := bytes.Repeat(frame, 4)
+		_, err := c.Write(large)
+		require.NoError(t, err)
+		assert.Equal(t, large, <-conn.writes)
+		assert.Equal(t, float64(0), testutil.ToFloat64(m.saved))
+	})
+
+	t.Run("flush error is returned by next write", func(t *testing.T) {
+		conn := &recordingConn{writes: make(chan []byte, 1), err: net.ErrClosed}
+		m, _ := newCoalesceMetrics(nil, "BEAST", zerolog.Nop())
+		c := newCoalescingConn(conn, time.Millisecond, 0, m)
+		defer func() { _ = c.Close() }()
+
+		_, err := c.Write(frame)
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			_, err := c.Write(frame)
+			return err != nil
+		}, time.Second, 5*time.Millisecond)
+		_, err = c.Write(frame)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("forwarding stats observed at flush", func(t *testing.T) {
+		conn := &recordingConn{writes: make(chan []byte, 1)}
+		m, _ := newCoalesceMetrics(nil, "BEAST", zerolog.Nop())
+		c := newCoalescingConn(conn, time.Hour, 2*len(frame), m)
+		defer func() { _ = c.Close() }()
+		reg := prometheus.NewRegistry()
+		latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_latency_seconds"})
+		require.NoError(t, reg.Register(latency))
+		fs := &forwardingStats{latency: latency}
+		observed := func() uint64 {
+			metricFamilies, err := reg.Gather()
+			require.NoError(t, err)
+			return metricFamilies[0].GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+
+		readAt := fs.read(len(frame))
+		_, err := writeForwarded(c, frame, fs, readAt)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(frame)), fs.inFlight.Load())
+		assert.Zero(t, observed())
+
+		readAt = fs.read(len(frame))
+		_, err = writeForwarded(c, frame, fs, readAt)
+		require.NoError(t, err)
+		<-conn.writes
+		assert.Equal(t, int64(0), fs.inFlight.Load())
+		assert.Equal(t, uint64(2), observed())
+	})
+
+	t.Run("close flushes buffer", func(t *testing.T) {
+		conn := &recordingConn{writes: make(chan []byte, 1)}
+		m, _ := newCoalesceMetrics(nil, "BEAST", zerolog.Nop())
+		c := newCoalescingConn(conn, time.Hour, 0, m)
+
+		_, err := c.Write(frame)
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+		assert.Equal(t, frame, <-conn.writes)
+
+		_, err = c.Write(frame)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+}
+
+// TestNewCoalesceMetrics verifies metric naming conventions and cleanup.
+func TestNewCoalesceMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, unregister := newCoalesceMetrics(reg, "BEAST", zerolog.Nop())
+	m.writeSize.Observe(128)
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Len(t, metricFamilies, 2)
+	problems, err := promlint.NewWithMetricFamilies(metricFamilies).Lint()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
@@ -21,11 +21,13 @@ package connproxy
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
 	"os"
 	"pw-feeder/lib/backoff"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"pw-feeder/lib/network"
@@ -37,18 +39,45 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// transferError identifies whether a data mover failed while reading from its
+// source connection or writing to its destination connection.
+type transferError struct {
+	// read reports whether the error came from the source connection.
+	read bool
+	// err is the underlying connection error.
+	err error
+}
+
+// Error returns the underlying connection error message.
+func (e *transferError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying connection error.
+func (e *transferError) Unwrap() error {
+	return e.err
+}
+
+// deadlineListener is implemented by listeners that support accept deadlines,
+// such as *net.TCPListener and *net.UnixListener.
+type deadlineListener interface {
+	SetDeadline(t time.Time) error
+}
+
 // tunnelStats tracks the number of bytes transferred at each end of a tunnel.
+// The counters are updated atomically so the data path never takes a lock.
 type tunnelStats struct {
-	// mu protects the byte counters.
-	mu sync.RWMutex
 	// bytesRxLocal counts bytes read from the local connection.
-	bytesRxLocal uint64
+	bytesRxLocal atomic.Uint64
 	// bytesTxLocal counts bytes written to the local connection.
-	bytesTxLocal uint64
+	bytesTxLocal atomic.Uint64
 	// bytesRxRemote counts bytes read from the remote connection.
-	bytesRxRemote uint64
+	bytesRxRemote atomic.Uint64
 	// bytesTxRemote counts bytes written to the remote connection.
-	bytesTxRemote uint64
+	bytesTxRemote atomic.Uint64
+	// lastData records when data last moved through the tunnel, in Unix
+	// nanoseconds.
+	lastData atomic.Int64
 }
 
 var (
@@ -58,9 +87,9 @@ var (
 	// errSleepTime retains the legacy connection-error delay used by package tests.
 	errSleepTime = time.Second * 10
 
-	// connectToPlaneWatch wraps stunnel.Connect so tests can replace it.
-	connectToPlaneWatch = func(name, addr, sni string, insecure bool) (c net.Conn, err error) {
-		return stunnel.Connect(name, addr, sni, insecure)
+	// connectToPlaneWatch wraps stunnel.ConnectContext so tests can replace it.
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return stunnel.ConnectContext(ctx, name, addr, sni, insecure, opts...)
 	}
 )
 
@@ -76,88 +105,181 @@ const (
 
 // incrementByteCounter atomically adds values to the tunnel byte counters.
 func (ts *tunnelStats) incrementByteCounter(bytesRxLocal, bytesTxLocal, bytesRxRemote, bytesTxRemote uint64) {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
-	ts.bytesRxLocal += bytesRxLocal
-	ts.bytesTxLocal += bytesTxLocal
-	ts.bytesRxRemote += bytesRxRemote
-	ts.bytesTxRemote += bytesTxRemote
+	if bytesRxLocal != 0 {
+		ts.bytesRxLocal.Add(bytesRxLocal)
+	}
+	if bytesTxLocal != 0 {
+		ts.bytesTxLocal.Add(bytesTxLocal)
+	}
+	if bytesRxRemote != 0 {
+		ts.bytesRxRemote.Add(bytesRxRemote)
+	}
+	if bytesTxRemote != 0 {
+		ts.bytesTxRemote.Add(bytesTxRemote)
+	}
+	if bytesRxLocal|bytesTxLocal|bytesRxRemote|bytesTxRemote != 0 {
+		ts.lastData.Store(time.Now().UnixNano())
+	}
 }
 
-// readStats atomically returns the current tunnel byte counters.
+// lastDataTime returns when data last moved through the tunnel, or the zero
+// time if no data has moved.
+func (ts *tunnelStats) lastDataTime() time.Time {
+	lastData := ts.lastData.Load()
+	if lastData == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastData)
+}
+
+// readStats returns the current tunnel byte counters. Each counter is read
+// atomically, but the four are not read as a single snapshot.
 func (ts *tunnelStats) readStats() (bytesRxLocal, bytesTxLocal, bytesRxRemote, bytesTxRemote uint64) {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
-	return ts.bytesRxLocal, ts.bytesTxLocal, ts.bytesRxRemote, ts.bytesTxRemote
+	return ts.bytesRxLocal.Load(), ts.bytesTxLocal.Load(), ts.bytesRxRemote.Load(), ts.bytesTxRemote.Load()
 }
 
-// dataMover copies one chunk of data from connIn to connOut using buf.
-func dataMover(connIn net.Conn, connOut net.Conn, buf []byte, log zerolog.Logger) (bytesRead, bytesWritten int, err error) {
-	// Set a read deadline so the caller can periodically check its context.
-	err = connIn.SetReadDeadline(time.Now().Add(time.Second))
+// moverReader reads from a data mover's source connection, noting when each
+// chunk was read so fs can observe it while it is in flight.
+type moverReader struct {
+	// conn is the source connection.
+	conn net.Conn
+	// fs observes the chunks read.
+	fs *forwardingStats
+	// log records read errors.
+	log zerolog.Logger
+	// readAt is when the most recent chunk was read.
+	readAt time.Time
+}
+
+// Read reads a chunk from the source connection. Errors are returned as a
+// transferError, so io.CopyBuffer reports io.EOF rather than treating it as
+// the end of a successful copy.
+func (r *moverReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.readAt = r.fs.read(n)
+	}
 	if err != nil {
-		return
+		if !errors.Is(err, net.ErrClosed) {
+			r.log.Err(err).Msg("error reading from socket")
+		}
+		return n, &transferError{read: true, err: err}
 	}
+	return n, nil
+}
 
-	// Read a chunk from the source connection.
-	bytesRead, err = connIn.Read(buf)
-	if err != nil {
+// moverWriter writes the chunks read by a moverReader to a data mover's
+// destination connection, calling count after each one.
+type moverWriter struct {
+	// conn is the destination connection.
+	conn net.Conn
+	// r is the reader whose chunks are written.
+	r *moverReader
+	// log records write errors.
+	log zerolog.Logger
+	// count is called with the size of each chunk written.
+	count func(bytesRead, bytesWritten int)
+}
 
-		// Treat a read deadline as an empty read rather than an error.
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			return 0, 0, nil
+// Write writes a chunk to the destination connection.
+func (w *moverWriter) Write(p []byte) (int, error) {
+	n, err := writeForwarded(w.conn, p, w.r.fs, w.r.readAt)
+	if err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			w.log.Err(err).Msg("error writing to socket")
 		}
+		return n, &transferError{err: err}
+	}
+	w.count(len(p), n)
+	return n, nil
+}
+
+// forwardingWriter is implemented by connections that hold written data back,
+// such as coalescingConn. They observe each chunk with fs once it has actually
+// been written, rather than when the write returns.
+type forwardingWriter interface {
+	writeForwarded(p []byte, fs *forwardingStats, readAt time.Time) (int, error)
+}
 
-		log.Err(err).Msg("error reading from socket")
-		return
+// writeForwarded writes p, read at readAt, to conn and observes it with fs
+// once it has been written.
+func writeForwarded(conn net.Conn, p []byte, fs *forwardingStats, readAt time.Time) (int, error) {
+	if fw, ok := conn.(forwardingWriter); ok {
+		return fw.writeForwarded(p, fs, readAt)
 	}
-	bytesWritten, err = connOut.Write(buf[:bytesRead])
-	if err != nil {
-		if strings.Contains(err.Error(), "use of closed network connection") {
-			return
-		}
-		log.Err(err).Msg("error writing to socket")
-		return
+	n, err := conn.Write(p)
+	fs.written(len(p), readAt)
+	return n, err
+}
+
+// copyLoop copies data from connIn to connOut with io.CopyBuffer until a
+// transfer fails or ctx is cancelled, calling count after each chunk.
+// Cancelling ctx closes both connections, which unblocks a pending read or
+// write without the loop having to poll. It returns the transfer error, or nil
+// when ctx is cancelled.
+func copyLoop(
+	ctx context.Context,
+	connIn, connOut net.Conn,
+	fs *forwardingStats,
+	log zerolog.Logger,
+	count func(bytesRead, bytesWritten int),
+) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = connIn.Close()
+		_ = connOut.Close()
+	})
+	defer stop()
+
+	// The wrappers hide any ReaderFrom or WriterTo of the connections, so
+	// every chunk passes through buf and is observed.
+	r := &moverReader{conn: connIn, fs: fs, log: log}
+	w := &moverWriter{conn: connOut, r: r, log: log, count: count}
+	_, err := io.CopyBuffer(w, r, make([]byte, dataMoverBufferSize))
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// moveData copies data from connIn to connOut through q, or directly when q is
+// nil. connOut is closed once the transfer stops, so data it holds back, such
+// as coalesced writes, is flushed before the other data mover is stopped.
+func moveData(
+	ctx context.Context,
+	connIn, connOut net.Conn,
+	fs *forwardingStats,
+	q *moverQueue,
+	log zerolog.Logger,
+	count func(bytesRead, bytesWritten int),
+) error {
+	var err error
+	if q != nil {
+		err = queuedCopyLoop(ctx, connIn, connOut, q, fs, log, count)
+	} else {
+		err = copyLoop(ctx, connIn, connOut, fs, log, count)
 	}
-	return
+	_ = connOut.Close()
+	return err
 }
 
 // dataMoverNettoTLS copies data from the local connection to the TLS connection
-// until the context is cancelled or a transfer fails.
-func dataMoverNettoTLS(ctx context.Context, connA net.Conn, connB net.Conn, ts *tunnelStats, log zerolog.Logger) {
+// until the context is cancelled or a transfer fails. It returns the transfer
+// error, or nil when the context is cancelled.
+func dataMoverNettoTLS(ctx context.Context, connA net.Conn, connB net.Conn, ts *tunnelStats, fs *forwardingStats, q *moverQueue, log zerolog.Logger) error {
 	log = log.With().Str("conn", "client-side").Logger()
-	buf := make([]byte, dataMoverBufferSize)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			bytesRead, bytesWritten, err := dataMover(connA, connB, buf, log)
-			if err != nil {
-				return
-			}
-			ts.incrementByteCounter(uint64(bytesRead), 0, 0, uint64(bytesWritten))
-		}
-	}
+	return moveData(ctx, connA, connB, fs, q, log, func(bytesRead, bytesWritten int) {
+		ts.incrementByteCounter(uint64(bytesRead), 0, 0, uint64(bytesWritten))
+	})
 }
 
 // dataMoverTLStoNet copies data from the TLS connection to the local connection
-// until the context is cancelled or a transfer fails.
-func dataMoverTLStoNet(ctx context.Context, connA net.Conn, connB net.Conn, ts *tunnelStats, log zerolog.Logger) {
+// until the context is cancelled or a transfer fails. It returns the transfer
+// error, or nil when the context is cancelled.
+func dataMoverTLStoNet(ctx context.Context, connA net.Conn, connB net.Conn, ts *tunnelStats, fs *forwardingStats, q *moverQueue, log zerolog.Logger) error {
 	log = log.With().Str("conn", "server-side").Logger()
-	buf := make([]byte, dataMoverBufferSize)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			bytesRead, bytesWritten, err := dataMover(connA, connB, buf, log)
-			if err != nil {
-				return
-			}
-			ts.incrementByteCounter(0, uint64(bytesWritten), uint64(bytesRead), 0)
-		}
-	}
+	return moveData(ctx, connA, connB, fs, q, log, func(bytesRead, bytesWritten int) {
+		ts.incrementByteCounter(0, uint64(bytesWritten), uint64(bytesRead), 0)
+	})
 }
 
 // logStats periodically logs tunnel byte counters until the context is cancelled.
@@ -187,17 +309,13 @@ func registerTunnelMetrics(
 	ts *tunnelStats,
 	logger zerolog.Logger,
 ) func() {
-	if reg == nil {
-		return func() {}
-	}
-
-	type metricSpec struct {
+	type counterSpec struct {
 		endpoint  string
 		direction string
 		value     func() float64
 	}
 
-	metrics := []metricSpec{
+	counters := []counterSpec{
 		{
 			endpoint:  "local",
 			direction: "received",
@@ -233,39 +351,39 @@ func registerTunnelMetrics(
 	}
 
 	protocol = strings.ToLower(protocol)
-	collectors := make([]prometheus.Collector, 0, len(metrics))
-	for _, metric := range metrics {
-		collector := prometheus.NewCounterFunc(prometheus.CounterOpts{
-			Namespace: metricsNamespace,
-			Subsystem: tunnelMetricsSubsystem,
-			Name:      tunnelBytesMetricName,
-			Help:      tunnelBytesMetricHelp,
-			Unit:      "bytes",
-			ConstLabels: prometheus.Labels{
-				"protocol":  protocol,
-				"endpoint":  metric.endpoint,
-				"direction": metric.direction,
-			},
-		}, metric.value)
-
-		if err := reg.Register(collector); err != nil {
-			logger.Error().
-				Err(err).
-				Str("metric", prometheus.BuildFQName(metricsNamespace, tunnelMetricsSubsystem, tunnelBytesMetricName)).
-				Str("protocol", protocol).
-				Str("endpoint", metric.endpoint).
-				Str("direction", metric.direction).
-				Msg("error registering metric")
-			continue
-		}
-		collectors = append(collectors, collector)
+	metrics := make([]metricSpec, 0, len(counters))
+	for _, counter := range counters {
+		metrics = append(metrics, metricSpec{
+			name: tunnelBytesMetricName,
+			collector: prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Subsystem: tunnelMetricsSubsystem,
+				Name:      tunnelBytesMetricName,
+				Help:      tunnelBytesMetricHelp,
+				Unit:      "bytes",
+				ConstLabels: prometheus.Labels{
+					"protocol":  protocol,
+					"endpoint":  counter.endpoint,
+					"direction": counter.direction,
+				},
+			}, counter.value),
+		})
 	}
 
-	return func() {
-		for _, collector := range collectors {
-			reg.Unregister(collector)
-		}
+	return registerMetrics(reg, tunnelMetricsSubsystem, protocol, metrics, logger)
+}
+
+// waitForRetry waits before the next connection attempt. It waits until resume
+// when it is set, as the circuit breaker for plane.watch is open until then,
+// and otherwise for the next delay from bo.
+func waitForRetry(ctx context.Context, bo *backoff.BackerOff, resume time.Time, metrics *tunnelMetrics, logger zerolog.Logger) error {
+	if resume.IsZero() {
+		return bo.Wait(ctx)
 	}
+	delay := max(time.Until(resume), 0)
+	metrics.observeBackoff(delay)
+	logRetry(logger, delay)
+	return backoff.Sleep(ctx, delay)
 }
 
 // ProxyBEASTConnection continuously proxies BEAST data from a local endpoint to
@@ -275,8 +393,11 @@ func ProxyBEASTConnection(
 	protoname, localaddr, pwendpoint, apikey string,
 	insecure bool,
 	reg prometheus.Registerer,
+	opts ...Option,
 ) {
 
+	o := newProxyOptions(opts)
+
 	logger := log.With().Str("src", localaddr).Str("dst", pwendpoint).Str("proto", protoname).Logger()
 
 	outerWg := sync.WaitGroup{}
@@ -290,8 +411,52 @@ func ProxyBEASTConnection(
 	unregisterMetrics := registerTunnelMetrics(reg, protoname, &ts, logger)
 	defer unregisterMetrics()
 
-	bo := backoff.New(backoff.WithResetAfter(5 * time.Minute))
+	metrics, unregisterLifecycleMetrics := newTunnelMetrics(reg, protoname, &ts, logger)
+	defer unregisterLifecycleMetrics()
+
+	coalesce, unregisterCoalesceMetrics := o.newCoalescer(reg, protoname, logger)
+	defer unregisterCoalesceMetrics()
+
+	// Queued data is split between BEAST frames, so the drop policies only
+	// discard whole frames.
+	queues, unregisterQueueMetrics := newQueues(reg, protoname, o.queueDepth, o.queuePolicy, true, logger)
+	defer unregisterQueueMetrics()
+
+	handshakes, unregisterHandshakeMetrics := newHandshakeMetrics(reg, protoname, logger)
+	defer unregisterHandshakeMetrics()
+	tlsOpts := o.remoteTLSOptions(handshakes)
+
+	endpoints, closeEndpoints := newEndpointSet(pwendpoint, o.endpointSeed, reg, protoname, logger)
+	defer closeEndpoints()
+	dialPlaneWatch := func(ctx context.Context, addr string) (net.Conn, error) {
+		return o.breakers.dial(ctx, addr, func(ctx context.Context, addr string) (net.Conn, error) {
+			return connectToPlaneWatch(ctx, protoname, addr, apikey, insecure, tlsOpts...)
+		})
+	}
+
+	sources, closeSources := newSourceSet(localaddr, o.sourceStallTimeout, o.sourceHoldDown, reg, protoname, logger)
+	defer closeSources()
+	dialSource := func(ctx context.Context, addr string) (net.Conn, error) {
+		return network.ConnectToHostContext(ctx, protoname, addr, o.localDialOpts...)
+	}
+
+	sourceFormats, unregisterSourceFormatMetrics := newSourceFormatMetrics(reg, protoname, logger)
+	defer unregisterSourceFormatMetrics()
+
+	auth, unregisterAuthMetrics := newAuthMonitor(reg, protoname, o.authRejected, logger)
+	defer unregisterAuthMetrics()
+
+	var heartbeats prometheus.Counter
+	if o.heartbeatInterval > 0 {
+		var unregisterHeartbeatMetrics func()
+		heartbeats, unregisterHeartbeatMetrics = newHeartbeatMetrics(reg, protoname, logger)
+		defer unregisterHeartbeatMetrics()
+	}
+
+	bo := o.newBackoff(metrics, logger)
 	retry := false
+	rejected := false
+	var resume time.Time
 
 	for {
 
@@ -307,52 +472,170 @@ func ProxyBEASTConnection(
 		}
 
 		if retry {
-			sleepTime := bo.BackOff()
-			if sleepTime > 0 {
-				logger.Info().Msgf("retrying in %s seconds", sleepTime.String())
+			var err error
+			if rejected {
+				metrics.observeBackoff(o.authRejectedBackoff)
+				logRetry(logger, o.authRejectedBackoff)
+				err = backoff.Sleep(ctx, o.authRejectedBackoff)
 			} else {
-				logger.Info().Msg("retrying")
+				err = waitForRetry(ctx, bo, resume, metrics, logger)
+			}
+			resume = time.Time{}
+			if err != nil {
+				// The context was cancelled while waiting.
+				continue
 			}
-			time.Sleep(sleepTime)
 		}
 		retry = true
 
 		logger.Info().Msg("initiating connection to BEAST provider")
 
+		session := newSessionRecord(protoname, localaddr, pwendpoint, &ts)
+
+		// Don't connect to the local source while the tunnel can't be started.
+		err := o.breakers.check(endpoints.addrs())
+		if err != nil {
+			logger.Err(err).Msg("tunnel terminated. connections to the plane.watch feed-in server are paused")
+			metrics.sessionEnded(o.history, session.finish(classifyDialError(err), err))
+			resume, _ = circuitRetryAt(err)
+			continue
+		}
+
 		// Connect to the local endpoint (lc is the local connection).
-		lc, err := network.ConnectToHost(protoname, localaddr)
+		lc, src, err := sources.connect(ctx, dialSource)
+		metrics.connectAttempt(connectSideLocal, err)
 		if err != nil {
 			logger.Err(err).Msg("tunnel terminated. could not connect to the local data source, please ensure it is running and listening on the specified port")
+			metrics.sessionEnded(o.history, session.finish(classifyDialError(err), err))
 			continue
 		}
+		metrics.connected(connectSideLocal, lc.RemoteAddr())
+		session.localConnected(src)
+
+		// Configure the receiver before any of its data is forwarded.
+		err = o.beastSettings.send(lc)
+		if err != nil {
+			logger.Err(err).Stringer("options", o.beastSettings).Msg("tunnel terminated. could not send the receiver options to the local data source")
+			metrics.sessionEnded(o.history, session.finish(classifyTransferError(err, false), err))
+			_ = lc.Close()
+			continue
+		}
+
+		// Recognise the format of the source before connecting to plane.watch,
+		// so a source that is not sending BEAST is explained rather than
+		// forwarded or reported as not matching the receiver options.
+		// A stalled source is detected once the tunnel is running.
+		sniffer := newSniffConn(lc, src, sourceFormats, logger)
+		timeout := sniffTimeout
+		if o.sourceStallTimeout > 0 {
+			timeout = min(timeout, o.sourceStallTimeout)
+		}
+		err = sniffer.sniff(ctx, timeout)
+		switch {
+		case ctx.Err() != nil:
+			// Shutting down, nothing to report.
+		case errors.Is(err, errWrongSourceFormat):
+			logger.Err(err).Str("source", src).Msg("tunnel not started. the local data source is not sending BEAST data")
+			// Try the next source, if there is one.
+			sources.markFailed(src)
+		case err != nil:
+			logger.Err(err).Str("source", src).Msg("tunnel not started. could not read from the local data source")
+		}
+		if err != nil {
+			metrics.sessionEnded(o.history, session.finish(classifyTransferError(err, false), err))
+			_ = lc.Close()
+			continue
+		}
+		source := newBeastSource(sniffer, o.beastSettings, logger)
 
 		logger.Info().Msg("initiating tunnel connection to plane.watch")
 
 		// Connect to plane.watch (pwc is the plane.watch connection).
-		pwc, err := connectToPlaneWatch(protoname, pwendpoint, apikey, insecure)
+		pwc, endpoint, err := endpoints.connect(ctx, dialPlaneWatch)
+		metrics.connectAttempt(connectSideRemote, err)
 		if err != nil {
 			logger.Err(err).Msg("tunnel terminated. could not connect to the plane.watch feed-in server, please check your internet connection")
+			ended := session.finish(classifyDialError(err), err)
+			metrics.sessionEnded(o.history, ended)
+			rejected = auth.observe(ended)
+			resume, _ = circuitRetryAt(err)
 			_ = lc.Close()
 			continue
 		}
 
 		// Report that the tunnel is ready.
-		logger.Info().Msg("feeding BEAST data to plane.watch")
+		metrics.connected(connectSideRemote, pwc.RemoteAddr())
+		session.established(endpoint)
+		metrics.sessionEstablished()
+		logger.Info().Str("endpoint", endpoint).Stringer("address", pwc.RemoteAddr()).Msg("feeding BEAST data to plane.watch")
 
 		// Start tunnelling data. The data movers stop when a transfer fails or a
 		// connection is closed.
 
 		// Prepare a shared context for the data movers.
 		dataMoverCtx, dataMoverCancel := context.WithCancel(ctx)
+		cause := closeCause{}
+
+		// Heartbeats are written below the coalescer, so they are neither
+		// held back by it nor hidden from the write deadline.
+		upstream := pwc
+		if o.heartbeatInterval > 0 {
+			hc := newHeartbeatConn(pwc)
+			upstream = hc
+			progressed := upstreamProgress(pwc)
+			innerWg.Go(func() {
+				runHeartbeat(dataMoverCtx, hc, progressed, o.heartbeatInterval, o.heartbeatMisses, heartbeats, func(err error) {
+					logger.Warn().Err(err).Msg("plane.watch is not accepting heartbeats, closing the tunnel")
+					cause.set(CloseReasonHeartbeatTimeout, err)
+					dataMoverCancel()
+				})
+			})
+		}
+		upstream = coalesce(upstream)
+
+		if sources.failover() {
+			lastRead := localActivity(&ts)
+			innerWg.Go(func() {
+				sources.watchStall(dataMoverCtx, lastRead, func() {
+					logger.Warn().
+						Str("source", src).
+						Dur("silence", o.sourceStallTimeout).
+						Msg("nothing received from the BEAST source, trying the next one")
+					sources.markFailed(src)
+					cause.set(CloseReasonSourceStalled, nil)
+					dataMoverCancel()
+				})
+			})
+
+			// Switch back when a more preferred source recovers. The watcher,
+			// and any check it is making, stops with the session.
+			innerWg.Go(func() {
+				sources.watchFailback(dataMoverCtx, dialSource, func() {
+					cause.set(CloseReasonFailback, nil)
+					dataMoverCancel()
+				})
+			})
+		}
 
 		innerWg.Go(func() {
 			defer dataMoverCancel()
-			dataMoverNettoTLS(dataMoverCtx, lc, pwc, &ts, logger)
+			err := dataMoverNettoTLS(dataMoverCtx, source, upstream, &ts, metrics.upstream, queues.upstream, logger)
+			cause.set(classifyMoverError(err, false), err)
 		})
 
 		innerWg.Go(func() {
 			defer dataMoverCancel()
-			dataMoverTLStoNet(dataMoverCtx, pwc, lc, &ts, logger)
+			err := dataMoverTLStoNet(dataMoverCtx, pwc, lc, &ts, metrics.downstream, queues.downstream, logger)
+			cause.set(classifyMoverError(err, true), err)
+		})
+
+		// Reconnect when a more preferred endpoint recovers. The watcher, and
+		// any check it is making, stops with the session.
+		innerWg.Go(func() {
+			endpoints.watchFailback(dataMoverCtx, dialPlaneWatch, func() {
+				cause.set(CloseReasonFailback, nil)
+				dataMoverCancel()
+			})
 		})
 
 		// Close a channel when the inner wait group finishes so the notifier can
@@ -367,9 +650,12 @@ func ProxyBEASTConnection(
 		// Stop when the parent context is cancelled.
 		case <-ctx.Done():
 			logger.Debug().Msg("stopping")
+			cause.set(CloseReasonContextCancel, ctx.Err())
 			_ = pwc.Close()
 			_ = lc.Close()
 			innerWg.Wait()
+			reason, err := cause.get()
+			metrics.sessionEnded(o.history, session.finish(reason, err))
 			outerWg.Wait()
 			return
 
@@ -379,7 +665,16 @@ func ProxyBEASTConnection(
 			_ = lc.Close()
 			_ = pwc.Close()
 			// Report the terminated tunnel.
-			logger.Warn().Msg("tunnel to plane.watch has been terminated")
+			reason, err := cause.get()
+			ended := session.finish(reason, err)
+			metrics.sessionEnded(o.history, ended)
+			rejected = auth.observe(ended)
+			logger.Warn().
+				Str("reason", string(reason)).
+				Dur("duration", ended.Duration()).
+				Msg("tunnel to plane.watch has been terminated")
+			// Fail back without waiting.
+			retry = reason != CloseReasonFailback
 		}
 	}
 }
@@ -393,8 +688,11 @@ func ProxyMLATConnection(
 	pwendpoint, apikey string,
 	insecure bool,
 	reg prometheus.Registerer,
+	opts ...Option,
 ) {
 
+	o := newProxyOptions(opts)
+
 	logger := log.With().Str("listen", listener.Addr().String()).Str("dst", pwendpoint).Str("proto", protoname).Logger()
 	logger.Info().Msg("listening for connections from mlat-client")
 
@@ -409,8 +707,41 @@ func ProxyMLATConnection(
 	unregisterMetrics := registerTunnelMetrics(reg, protoname, &ts, logger)
 	defer unregisterMetrics()
 
-	bo := backoff.New(backoff.WithResetAfter(5 * time.Minute))
+	metrics, unregisterLifecycleMetrics := newTunnelMetrics(reg, protoname, &ts, logger)
+	defer unregisterLifecycleMetrics()
+
+	coalesce, unregisterCoalesceMetrics := o.newCoalescer(reg, protoname, logger)
+	defer unregisterCoalesceMetrics()
+
+	// The MLAT protocol cannot recover from lost data, so its queues always
+	// block when full.
+	queues, unregisterQueueMetrics := newQueues(reg, protoname, o.queueDepth, OverflowBlock, false, logger)
+	defer unregisterQueueMetrics()
+
+	handshakes, unregisterHandshakeMetrics := newHandshakeMetrics(reg, protoname, logger)
+	defer unregisterHandshakeMetrics()
+	tlsOpts := o.remoteTLSOptions(handshakes)
+
+	endpoints, closeEndpoints := newEndpointSet(pwendpoint, o.endpointSeed, reg, protoname, logger)
+	defer closeEndpoints()
+	dialPlaneWatch := func(ctx context.Context, addr string) (net.Conn, error) {
+		return o.breakers.dial(ctx, addr, func(ctx context.Context, addr string) (net.Conn, error) {
+			return connectToPlaneWatch(ctx, protoname, addr, apikey, insecure, tlsOpts...)
+		})
+	}
+
+	// Listeners without accept deadlines can only be unblocked by closing them.
+	dl, hasDeadline := listener.(deadlineListener)
+	if !hasDeadline {
+		stopCloser := context.AfterFunc(ctx, func() {
+			_ = listener.Close()
+		})
+		defer stopCloser()
+	}
+
+	bo := o.newBackoff(metrics, logger)
 	retry := false
+	var resume time.Time
 
 	for {
 
@@ -426,33 +757,37 @@ func ProxyMLATConnection(
 		}
 
 		if retry {
-			sleepTime := bo.BackOff()
-			if sleepTime > 0 {
-				logger.Info().Msgf("retrying in %s seconds", sleepTime.String())
-			} else {
-				logger.Info().Msg("retrying")
+			err := waitForRetry(ctx, bo, resume, metrics, logger)
+			resume = time.Time{}
+			if err != nil {
+				// The context was cancelled while waiting.
+				continue
 			}
-			time.Sleep(sleepTime)
 		}
 		retry = true
 
-		// Wait for a local connection with a deadline.
-		err := listener.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second * 1))
-		if err != nil {
-			logger.Err(err).Msg("Error setting accept deadline")
-			continue
+		// Wait for a local connection with a deadline when the listener supports one.
+		if hasDeadline {
+			err := dl.SetDeadline(time.Now().Add(time.Second * 1))
+			if err != nil {
+				logger.Err(err).Msg("Error setting accept deadline")
+				continue
+			}
 		}
 
 		lc, err := listener.Accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "timeout") {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
 				retry = false
 				continue
 			} else {
+				metrics.connectAttempt(connectSideLocal, err)
 				logger.Err(err).Msg("An error occurred attempting to accept the incoming connection")
 				continue
 			}
 		}
+		metrics.connectAttempt(connectSideLocal, nil)
+		metrics.connected(connectSideLocal, lc.RemoteAddr())
 
 		// Add the local client address only to this connection's logger.
 		// Keeping the base logger unchanged avoids retaining every previous client address.
@@ -461,28 +796,48 @@ func ProxyMLATConnection(
 
 		connectionLogger.Info().Msg("initiating tunnel connection to plane.watch")
 
+		session := newSessionRecord(protoname, lc.RemoteAddr().String(), pwendpoint, &ts)
+
 		// Connect to the plane.watch endpoint.
-		pwc, err := connectToPlaneWatch(protoname, pwendpoint, apikey, insecure)
+		pwc, endpoint, err := endpoints.connect(ctx, dialPlaneWatch)
+		metrics.connectAttempt(connectSideRemote, err)
 		if err != nil {
 			connectionLogger.Err(err).Msg("tunnel terminated. could not connect to the plane.watch feed-in server, please check your internet connection.")
+			metrics.sessionEnded(o.history, session.finish(classifyDialError(err), err))
+			resume, _ = circuitRetryAt(err)
 			_ = lc.Close()
 			continue
 		}
 
 		// Report that the tunnel is ready.
-		connectionLogger.Info().Msg("feeding MLAT results to plane.watch")
+		metrics.connected(connectSideRemote, pwc.RemoteAddr())
+		session.established(endpoint)
+		metrics.sessionEstablished()
+		connectionLogger.Info().Str("endpoint", endpoint).Stringer("address", pwc.RemoteAddr()).Msg("feeding MLAT results to plane.watch")
 
 		// Give both directions a shared per-connection context. When either mover
 		// exits, cancellation stops its peer and releases both connections.
 		dataMoverCtx, dataMoverCancel := context.WithCancel(ctx)
+		cause := closeCause{}
 
 		innerWg.Go(func() {
 			defer dataMoverCancel()
-			dataMoverNettoTLS(dataMoverCtx, lc, pwc, &ts, connectionLogger)
+			err := dataMoverNettoTLS(dataMoverCtx, lc, coalesce(pwc), &ts, metrics.upstream, queues.upstream, connectionLogger)
+			cause.set(classifyMoverError(err, false), err)
 		})
 		innerWg.Go(func() {
 			defer dataMoverCancel()
-			dataMoverTLStoNet(dataMoverCtx, pwc, lc, &ts, connectionLogger)
+			err := dataMoverTLStoNet(dataMoverCtx, pwc, lc, &ts, metrics.downstream, queues.downstream, connectionLogger)
+			cause.set(classifyMoverError(err, true), err)
+		})
+
+		// Reconnect when a more preferred endpoint recovers. The watcher, and
+		// any check it is making, stops with the session.
+		innerWg.Go(func() {
+			endpoints.watchFailback(dataMoverCtx, dialPlaneWatch, func() {
+				cause.set(CloseReasonFailback, nil)
+				dataMoverCancel()
+			})
 		})
 
 		// Close a channel when the inner wait group finishes so the notifier can
@@ -497,9 +852,12 @@ func ProxyMLATConnection(
 		// Stop when the parent context is cancelled.
 		case <-ctx.Done():
 			connectionLogger.Debug().Msg("stopping")
+			cause.set(CloseReasonContextCancel, ctx.Err())
 			_ = lc.Close()
 			_ = pwc.Close()
 			innerWg.Wait()
+			reason, err := cause.get()
+			metrics.sessionEnded(o.history, session.finish(reason, err))
 			outerWg.Wait()
 			return
 
@@ -509,7 +867,15 @@ func ProxyMLATConnection(
 			_ = lc.Close()
 			_ = pwc.Close()
 			// Report the terminated tunnel.
-			connectionLogger.Warn().Msg("tunnel to plane.watch has been terminated")
+			reason, err := cause.get()
+			ended := session.finish(reason, err)
+			metrics.sessionEnded(o.history, ended)
+			connectionLogger.Warn().
+				Str("reason", string(reason)).
+				Dur("duration", ended.Duration()).
+				Msg("tunnel to plane.watch has been terminated")
+			// Fail back without waiting.
+			retry = reason != CloseReasonFailback
 		}
 	}
 }
@@ -20,8 +20,13 @@ package connproxy
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"pw-feeder/lib/stunnel"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -134,7 +139,7 @@ func TestDataMover(t *testing.T) {
 		waitRead := make(chan bool)
 
 		wg.Go(func() {
-			dataMoverNettoTLS(ctx, connAOut, connBIn, &ts, logger)
+			dataMoverNettoTLS(ctx, connAOut, connBIn, &ts, nil, nil, logger)
 		})
 
 		wg.Go(func() {
@@ -173,7 +178,7 @@ func TestDataMover(t *testing.T) {
 		wg := sync.WaitGroup{}
 
 		wg.Go(func() {
-			dataMoverNettoTLS(ctx, connAOut, connBIn, &ts, logger)
+			dataMoverNettoTLS(ctx, connAOut, connBIn, &ts, nil, nil, logger)
 		})
 
 		// Cancel the context.
@@ -199,7 +204,7 @@ func TestDataMover(t *testing.T) {
 		wg := sync.WaitGroup{}
 
 		wg.Go(func() {
-			dataMoverTLStoNet(ctx, connAOut, connBIn, &ts, logger)
+			dataMoverTLStoNet(ctx, connAOut, connBIn, &ts, nil, nil, logger)
 		})
 
 		// Cancel the context.
@@ -215,6 +220,57 @@ func TestDataMover(t *testing.T) {
 		wg.Wait()
 	})
 
+	t.Run("context cancel unblocks idle mover", func(t *testing.T) {
+		connAIn, connAOut := net.Pipe()
+		connBIn, connBOut := net.Pipe()
+		defer func() {
+			_ = connAIn.Close()
+			_ = connBOut.Close()
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		ts := tunnelStats{}
+		done := make(chan error, 1)
+
+		go func() {
+			done <- dataMoverTLStoNet(ctx, connAOut, connBIn, &ts, nil, nil, logger)
+		}()
+
+		// Cancel the context without closing the connections.
+		cancel()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(250 * time.Millisecond):
+			t.Fatal("data mover did not return after context cancellation")
+		}
+
+		// The mover closes both of its connections.
+		_, err := connAOut.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+
+	t.Run("transfer error is returned", func(t *testing.T) {
+		connAIn, connAOut := net.Pipe()
+		connBIn, connBOut := net.Pipe()
+		defer func() {
+			_ = connAOut.Close()
+			_ = connBIn.Close()
+			_ = connBOut.Close()
+		}()
+
+		ts := tunnelStats{}
+
+		// Closing the source makes the next read fail with EOF.
+		_ = connAIn.Close()
+
+		err := dataMoverNettoTLS(context.Background(), connAOut, connBIn, &ts, nil, nil, logger)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
 	t.Run("TLS to Net working", func(t *testing.T) {
 		connAIn, connAOut := net.Pipe()
 		connBIn, connBOut := net.Pipe()
@@ -226,7 +282,7 @@ func TestDataMover(t *testing.T) {
 		waitRead := make(chan bool)
 
 		wg.Go(func() {
-			dataMoverTLStoNet(ctx, connAOut, connBIn, &ts, logger)
+			dataMoverTLStoNet(ctx, connAOut, connBIn, &ts, nil, nil, logger)
 		})
 
 		wg.Go(func() {
@@ -255,19 +311,18 @@ func TestDataMover(t *testing.T) {
 		wg.Wait()
 	})
 
-	t.Run("dataMover working", func(t *testing.T) {
+	t.Run("copyLoop working", func(t *testing.T) {
 		connAIn, connAOut := net.Pipe()
 		connBIn, connBOut := net.Pipe()
 
 		wg := sync.WaitGroup{}
 		waitRead := make(chan bool)
+		counted := make(chan [2]int, 1)
 
 		wg.Go(func() {
-			buf := make([]byte, dataMoverBufferSize)
-			bytesRead, bytesWritten, err := dataMover(connAOut, connBIn, buf, logger)
-			require.NoError(t, err)
-			assert.Equal(t, len(testBytes), bytesRead)
-			assert.Equal(t, len(testBytes), bytesWritten)
+			_ = copyLoop(context.Background(), connAOut, connBIn, nil, logger, func(bytesRead, bytesWritten int) {
+				counted <- [2]int{bytesRead, bytesWritten}
+			})
 		})
 
 		wg.Go(func() {
@@ -285,6 +340,7 @@ func TestDataMover(t *testing.T) {
 
 		// Wait for the read to complete.
 		_ = <-waitRead
+		assert.Equal(t, [2]int{len(testBytes), len(testBytes)}, <-counted)
 
 		// Close the connections.
 		_ = connBOut.Close()
@@ -296,16 +352,17 @@ func TestDataMover(t *testing.T) {
 		wg.Wait()
 	})
 
-	t.Run("dataMover error writing", func(t *testing.T) {
+	t.Run("copyLoop error writing", func(t *testing.T) {
 		connAIn, connAOut := net.Pipe()
 		connBIn, connBOut := net.Pipe()
 
 		wg := sync.WaitGroup{}
 
 		wg.Go(func() {
-			buf := make([]byte, dataMoverBufferSize)
-			_, _, err := dataMover(connAOut, connBIn, buf, logger)
-			require.Error(t, err)
+			err := copyLoop(context.Background(), connAOut, connBIn, nil, logger, func(int, int) {})
+			var te *transferError
+			require.ErrorAs(t, err, &te)
+			assert.False(t, te.read)
 		})
 
 		// Close the destination to induce a write error.
@@ -337,19 +394,22 @@ func TestProxyOutboundConnection(t *testing.T) {
 	t.Cleanup(func() {
 		connectToPlaneWatch = connectToPlaneWatchOriginal
 	})
-	connectToPlaneWatch = func(name, addr, sni string, insecure bool) (c net.Conn, err error) {
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
 		return net.Dial("tcp4", addr)
 	}
 
 	// Reduce test timing intervals.
 	logStatsIntervalOriginal := logStatsInterval
 	errSleepTimeOriginal := errSleepTime
+	sniffTimeoutOriginal := sniffTimeout
 	t.Cleanup(func() {
 		logStatsInterval = logStatsIntervalOriginal
 		errSleepTime = errSleepTimeOriginal
+		sniffTimeout = sniffTimeoutOriginal
 	})
 	logStatsInterval = time.Second * 1
 	errSleepTime = time.Second * 1
+	sniffTimeout = time.Millisecond * 100
 
 	t.Run("cannot connect to plane.watch endpoint", func(t *testing.T) {
 		var err error
@@ -692,7 +752,7 @@ func TestProxyInboundConnection(t *testing.T) {
 	t.Cleanup(func() {
 		connectToPlaneWatch = connectToPlaneWatchOriginal
 	})
-	connectToPlaneWatch = func(name, addr, sni string, insecure bool) (c net.Conn, err error) {
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
 		return net.DialTimeout("tcp4", addr, time.Second*10)
 	}
 
@@ -1000,4 +1060,150 @@ func TestProxyInboundConnection(t *testing.T) {
 		wg.Wait()
 
 	})
+
+	t.Run("working over unix socket without accept deadline", func(t *testing.T) {
+		var err error
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		wg := sync.WaitGroup{}
+
+		finishChan := make(chan bool)
+
+		// Create the mock plane.watch listener.
+		nl, err := nettest.NewLocalListener("tcp4")
+		require.NoError(t, err)
+		defer func() {
+			_ = nl.Close()
+		}()
+
+		// Start a mock plane.watch echo server for one connection.
+		wg.Go(func() {
+			buf := make([]byte, 1000)
+
+			c, err := nl.Accept()
+			require.NoError(t, err, "mock plane.watch server accepting connection")
+
+			n, err := c.Read(buf)
+			require.NoError(t, err, "mock plane.watch server reading from connection")
+			assert.Equal(t, testData, buf[:n])
+
+			_, err = c.Write(buf[:n])
+			require.NoError(t, err, "mock plane.watch server writing to connection")
+
+			_ = c.Close()
+			finishChan <- true
+		})
+
+		// Create the MLAT unix socket listener, hiding its SetDeadline method.
+		path := filepath.Join(t.TempDir(), "mlat.sock")
+		ul, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		mp := struct{ net.Listener }{ul}
+		defer func() {
+			_ = mp.Close()
+		}()
+
+		// Start the proxy.
+		wg.Go(func() {
+			ProxyMLATConnection(ctx, "MLAT", mp, nl.Addr().String(), TestClientAPIKey.String(), false, nil)
+		})
+
+		// Start the mock mlat-client.
+		wg.Go(func() {
+			buf := make([]byte, 1000)
+
+			c, err := net.Dial("unix", path)
+			require.NoError(t, err)
+
+			_, err = c.Write(testData)
+			require.NoError(t, err, "mock mlat-client writing to connection")
+
+			n, err := c.Read(buf)
+			require.NoError(t, err, "mock mlat-client reading from connection")
+			assert.Equal(t, testData, buf[:n])
+
+			_ = c.Close()
+			finishChan <- true
+		})
+
+		// Wait for both data transfers.
+		<-finishChan
+		<-finishChan
+
+		// Cancel the context. The proxy must return even though Accept has no deadline.
+		cancel()
+
+		// Wait for all goroutines to finish.
+		wg.Wait()
+	})
+}
+
+// tcpConnPair returns both ends of a loopback TCP connection.
+func tcpConnPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	l, err := nettest.NewLocalListener("tcp4")
+	require.NoError(tb, err)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	dialed, err := net.Dial("tcp4", l.Addr().String())
+	require.NoError(tb, err)
+	accepted, err := l.Accept()
+	require.NoError(tb, err)
+
+	return dialed, accepted
+}
+
+// BenchmarkDataMoverNettoTLS measures the throughput and allocations of one
+// tunnel direction over loopback TCP, using BEAST-sized writes.
+func BenchmarkDataMoverNettoTLS(b *testing.B) {
+	for _, chunkSize := range []int{64, 1024, 16 * 1024} {
+		b.Run(fmt.Sprintf("chunk=%d", chunkSize), func(b *testing.B) {
+			src, srcPeer := tcpConnPair(b)
+			dst, dstPeer := tcpConnPair(b)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			ts := tunnelStats{}
+			wg := sync.WaitGroup{}
+
+			wg.Go(func() {
+				_ = dataMoverNettoTLS(ctx, src, dst, &ts, nil, nil, zerolog.Nop())
+			})
+			wg.Go(func() {
+				_, _ = io.Copy(io.Discard, dstPeer)
+			})
+
+			chunk := make([]byte, chunkSize)
+			total := uint64(chunkSize) * uint64(b.N)
+
+			b.SetBytes(int64(chunkSize))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for range b.N {
+				_, err := srcPeer.Write(chunk)
+				require.NoError(b, err)
+			}
+
+			// Wait for every byte to reach the destination.
+			for {
+				_, _, _, bytesTxRemote := ts.readStats()
+				if bytesTxRemote >= total {
+					break
+				}
+				runtime.Gosched()
+			}
+
+			b.StopTimer()
+			cancel()
+			_ = srcPeer.Close()
+			_ = src.Close()
+			_ = dst.Close()
+			_ = dstPeer.Close()
+			wg.Wait()
+		})
+	}
 }
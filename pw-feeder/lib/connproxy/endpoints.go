@@ -0,0 +1,531 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pw-feeder/lib/backoff"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	tunnelEndpointActiveMetricName = "endpoint_active"
+	tunnelEndpointActiveMetricHelp = "The plane.watch feed-in endpoint the tunnel is connected to, with a value of 1."
+
+	tunnelEndpointHealthyMetricName = "endpoint_healthy"
+	tunnelEndpointHealthyMetricHelp = "Whether each plane.watch feed-in endpoint is accepting connections, or backing off after a failure."
+
+	tunnelEndpointSwitchesMetricName = "endpoint_switches_total"
+	tunnelEndpointSwitchesMetricHelp = "Total number of times the tunnel connected to a different plane.watch feed-in endpoint than before."
+)
+
+const (
+	// srvRefreshInterval is how long endpoints resolved from DNS SRV names are
+	// used before the names are looked up again.
+	srvRefreshInterval = 5 * time.Minute
+
+	// pendingConnMaxAge is how long a connection opened while checking for
+	// failback is kept for the next session before it is discarded.
+	pendingConnMaxAge = 10 * time.Second
+)
+
+var (
+	// failbackCheckInterval is how often a tunnel connected to a less
+	// preferred endpoint checks whether a more preferred one has recovered.
+	failbackCheckInterval = 30 * time.Second
+
+	// lookupSRV resolves DNS SRV names so tests can replace it.
+	lookupSRV = net.DefaultResolver.LookupSRV
+)
+
+// ParseEndpoints splits a comma-separated list of plane.watch feed-in
+// endpoints, most preferred first. Each entry is a host:port address, or a DNS
+// SRV name such as _beast._tcp.example.com that is looked up when connecting.
+func ParseEndpoints(s string) ([]string, error) {
+	var endpoints []string
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !isSRVName(entry) {
+			host, port, err := net.SplitHostPort(entry)
+			if err != nil {
+				return nil, fmt.Errorf("endpoint %q is neither host:port nor a DNS SRV name: %w", entry, err)
+			}
+			if host == "" || port == "" {
+				return nil, fmt.Errorf("endpoint %q needs both a host and a port", entry)
+			}
+		}
+		endpoints = append(endpoints, entry)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints given")
+	}
+	return endpoints, nil
+}
+
+// isSRVName reports whether endpoint is a DNS SRV name rather than a
+// host:port address.
+func isSRVName(endpoint string) bool {
+	_, _, err := net.SplitHostPort(endpoint)
+	return err != nil && strings.HasPrefix(endpoint, "_")
+}
+
+// shuffleEndpoints returns endpoints in an order chosen by seed, so every
+// feeder prefers a different endpoint but keeps the same preference across
+// restarts.
+func shuffleEndpoints(endpoints []string, seed string) []string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(seed))
+	shuffled := slices.Clone(endpoints)
+	rand.New(rand.NewPCG(h.Sum64(), 0)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// endpointBackoff returns the delay before retrying an endpoint that has
+// failed attempt+1 times in a row.
+func endpointBackoff(attempt int64) time.Duration {
+	return backoff.DefaultMethodExponentialBackoff(attempt + 1)
+}
+
+// endpoint tracks the health of a single feed-in server address.
+type endpoint struct {
+	// addr is the host:port address of the server.
+	addr string
+	// bo calculates how long the endpoint is skipped after each failure.
+	bo *backoff.BackerOff
+	// retryAt is when the endpoint may be tried again, or the zero time when
+	// it is healthy.
+	retryAt time.Time
+}
+
+// endpointMetrics holds the collectors describing the feed-in endpoints. The
+// collectors are usable whether or not they were registered.
+type endpointMetrics struct {
+	// active reports the endpoint the tunnel is connected to.
+	active *prometheus.GaugeVec
+	// healthy reports whether each endpoint is accepting connections.
+	healthy *prometheus.GaugeVec
+	// switches counts changes of the active endpoint.
+	switches prometheus.Counter
+}
+
+// endpointSet chooses which feed-in endpoint a proxy connects to. Endpoints
+// are tried in order of preference, skipping any that are backing off after a
+// failure, and a tunnel on a less preferred endpoint fails back once a more
+// preferred one recovers. It is safe for concurrent use.
+type endpointSet struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// configured are the addresses and SRV names in order of preference.
+	configured []string
+	// endpoints are the resolved addresses in order of preference.
+	endpoints []*endpoint
+	// resolvedAt is when SRV names were last looked up.
+	resolvedAt time.Time
+	// active is the address of the most recently connected endpoint.
+	active string
+	// pending is a connection opened while checking for failback, if any.
+	pending net.Conn
+	// pendingAddr is the address pending is connected to.
+	pendingAddr string
+	// pendingAt is when pending was opened.
+	pendingAt time.Time
+	// metrics describes the endpoints.
+	metrics *endpointMetrics
+	// logger records endpoint health changes.
+	logger zerolog.Logger
+}
+
+// newEndpointSet returns an endpointSet for the comma-separated endpoints in
+// s, shuffled by seed when it is not empty. It registers the endpoint
+// collectors for protocol with reg when it is not nil, and the returned
+// function unregisters them and closes any pending connection.
+func newEndpointSet(s, seed string, reg prometheus.Registerer, protocol string, logger zerolog.Logger) (*endpointSet, func()) {
+	configured, err := ParseEndpoints(s)
+	if err != nil {
+		// Let the connection attempt report the bad address.
+		configured = []string{s}
+	}
+	if seed != "" {
+		configured = shuffleEndpoints(configured, seed)
+	}
+
+	protocol = strings.ToLower(protocol)
+	constLabels := prometheus.Labels{"protocol": protocol}
+	es := &endpointSet{
+		configured: configured,
+		metrics: &endpointMetrics{
+			active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Subsystem:   tunnelMetricsSubsystem,
+				Name:        tunnelEndpointActiveMetricName,
+				Help:        tunnelEndpointActiveMetricHelp,
+				ConstLabels: constLabels,
+			}, []string{"address"}),
+			healthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Subsystem:   tunnelMetricsSubsystem,
+				Name:        tunnelEndpointHealthyMetricName,
+				Help:        tunnelEndpointHealthyMetricHelp,
+				ConstLabels: constLabels,
+			}, []string{"address"}),
+			switches: prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace:   metricsNamespace,
+				Subsystem:   tunnelMetricsSubsystem,
+				Name:        tunnelEndpointSwitchesMetricName,
+				Help:        tunnelEndpointSwitchesMetricHelp,
+				ConstLabels: constLabels,
+			}),
+		},
+		logger: logger,
+	}
+
+	metrics := []metricSpec{
+		{name: tunnelEndpointActiveMetricName, collector: es.metrics.active},
+		{name: tunnelEndpointHealthyMetricName, collector: es.metrics.healthy},
+		{name: tunnelEndpointSwitchesMetricName, collector: es.metrics.switches},
+	}
+	unregister := registerMetrics(reg, tunnelMetricsSubsystem, protocol, metrics, logger)
+
+	return es, func() {
+		es.mu.Lock()
+		conn, _ := es.takePending()
+		es.mu.Unlock()
+		if conn != nil {
+			_ = conn.Close()
+		}
+		unregister()
+	}
+}
+
+// connect returns a connection to the most preferred endpoint that is not
+// backing off, trying the others in order when it fails. When every endpoint
+// is backing off, all of them are tried. It also returns the address that was
+// connected to.
+func (es *endpointSet) connect(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, string, error) {
+	es.mu.Lock()
+	if conn, addr := es.takePending(); conn != nil {
+		es.setActive(addr)
+		es.mu.Unlock()
+		return conn, addr, nil
+	}
+	es.mu.Unlock()
+
+	err := es.resolve(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	es.mu.Lock()
+	now := time.Now()
+	candidates := make([]string, 0, len(es.endpoints))
+	for _, e := range es.endpoints {
+		if !now.Before(e.retryAt) {
+			candidates = append(candidates, e.addr)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, e := range es.endpoints {
+			candidates = append(candidates, e.addr)
+		}
+	}
+	es.mu.Unlock()
+
+	var errs []error
+	for _, addr := range candidates {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		conn, err := dial(ctx, addr)
+		es.mu.Lock()
+		if err != nil {
+			es.markFailed(addr, err)
+			es.mu.Unlock()
+			errs = append(errs, err)
+			continue
+		}
+		es.markHealthy(addr)
+		es.setActive(addr)
+		es.mu.Unlock()
+		return conn, addr, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// addrs returns the addresses of the endpoints as last resolved. Before the
+// first connection it returns the configured addresses, or nil when there are
+// SRV names still to look up.
+func (es *endpointSet) addrs() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.endpoints == nil {
+		if slices.ContainsFunc(es.configured, isSRVName) {
+			return nil
+		}
+		return slices.Clone(es.configured)
+	}
+	addrs := make([]string, 0, len(es.endpoints))
+	for _, e := range es.endpoints {
+		addrs = append(addrs, e.addr)
+	}
+	return addrs
+}
+
+// watchFailback checks every failbackCheckInterval whether an endpoint more
+// preferred than the active one accepts connections. When one does, the
+// connection is kept for the next call to connect and failback is called. It
+// returns once ctx is cancelled or failback has been called, or straight away
+// when the active endpoint is already the most preferred. Cancelling ctx also
+// cancels any check in progress.
+func (es *endpointSet) watchFailback(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error), failback func()) {
+	es.mu.Lock()
+	preferred := len(es.endpoints) == 0 || es.endpoints[0].addr == es.active
+	es.mu.Unlock()
+	if preferred {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(failbackCheckInterval):
+		}
+
+		es.mu.Lock()
+		now := time.Now()
+		var candidates []string
+		for _, e := range es.endpoints {
+			if e.addr == es.active {
+				break
+			}
+			if !now.Before(e.retryAt) {
+				candidates = append(candidates, e.addr)
+			}
+		}
+		es.mu.Unlock()
+
+		for _, addr := range candidates {
+			conn, err := dial(ctx, addr)
+			if ctx.Err() != nil {
+				if err == nil {
+					_ = conn.Close()
+				}
+				return
+			}
+			es.mu.Lock()
+			if err != nil {
+				es.markFailed(addr, err)
+				es.mu.Unlock()
+				continue
+			}
+			es.markHealthy(addr)
+			if stale, _ := es.takePending(); stale != nil {
+				_ = stale.Close()
+			}
+			es.pending, es.pendingAddr, es.pendingAt = conn, addr, time.Now()
+			es.mu.Unlock()
+
+			es.logger.Info().Str("endpoint", addr).Msg("preferred feed-in endpoint has recovered, failing back")
+			failback()
+			return
+		}
+	}
+}
+
+// resolve looks up any SRV names when they have not been looked up within
+// srvRefreshInterval, keeping the health of endpoints that remain. When a
+// lookup fails the previous endpoints are kept, if there are any. es.mu must
+// not be held, as it is not held during the lookups.
+func (es *endpointSet) resolve(ctx context.Context) error {
+	es.mu.Lock()
+	configuredAddrs := es.configured
+	hasSRV := slices.ContainsFunc(configuredAddrs, isSRVName)
+	fresh := es.endpoints != nil && (!hasSRV || time.Since(es.resolvedAt) < srvRefreshInterval)
+	es.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	var (
+		addrs   []string
+		lookErr error
+	)
+	for _, configured := range configuredAddrs {
+		if !isSRVName(configured) {
+			addrs = append(addrs, configured)
+			continue
+		}
+		srvAddrs, err := resolveSRV(ctx, configured)
+		if err != nil {
+			es.logger.Warn().Err(err).Str("name", configured).Msg("could not look up feed-in endpoints")
+			lookErr = err
+			continue
+		}
+		addrs = append(addrs, srvAddrs...)
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if lookErr != nil && es.endpoints != nil {
+		// Retry the lookup on the next connection rather than dropping
+		// endpoints that may still work.
+		return nil
+	}
+	es.resolvedAt = time.Now()
+	if len(addrs) == 0 {
+		return lookErr
+	}
+
+	previous := make(map[string]*endpoint, len(es.endpoints))
+	for _, e := range es.endpoints {
+		previous[e.addr] = e
+	}
+	endpoints := make([]*endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		e, ok := previous[addr]
+		if !ok {
+			e = &endpoint{
+				addr: addr,
+				bo:   backoff.New(backoff.WithMethod(endpointBackoff)),
+			}
+			es.metrics.healthy.WithLabelValues(addr).Set(1)
+		}
+		delete(previous, addr)
+		endpoints = append(endpoints, e)
+	}
+	for addr := range previous {
+		es.metrics.healthy.DeleteLabelValues(addr)
+	}
+	es.endpoints = endpoints
+	return nil
+}
+
+// resolveSRV returns the host:port addresses that name points to, in order of
+// priority. Records with equal priority are ordered by weight and then name,
+// so the order only changes when the records do.
+func resolveSRV(ctx context.Context, name string) ([]string, error) {
+	_, records, err := lookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(records, func(a, b *net.SRV) int {
+		return cmp.Or(
+			cmp.Compare(a.Priority, b.Priority),
+			cmp.Compare(b.Weight, a.Weight),
+			cmp.Compare(a.Target, b.Target),
+			cmp.Compare(a.Port, b.Port),
+		)
+	})
+
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		// A target of "." means the service is not available at this name.
+		target := strings.TrimSuffix(record.Target, ".")
+		if target == "" {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no usable SRV records", Name: name, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// find returns the endpoint with addr, or nil. es.mu must be held.
+func (es *endpointSet) find(addr string) *endpoint {
+	for _, e := range es.endpoints {
+		if e.addr == addr {
+			return e
+		}
+	}
+	return nil
+}
+
+// markFailed backs off from the endpoint at addr after err. An endpoint whose
+// circuit breaker is open was not tried, so it does not back off. es.mu must
+// be held.
+func (es *endpointSet) markFailed(addr string, err error) {
+	e := es.find(addr)
+	if e == nil || errors.Is(err, errCircuitOpen) {
+		return
+	}
+	e.retryAt = time.Now().Add(e.bo.BackOff())
+	es.metrics.healthy.WithLabelValues(addr).Set(0)
+	if len(es.endpoints) > 1 {
+		es.logger.Warn().Err(err).Str("endpoint", addr).Time("retry_at", e.retryAt).Msg("feed-in endpoint failed, skipping it until it is retried")
+	}
+}
+
+// markHealthy clears any backoff of the endpoint at addr. es.mu must be held.
+func (es *endpointSet) markHealthy(addr string) {
+	e := es.find(addr)
+	if e == nil || e.retryAt.IsZero() {
+		return
+	}
+	e.retryAt = time.Time{}
+	e.bo = backoff.New(backoff.WithMethod(endpointBackoff))
+	es.metrics.healthy.WithLabelValues(addr).Set(1)
+}
+
+// setActive records that the tunnel is connected to addr. es.mu must be held.
+func (es *endpointSet) setActive(addr string) {
+	if addr == es.active {
+		return
+	}
+	if es.active != "" {
+		es.metrics.active.DeleteLabelValues(es.active)
+		es.metrics.switches.Inc()
+		es.logger.Info().Str("endpoint", addr).Str("previous", es.active).Msg("switched feed-in endpoint")
+	}
+	es.metrics.active.WithLabelValues(addr).Set(1)
+	es.active = addr
+}
+
+// takePending returns the connection opened while checking for failback, or
+// nil when there is none or it is too old to use, and clears it. es.mu must be
+// held.
+func (es *endpointSet) takePending() (net.Conn, string) {
+	conn, addr := es.pending, es.pendingAddr
+	es.pending, es.pendingAddr = nil, ""
+	if conn != nil && time.Since(es.pendingAt) > pendingConnMaxAge {
+		_ = conn.Close()
+		return nil, ""
+	}
+	return conn, addr
+}
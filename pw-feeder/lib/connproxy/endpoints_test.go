@@ -0,0 +1,313 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEndpoints is a dial function whose endpoints can be made to fail.
+type fakeEndpoints struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// down lists the addresses that refuse connections.
+	down map[string]bool
+	// dialled records every address dialled, in order.
+	dialled []string
+}
+
+// dial records addr and returns a connection unless addr is down.
+func (f *fakeEndpoints) dial(_ context.Context, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dialled = append(f.dialled, addr)
+	if f.down[addr] {
+		return nil, errors.New(addr + " refused")
+	}
+	c, peer := net.Pipe()
+	_ = peer.Close()
+	return c, nil
+}
+
+// setDown marks addr as refusing connections or not.
+func (f *fakeEndpoints) setDown(addr string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[addr] = down
+}
+
+// takeDialled returns and clears the dialled addresses.
+func (f *fakeEndpoints) takeDialled() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dialled := f.dialled
+	f.dialled = nil
+	return dialled
+}
+
+// TestParseEndpoints verifies lists, SRV names and bad entries.
+func TestParseEndpoints(t *testing.T) {
+	endpoints, err := ParseEndpoints(" a.example:1, _beast._tcp.example.com ,[::1]:2,")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example:1", "_beast._tcp.example.com", "[::1]:2"}, endpoints)
+
+	for _, s := range []string{"", " , ", "a.example", ":1", "a.example:"} {
+		_, err := ParseEndpoints(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// TestShuffleEndpoints verifies the order depends only on the seed.
+func TestShuffleEndpoints(t *testing.T) {
+	endpoints := []string{"a:1", "b:1", "c:1", "d:1", "e:1"}
+
+	first := shuffleEndpoints(endpoints, "feeder-one")
+	assert.Equal(t, first, shuffleEndpoints(endpoints, "feeder-one"))
+	assert.ElementsMatch(t, endpoints, first)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1", "d:1", "e:1"}, endpoints, "input must not be modified")
+
+	preferred := map[string]bool{}
+	for _, seed := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		preferred[shuffleEndpoints(endpoints, seed)[0]] = true
+	}
+	assert.Greater(t, len(preferred), 1, "different seeds should prefer different endpoints")
+}
+
+// TestEndpointSetConnect verifies endpoints are tried in order, skipped while
+// backing off, and reported in metrics.
+func TestEndpointSetConnect(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	es, unregister := newEndpointSet("a:1,b:1,c:1", "", reg, "BEAST", zerolog.Nop())
+	f := &fakeEndpoints{down: map[string]bool{}}
+	ctx := context.Background()
+
+	c, addr, err := es.connect(ctx, f.dial)
+	require.NoError(t, err)
+	_ = c.Close()
+	assert.Equal(t, "a:1", addr)
+	assert.Equal(t, []string{"a:1"}, f.takeDialled())
+
+	// A failed endpoint is skipped until its backoff expires.
+	f.setDown("a:1", true)
+	_, addr, err = es.connect(ctx, f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", addr)
+	assert.Equal(t, []string{"a:1", "b:1"}, f.takeDialled())
+	_, addr, err = es.connect(ctx, f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", addr)
+	assert.Equal(t, []string{"b:1"}, f.takeDialled())
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(es.metrics.active.WithLabelValues("b:1")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(es.metrics.healthy.WithLabelValues("a:1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(es.metrics.healthy.WithLabelValues("b:1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(es.metrics.switches))
+
+	// Every endpoint is tried when all of them are backing off.
+	f.setDown("b:1", true)
+	f.setDown("c:1", true)
+	_, _, err = es.connect(ctx, f.dial)
+	assert.ErrorContains(t, err, "b:1 refused")
+	assert.ErrorContains(t, err, "c:1 refused")
+	f.takeDialled()
+	_, _, err = es.connect(ctx, f.dial)
+	require.Error(t, err)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, f.takeDialled())
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Len(t, metricFamilies, 3)
+	problems, err := promlint.NewWithMetricFamilies(metricFamilies).Lint()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
+
+// TestEndpointSetSRV verifies SRV names are expanded in priority order and
+// that the last good result is kept when a lookup fails.
+func TestEndpointSetSRV(t *testing.T) {
+	lookupSRVOriginal := lookupSRV
+	t.Cleanup(func() {
+		lookupSRV = lookupSRVOriginal
+	})
+	var lookupErr error
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if lookupErr != nil {
+			return "", nil, lookupErr
+		}
+		return name, []*net.SRV{
+			{Target: "backup.example.", Port: 2, Priority: 20},
+			{Target: "light.example.", Port: 1, Priority: 10, Weight: 1},
+			{Target: "heavy.example.", Port: 1, Priority: 10, Weight: 5},
+		}, nil
+	}
+
+	es, unregister := newEndpointSet("_beast._tcp.example.com,static.example:3", "", nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	f := &fakeEndpoints{down: map[string]bool{"heavy.example:1": true}}
+
+	_, addr, err := es.connect(context.Background(), f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "light.example:1", addr)
+	assert.Equal(t, []string{"heavy.example:1", "light.example:1"}, f.takeDialled())
+
+	// A failed lookup keeps the previous endpoints and their health.
+	lookupErr = &net.DNSError{Err: "server misbehaving", Name: "_beast._tcp.example.com"}
+	es.resolvedAt = time.Time{}
+	_, addr, err = es.connect(context.Background(), f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "light.example:1", addr)
+	assert.Equal(t, []string{"light.example:1"}, f.takeDialled())
+
+	// Without previous endpoints, the lookup error is returned.
+	es, unregister = newEndpointSet("_beast._tcp.example.com", "", nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	_, _, err = es.connect(context.Background(), f.dial)
+	var dnsErr *net.DNSError
+	assert.ErrorAs(t, err, &dnsErr)
+}
+
+// TestEndpointSetSRVUnlocked verifies the endpoint set is not locked while an
+// SRV lookup is in progress.
+func TestEndpointSetSRVUnlocked(t *testing.T) {
+	lookupSRVOriginal := lookupSRV
+	t.Cleanup(func() {
+		lookupSRV = lookupSRVOriginal
+	})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		close(started)
+		<-release
+		return name, []*net.SRV{{Target: "feed.example.", Port: 1}}, nil
+	}
+
+	es, unregister := newEndpointSet("_beast._tcp.example.com", "", nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	f := &fakeEndpoints{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, addr, err := es.connect(context.Background(), f.dial)
+		assert.NoError(t, err)
+		assert.Equal(t, "feed.example:1", addr)
+	}()
+
+	<-started
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		assert.Nil(t, es.addrs())
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the endpoint set was locked during the lookup")
+	}
+	close(release)
+	<-done
+}
+
+// TestEndpointSetFailback verifies that a recovered preferred endpoint ends
+// the session on a less preferred one, and that its connection is reused.
+func TestEndpointSetFailback(t *testing.T) {
+	failbackCheckIntervalOriginal := failbackCheckInterval
+	t.Cleanup(func() {
+		failbackCheckInterval = failbackCheckIntervalOriginal
+	})
+	failbackCheckInterval = 10 * time.Millisecond
+
+	es, unregister := newEndpointSet("a:1,b:1", "", nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	f := &fakeEndpoints{down: map[string]bool{"a:1": true}}
+
+	_, addr, err := es.connect(context.Background(), f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", addr)
+
+	// Recover the preferred endpoint once its backoff allows a retry.
+	es.mu.Lock()
+	es.find("a:1").retryAt = time.Now()
+	es.mu.Unlock()
+	f.setDown("a:1", false)
+	f.takeDialled()
+
+	failedBack := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		es.watchFailback(context.Background(), f.dial, func() { close(failedBack) })
+	}()
+	select {
+	case <-failedBack:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not fail back to the preferred endpoint")
+	}
+	<-done
+
+	_, addr, err = es.connect(context.Background(), f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "a:1", addr)
+	assert.Equal(t, []string{"a:1"}, f.takeDialled(), "the failback connection should be reused")
+	assert.Equal(t, float64(1), testutil.ToFloat64(es.metrics.switches))
+
+	// The watcher does nothing on the preferred endpoint.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	es.watchFailback(ctx, f.dial, func() { t.Error("failback called on the preferred endpoint") })
+
+	// Cancelling the session stops a check in progress without backing off
+	// the endpoint being checked.
+	es, unregister = newEndpointSet("a:1,b:1", "", nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	f = &fakeEndpoints{down: map[string]bool{"a:1": true}}
+	_, _, err = es.connect(context.Background(), f.dial)
+	require.NoError(t, err)
+	es.mu.Lock()
+	retryAt := time.Now()
+	es.find("a:1").retryAt = retryAt
+	es.mu.Unlock()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	es.watchFailback(ctx, func(ctx context.Context, addr string) (net.Conn, error) {
+		cancel()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, func() { t.Error("failback called after the session ended") })
+	es.mu.Lock()
+	assert.Equal(t, retryAt, es.find("a:1").retryAt)
+	es.mu.Unlock()
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"strconv"
+	"strings"
+
+	"pw-feeder/lib/stunnel"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	tunnelDNSDurationMetricName = "dns_duration_seconds"
+	tunnelDNSDurationMetricHelp = "Time taken to resolve the plane.watch feed-in server's host name."
+
+	tunnelConnectDurationMetricName = "connect_duration_seconds"
+	tunnelConnectDurationMetricHelp = "Time taken to establish the TCP connection to the plane.watch feed-in server."
+
+	tunnelHandshakeDurationMetricName = "tls_handshake_duration_seconds"
+	tunnelHandshakeDurationMetricHelp = "Time taken by the TLS handshake with the plane.watch feed-in server."
+
+	tunnelHandshakesMetricName = "tls_handshakes_total"
+	tunnelHandshakesMetricHelp = "Total number of completed TLS handshakes with plane.watch by whether a previous session was resumed."
+
+	tunnelPeerCertExpiryMetricName = "peer_certificate_expiry_timestamp_seconds"
+	tunnelPeerCertExpiryMetricHelp = "Unix time at which the certificate most recently presented by the plane.watch feed-in server expires."
+)
+
+// handshakeDurationBuckets spans a lookup answered from a local cache through
+// to a handshake close to the connection timeout.
+var handshakeDurationBuckets = prometheus.ExponentialBuckets(0.001, 2.5, 11)
+
+// handshakeMetrics holds the collectors updated as connections to plane.watch
+// are established. The collectors are usable whether or not they were
+// registered.
+type handshakeMetrics struct {
+	// dnsDuration observes host name resolution time.
+	dnsDuration prometheus.Histogram
+	// connectDuration observes TCP connection time.
+	connectDuration prometheus.Histogram
+	// handshakeDuration observes TLS handshake time.
+	handshakeDuration prometheus.Histogram
+	// handshakes counts handshakes by whether they resumed a session.
+	handshakes *prometheus.CounterVec
+	// peerCertExpiry reports when the server's certificate expires.
+	peerCertExpiry prometheus.Gauge
+}
+
+// newHandshakeMetrics creates the connection establishment collectors for
+// protocol and registers them with reg when it is not nil. The returned
+// function unregisters them.
+func newHandshakeMetrics(reg prometheus.Registerer, protocol string, logger zerolog.Logger) (*handshakeMetrics, func()) {
+	protocol = strings.ToLower(protocol)
+	constLabels := prometheus.Labels{"protocol": protocol}
+
+	newHistogram := func(name, help string) prometheus.Histogram {
+		return prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: constLabels,
+			Buckets:     handshakeDurationBuckets,
+		})
+	}
+
+	m := &handshakeMetrics{
+		dnsDuration:       newHistogram(tunnelDNSDurationMetricName, tunnelDNSDurationMetricHelp),
+		connectDuration:   newHistogram(tunnelConnectDurationMetricName, tunnelConnectDurationMetricHelp),
+		handshakeDuration: newHistogram(tunnelHandshakeDurationMetricName, tunnelHandshakeDurationMetricHelp),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelHandshakesMetricName,
+			Help:        tunnelHandshakesMetricHelp,
+			ConstLabels: constLabels,
+		}, []string{"resumed"}),
+		peerCertExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelPeerCertExpiryMetricName,
+			Help:        tunnelPeerCertExpiryMetricHelp,
+			ConstLabels: constLabels,
+		}),
+	}
+	for _, resumed := range []bool{false, true} {
+		m.handshakes.WithLabelValues(strconv.FormatBool(resumed))
+	}
+
+	metrics := []metricSpec{
+		{name: tunnelDNSDurationMetricName, collector: m.dnsDuration},
+		{name: tunnelConnectDurationMetricName, collector: m.connectDuration},
+		{name: tunnelHandshakeDurationMetricName, collector: m.handshakeDuration},
+		{name: tunnelHandshakesMetricName, collector: m.handshakes},
+		{name: tunnelPeerCertExpiryMetricName, collector: m.peerCertExpiry},
+	}
+
+	return m, registerMetrics(reg, tunnelMetricsSubsystem, protocol, metrics, logger)
+}
+
+// observe records how a connection to plane.watch was established. The DNS
+// duration is skipped when no host name was resolved.
+func (m *handshakeMetrics) observe(trace stunnel.ConnectTrace) {
+	if trace.DNS > 0 {
+		m.dnsDuration.Observe(trace.DNS.Seconds())
+	}
+	m.connectDuration.Observe(trace.Connect.Seconds())
+	m.handshakeDuration.Observe(trace.Handshake.Seconds())
+	m.handshakes.WithLabelValues(strconv.FormatBool(trace.State.DidResume)).Inc()
+	if len(trace.State.PeerCertificates) > 0 {
+		m.peerCertExpiry.Set(float64(trace.State.PeerCertificates[0].NotAfter.Unix()))
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"pw-feeder/lib/stunnel"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHandshakeMetricsObserve verifies each part of a trace is recorded.
+func TestHandshakeMetricsObserve(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, _ := newHandshakeMetrics(reg, "BEAST", zerolog.Nop())
+	notAfter := time.Unix(1900000000, 0)
+
+	m.observe(stunnel.ConnectTrace{
+		DNS:       time.Millisecond,
+		Connect:   2 * time.Millisecond,
+		Handshake: 3 * time.Millisecond,
+		State:     tls.ConnectionState{PeerCertificates: []*x509.Certificate{{NotAfter: notAfter}}},
+	})
+	m.observe(stunnel.ConnectTrace{
+		Connect:   2 * time.Millisecond,
+		Handshake: time.Millisecond,
+		State:     tls.ConnectionState{DidResume: true},
+	})
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.handshakes.WithLabelValues("false")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.handshakes.WithLabelValues("true")))
+	assert.Equal(t, float64(notAfter.Unix()), testutil.ToFloat64(m.peerCertExpiry))
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	samples := make(map[string]uint64)
+	for _, mf := range metricFamilies {
+		if h := mf.GetMetric()[0].GetHistogram(); h != nil {
+			samples[mf.GetName()] = h.GetSampleCount()
+		}
+	}
+	assert.Equal(t, map[string]uint64{
+		"pwfeeder_tunnel_dns_duration_seconds":           1,
+		"pwfeeder_tunnel_connect_duration_seconds":       2,
+		"pwfeeder_tunnel_tls_handshake_duration_seconds": 2,
+	}, samples)
+}
+
+// TestNewHandshakeMetrics checks metric naming conventions and cleanup.
+func TestNewHandshakeMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, unregister := newHandshakeMetrics(reg, "BEAST", zerolog.Nop())
+	m.peerCertExpiry.Set(1)
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Len(t, metricFamilies, 5)
+	problems, err := promlint.NewWithMetricFamilies(metricFamilies).Lint()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
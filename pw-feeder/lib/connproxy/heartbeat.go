@@ -0,0 +1,193 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"pw-feeder/lib/network"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultHeartbeatMisses is the number of heartbeat intervals in which
+	// plane.watch makes no progress with the data sent to it after which a
+	// tunnel is considered dead, when no other number is configured.
+	DefaultHeartbeatMisses = 3
+
+	tunnelHeartbeatsMetricName = "heartbeats_total"
+	tunnelHeartbeatsMetricHelp = "Number of heartbeat frames sent to plane.watch while the local source was quiet."
+)
+
+// errHeartbeatNoProgress is reported when plane.watch has neither
+// acknowledged nor sent anything for the configured number of heartbeat
+// intervals while data was waiting for it.
+var errHeartbeatNoProgress = errors.New("plane.watch stopped acknowledging data")
+
+// beastHeartbeat is a Mode A/C frame with a zero timestamp, signal level and
+// code. readsb sends the same frame to keep idle BEAST connections open, and
+// decoders discard it.
+var beastHeartbeat = []byte{beastEscape, '1', 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// heartbeatConn serialises writes to plane.watch with the heartbeats
+// inserted between them, and tracks when data was last written.
+type heartbeatConn struct {
+	net.Conn
+
+	// mu serialises writes and protects the fields below.
+	mu sync.Mutex
+	// scanner follows the written BEAST stream.
+	scanner beastScanner
+	// lastWrite is when data or a heartbeat was last written.
+	lastWrite time.Time
+}
+
+// newHeartbeatConn wraps conn, treating the time it was wrapped as its last
+// write.
+func newHeartbeatConn(conn net.Conn) *heartbeatConn {
+	return &heartbeatConn{Conn: conn, lastWrite: time.Now()}
+}
+
+// Write writes p to the underlying connection.
+func (c *heartbeatConn) Write(p []byte) (int, error) {
+	return c.writeForwarded(p, nil, time.Time{})
+}
+
+// writeForwarded writes p like Write, passing fs and readAt on to the
+// underlying connection so data it holds back is observed when it is sent.
+func (c *heartbeatConn) writeForwarded(p []byte, fs *forwardingStats, readAt time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := writeForwarded(c.Conn, p, fs, readAt)
+	c.scanner.scan(p[:n])
+	c.lastWrite = time.Now()
+	return n, err
+}
+
+// beat writes a heartbeat if nothing has been written for quiet and the
+// stream is between frames, giving up on the write after timeout. It reports
+// whether a heartbeat was written. A write in progress means the connection
+// is not quiet, so beat does not wait for it.
+func (c *heartbeatConn) beat(quiet, timeout time.Duration) (bool, error) {
+	if !c.mu.TryLock() {
+		return false, nil
+	}
+	defer c.mu.Unlock()
+	if time.Since(c.lastWrite) < quiet || !c.scanner.betweenFrames() {
+		return false, nil
+	}
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := c.Conn.Write(beastHeartbeat)
+	_ = c.Conn.SetWriteDeadline(time.Time{})
+	c.lastWrite = time.Now()
+	return err == nil, err
+}
+
+// newHeartbeatMetrics creates the heartbeat counter for protocol and
+// registers it with reg when it is not nil. The returned function
+// unregisters it.
+func newHeartbeatMetrics(reg prometheus.Registerer, protocol string, logger zerolog.Logger) (prometheus.Counter, func()) {
+	protocol = strings.ToLower(protocol)
+	sent := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   tunnelMetricsSubsystem,
+		Name:        tunnelHeartbeatsMetricName,
+		Help:        tunnelHeartbeatsMetricHelp,
+		ConstLabels: prometheus.Labels{"protocol": protocol},
+	})
+	return sent, registerMetrics(reg, tunnelMetricsSubsystem, protocol, []metricSpec{
+		{name: tunnelHeartbeatsMetricName, collector: sent},
+	}, logger)
+}
+
+// upstreamProgress returns a function reporting whether plane.watch has made
+// progress with conn since it was last called: it acknowledged or sent data,
+// or has nothing left to acknowledge. It returns nil when the progress of
+// conn cannot be read, such as on platforms without TCP_INFO.
+func upstreamProgress(conn net.Conn) func() bool {
+	last, err := network.ReadTCPProgress(conn)
+	if err != nil {
+		return nil
+	}
+	return func() bool {
+		p, err := network.ReadTCPProgress(conn)
+		if err != nil {
+			// A closed connection is reported by the data movers.
+			return true
+		}
+		progressed := !p.Outstanding || p.Acked != last.Acked || p.Received != last.Received
+		last = p
+		return progressed
+	}
+}
+
+// runHeartbeat writes a heartbeat to hc each interval that the local source
+// has been quiet. It calls dead with the error if a heartbeat cannot be
+// written within interval, or with errHeartbeatNoProgress once progressed,
+// when it is not nil, has reported no progress for misses intervals in a row.
+// It returns when ctx is cancelled or dead is called.
+func runHeartbeat(
+	ctx context.Context,
+	hc *heartbeatConn,
+	progressed func() bool,
+	interval time.Duration,
+	misses int,
+	sent prometheus.Counter,
+	dead func(err error),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if progressed != nil {
+			missed++
+			if progressed() {
+				missed = 0
+			}
+			if missed >= misses {
+				dead(errHeartbeatNoProgress)
+				return
+			}
+		}
+
+		wrote, err := hc.beat(interval, interval)
+		if err != nil {
+			if ctx.Err() == nil {
+				dead(err)
+			}
+			return
+		}
+		if wrote {
+			sent.Inc()
+		}
+	}
+}
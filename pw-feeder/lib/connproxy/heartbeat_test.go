@@ -0,0 +1,172 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"pw-feeder/lib/stunnel"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestHeartbeatConnBeat verifies heartbeats are only written when the
+// connection is quiet and between frames.
+func TestHeartbeatConnBeat(t *testing.T) {
+	conn := &recordingConn{writes: make(chan []byte, 4)}
+	hc := newHeartbeatConn(conn)
+
+	wrote, err := hc.beat(time.Hour, time.Second)
+	require.NoError(t, err)
+	assert.False(t, wrote, "the connection has not been quiet for long enough")
+
+	_, err = hc.Write(beastHeartbeat[:4])
+	require.NoError(t, err)
+	<-conn.writes
+	wrote, err = hc.beat(0, time.Second)
+	require.NoError(t, err)
+	assert.False(t, wrote, "a heartbeat must not split a frame")
+
+	_, err = hc.Write(beastHeartbeat[4:])
+	require.NoError(t, err)
+	<-conn.writes
+	wrote, err = hc.beat(0, time.Second)
+	require.NoError(t, err)
+	assert.True(t, wrote)
+	assert.Equal(t, beastHeartbeat, <-conn.writes)
+}
+
+// TestRunHeartbeatDead verifies a tunnel that plane.watch has stopped
+// accepting data on is reported dead.
+func TestRunHeartbeatDead(t *testing.T) {
+	// Writes to a pipe block until its peer reads.
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+	hc := newHeartbeatConn(client)
+	dead := make(chan error, 1)
+	runHeartbeat(t.Context(), hc, nil, 10*time.Millisecond, DefaultHeartbeatMisses, prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}), func(err error) {
+		dead <- err
+	})
+	assert.ErrorIs(t, <-dead, os.ErrDeadlineExceeded)
+}
+
+// TestRunHeartbeatNoProgress verifies a tunnel is reported dead once
+// plane.watch has made no progress for the configured number of intervals,
+// even though heartbeats can still be written.
+func TestRunHeartbeatNoProgress(t *testing.T) {
+	conn := &recordingConn{writes: make(chan []byte, 8)}
+	hc := newHeartbeatConn(conn)
+	checks := 0
+	progressed := func() bool {
+		checks++
+		// Progress is made once, then plane.watch goes silent.
+		return checks == 2
+	}
+	dead := make(chan error, 1)
+	runHeartbeat(t.Context(), hc, progressed, time.Millisecond, 3, prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}), func(err error) {
+		dead <- err
+	})
+	assert.ErrorIs(t, <-dead, errHeartbeatNoProgress)
+	assert.Equal(t, 5, checks)
+}
+
+// TestProxyBEASTConnectionHeartbeat verifies heartbeats follow coalesced
+// BEAST data while the source is quiet, and that a tunnel plane.watch
+// acknowledges but never answers on is kept open.
+func TestProxyBEASTConnectionHeartbeat(t *testing.T) {
+	connectToPlaneWatchOriginal := connectToPlaneWatch
+	t.Cleanup(func() {
+		connectToPlaneWatch = connectToPlaneWatchOriginal
+	})
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return net.Dial("tcp4", addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	frame := []byte{beastEscape, '1', 1, 2, 3, 4, 5, 6, 0x40, 0x12, 0x34}
+
+	// Start a mock plane.watch server that reads the frame and two
+	// heartbeats, then the rest of the stream, and never answers.
+	nl, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = nl.Close()
+	}()
+	received := make(chan []byte, 1)
+	wg.Go(func() {
+		c, err := nl.Accept()
+		require.NoError(t, err)
+		data := make([]byte, len(frame)+2*len(beastHeartbeat))
+		_, err = io.ReadFull(c, data)
+		require.NoError(t, err)
+		received <- data
+		_, _ = io.Copy(io.Discard, c)
+		_ = c.Close()
+	})
+
+	// Start a mock BEAST provider that sends one frame and goes quiet.
+	bp, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = bp.Close()
+	}()
+	wg.Go(func() {
+		c, err := bp.Accept()
+		require.NoError(t, err)
+		_, err = c.Write(frame)
+		require.NoError(t, err)
+		<-ctx.Done()
+		_ = c.Close()
+	})
+
+	reg := prometheus.NewRegistry()
+	history := NewSessionHistory(8)
+	wg.Go(func() {
+		ProxyBEASTConnection(ctx, "BEAST", bp.Addr().String(), nl.Addr().String(), TestClientAPIKey.String(), false, reg,
+			WithSessionHistory(history),
+			WithHeartbeat(20*time.Millisecond, DefaultHeartbeatMisses),
+			WithCoalescing(5*time.Millisecond, 16384),
+		)
+	})
+
+	data := <-received
+	assert.Equal(t, append(bytes.Clone(frame), bytes.Repeat(beastHeartbeat, 2)...), data)
+
+	// The tunnel stays open although plane.watch sends nothing back.
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, history.Sessions())
+
+	cancel()
+	wg.Wait()
+	require.Len(t, history.Sessions(), 1)
+	assert.Equal(t, CloseReasonContextCancel, history.Sessions()[0].CloseReason)
+}
@@ -0,0 +1,402 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"pw-feeder/lib/backoff"
+	"pw-feeder/lib/network"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	tunnelDisconnectsMetricName = "disconnects_total"
+	tunnelDisconnectsMetricHelp = "Total number of ended tunnel sessions and failed connection attempts by close reason."
+
+	tunnelUpMetricName = "up"
+	tunnelUpMetricHelp = "Whether the tunnel to plane.watch is currently established."
+
+	tunnelConnectAttemptsMetricName = "connect_attempts_total"
+	tunnelConnectAttemptsMetricHelp = "Total number of tunnel connection attempts by side and result."
+
+	tunnelConnectionsMetricName = "connections_total"
+	tunnelConnectionsMetricHelp = "Total number of tunnel connections established by side and address family."
+
+	tunnelSessionDurationMetricName = "session_duration_seconds"
+	tunnelSessionDurationMetricHelp = "Duration of established tunnel sessions."
+
+	tunnelLastDataMetricName = "last_data_timestamp_seconds"
+	tunnelLastDataMetricHelp = "Unix time at which data last moved through the tunnel, or 0 if none has."
+
+	tunnelBackoffDelayMetricName = "backoff_delay_seconds"
+	tunnelBackoffDelayMetricHelp = "Delay before the most recent tunnel reconnection attempt."
+
+	tunnelBackoffAttemptsMetricName = "backoff_attempts"
+	tunnelBackoffAttemptsMetricHelp = "Number of tunnel reconnection attempts in a row, reset after a period without any."
+
+	tunnelForwardingLatencyMetricName = "forwarding_latency_seconds"
+	tunnelForwardingLatencyMetricHelp = "Time between reading data from one end of the tunnel and finishing writing it to the other."
+
+	tunnelInFlightMetricName = "in_flight_bytes"
+	tunnelInFlightMetricHelp = "Bytes read from one end of the tunnel that have not yet been written to the other."
+)
+
+// Tunnel directions used by the forwarding metrics.
+const (
+	// directionUpstream is data flowing from the local peer to plane.watch.
+	directionUpstream = "upstream"
+	// directionDownstream is data flowing from plane.watch to the local peer.
+	directionDownstream = "downstream"
+)
+
+// connectSide identifies the end of the tunnel a connection attempt was made to.
+type connectSide string
+
+const (
+	// connectSideLocal is the local data source or client.
+	connectSideLocal connectSide = "local"
+	// connectSideRemote is the plane.watch feed-in server.
+	connectSideRemote connectSide = "remote"
+)
+
+// sessionDurationBuckets spans short-lived failures through to tunnels that
+// stay up for days.
+var sessionDurationBuckets = []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 7 * 24 * 3600}
+
+// forwardingLatencyBuckets spans 100µs, for an idle fast link, to around 26s
+// for a TLS write blocked on a stalled connection.
+var forwardingLatencyBuckets = prometheus.ExponentialBuckets(0.0001, 4, 10)
+
+// forwardingStats observes data passing through one direction of a tunnel. A
+// nil forwardingStats observes nothing.
+type forwardingStats struct {
+	// latency observes the time between reading data and finishing writing it.
+	latency prometheus.Observer
+	// inFlight counts bytes that have been read but not yet written.
+	inFlight atomic.Int64
+}
+
+// read records n bytes read from the source connection and returns the time
+// they were read.
+func (fs *forwardingStats) read(n int) time.Time {
+	if fs == nil {
+		return time.Time{}
+	}
+	fs.inFlight.Add(int64(n))
+	return time.Now()
+}
+
+// written records that the n bytes read at readAt have been written, or have
+// failed to be written, to the destination connection.
+func (fs *forwardingStats) written(n int, readAt time.Time) {
+	if fs == nil {
+		return
+	}
+	fs.inFlight.Add(-int64(n))
+	fs.latency.Observe(time.Since(readAt).Seconds())
+}
+
+// dropped records that n bytes that were read will never be written.
+func (fs *forwardingStats) dropped(n int) {
+	if fs == nil {
+		return
+	}
+	fs.inFlight.Add(-int64(n))
+}
+
+// closeReasons lists every close reason so each series is exported from zero.
+var closeReasons = []CloseReason{
+	CloseReasonLocalEOF,
+	CloseReasonLocalReset,
+	CloseReasonRemoteEOF,
+	CloseReasonRemoteReset,
+	CloseReasonPeerTimeout,
+	CloseReasonHeartbeatTimeout,
+	CloseReasonSourceStalled,
+	CloseReasonWrongSourceFormat,
+	CloseReasonTLSAlert,
+	CloseReasonDialTimeout,
+	CloseReasonDNSFailure,
+	CloseReasonAuthRejected,
+	CloseReasonCircuitOpen,
+	CloseReasonFailback,
+	CloseReasonContextCancel,
+	CloseReasonError,
+}
+
+// tunnelMetrics holds the collectors updated by a proxy loop as its tunnel
+// sessions start and end. The collectors are usable whether or not they were
+// registered.
+type tunnelMetrics struct {
+	// disconnects counts ended sessions by close reason.
+	disconnects *prometheus.CounterVec
+	// up reports whether a session is established.
+	up prometheus.Gauge
+	// connectAttempts counts connection attempts by side and result.
+	connectAttempts *prometheus.CounterVec
+	// connections counts established connections by side and address family.
+	connections *prometheus.CounterVec
+	// sessionDuration observes the duration of established sessions.
+	sessionDuration prometheus.Histogram
+	// lastData reports when data last moved through the tunnel.
+	lastData prometheus.GaugeFunc
+	// backoffDelay reports the most recent reconnection delay.
+	backoffDelay prometheus.Gauge
+	// backoffAttempts reports the attempts counted by the tracked backoff.
+	backoffAttempts prometheus.GaugeFunc
+	// backoff is the backoff whose attempts are reported, once tracked.
+	backoff atomic.Pointer[backoff.BackerOff]
+	// forwardingLatency observes forwarding latency by direction.
+	forwardingLatency *prometheus.HistogramVec
+	// inFlight reports the bytes in flight in each direction.
+	inFlight []prometheus.Collector
+	// upstream observes data flowing to plane.watch.
+	upstream *forwardingStats
+	// downstream observes data flowing to the local peer.
+	downstream *forwardingStats
+}
+
+// metricSpec names a collector to register.
+type metricSpec struct {
+	// name is the metric name within its subsystem, used to report errors.
+	name string
+	// collector is the collector to register.
+	collector prometheus.Collector
+}
+
+// registerMetrics registers each metric with reg when it is not nil, logging
+// any that cannot be registered. protocol is logged when it is not empty. The
+// returned function unregisters the metrics that were registered.
+func registerMetrics(reg prometheus.Registerer, subsystem, protocol string, metrics []metricSpec, logger zerolog.Logger) func() {
+	if reg == nil {
+		return func() {}
+	}
+
+	collectors := make([]prometheus.Collector, 0, len(metrics))
+	for _, metric := range metrics {
+		if err := reg.Register(metric.collector); err != nil {
+			event := logger.Error().
+				Err(err).
+				Str("metric", prometheus.BuildFQName(metricsNamespace, subsystem, metric.name))
+			if protocol != "" {
+				event = event.Str("protocol", protocol)
+			}
+			event.Msg("error registering metric")
+			continue
+		}
+		collectors = append(collectors, metric.collector)
+	}
+
+	return func() {
+		for _, collector := range collectors {
+			reg.Unregister(collector)
+		}
+	}
+}
+
+// newTunnelMetrics creates the tunnel lifecycle collectors for protocol and
+// registers them with reg when it is not nil. The returned function
+// unregisters them.
+func newTunnelMetrics(
+	reg prometheus.Registerer,
+	protocol string,
+	ts *tunnelStats,
+	logger zerolog.Logger,
+) (*tunnelMetrics, func()) {
+	protocol = strings.ToLower(protocol)
+	constLabels := prometheus.Labels{"protocol": protocol}
+
+	m := &tunnelMetrics{
+		disconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelDisconnectsMetricName,
+			Help:        tunnelDisconnectsMetricHelp,
+			ConstLabels: constLabels,
+		}, []string{"reason"}),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelUpMetricName,
+			Help:        tunnelUpMetricHelp,
+			ConstLabels: constLabels,
+		}),
+		connectAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelConnectAttemptsMetricName,
+			Help:        tunnelConnectAttemptsMetricHelp,
+			ConstLabels: constLabels,
+		}, []string{"side", "result"}),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelConnectionsMetricName,
+			Help:        tunnelConnectionsMetricHelp,
+			ConstLabels: constLabels,
+		}, []string{"side", "family"}),
+		sessionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelSessionDurationMetricName,
+			Help:        tunnelSessionDurationMetricHelp,
+			ConstLabels: constLabels,
+			Buckets:     sessionDurationBuckets,
+		}),
+		lastData: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelLastDataMetricName,
+			Help:        tunnelLastDataMetricHelp,
+			ConstLabels: constLabels,
+		}, func() float64 {
+			lastData := ts.lastDataTime()
+			if lastData.IsZero() {
+				return 0
+			}
+			return float64(lastData.UnixNano()) / 1e9
+		}),
+		backoffDelay: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   tunnelMetricsSubsystem,
+			Name:        tunnelBackoffDelayMetricName,
+			Help:        tunnelBackoffDelayMetricHelp,
+			ConstLabels: constLabels,
+		}),
+	}
+	m.backoffAttempts = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   tunnelMetricsSubsystem,
+		Name:        tunnelBackoffAttemptsMetricName,
+		Help:        tunnelBackoffAttemptsMetricHelp,
+		ConstLabels: constLabels,
+	}, func() float64 {
+		bo := m.backoff.Load()
+		if bo == nil {
+			return 0
+		}
+		return float64(bo.Attempts())
+	})
+	m.forwardingLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   tunnelMetricsSubsystem,
+		Name:        tunnelForwardingLatencyMetricName,
+		Help:        tunnelForwardingLatencyMetricHelp,
+		ConstLabels: constLabels,
+		Buckets:     forwardingLatencyBuckets,
+	}, []string{"direction"})
+	m.upstream = &forwardingStats{latency: m.forwardingLatency.WithLabelValues(directionUpstream)}
+	m.downstream = &forwardingStats{latency: m.forwardingLatency.WithLabelValues(directionDownstream)}
+	for _, direction := range []struct {
+		name string
+		fs   *forwardingStats
+	}{
+		{name: directionUpstream, fs: m.upstream},
+		{name: directionDownstream, fs: m.downstream},
+	} {
+		m.inFlight = append(m.inFlight, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: tunnelMetricsSubsystem,
+			Name:      tunnelInFlightMetricName,
+			Help:      tunnelInFlightMetricHelp,
+			Unit:      "bytes",
+			ConstLabels: prometheus.Labels{
+				"protocol":  protocol,
+				"direction": direction.name,
+			},
+		}, func() float64 {
+			return float64(direction.fs.inFlight.Load())
+		}))
+	}
+
+	for _, reason := range closeReasons {
+		m.disconnects.WithLabelValues(string(reason))
+	}
+	for _, side := range []connectSide{connectSideLocal, connectSideRemote} {
+		m.connectAttempts.WithLabelValues(string(side), "success")
+		m.connectAttempts.WithLabelValues(string(side), "failure")
+		m.connections.WithLabelValues(string(side), "ipv4")
+		m.connections.WithLabelValues(string(side), "ipv6")
+	}
+
+	metrics := []metricSpec{
+		{name: tunnelDisconnectsMetricName, collector: m.disconnects},
+		{name: tunnelUpMetricName, collector: m.up},
+		{name: tunnelConnectAttemptsMetricName, collector: m.connectAttempts},
+		{name: tunnelConnectionsMetricName, collector: m.connections},
+		{name: tunnelSessionDurationMetricName, collector: m.sessionDuration},
+		{name: tunnelLastDataMetricName, collector: m.lastData},
+		{name: tunnelBackoffDelayMetricName, collector: m.backoffDelay},
+		{name: tunnelBackoffAttemptsMetricName, collector: m.backoffAttempts},
+		{name: tunnelForwardingLatencyMetricName, collector: m.forwardingLatency},
+	}
+	for _, collector := range m.inFlight {
+		metrics = append(metrics, metricSpec{name: tunnelInFlightMetricName, collector: collector})
+	}
+
+	return m, registerMetrics(reg, tunnelMetricsSubsystem, protocol, metrics, logger)
+}
+
+// connectAttempt counts a connection attempt to side that failed with err, or
+// succeeded when err is nil.
+func (m *tunnelMetrics) connectAttempt(side connectSide, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.connectAttempts.WithLabelValues(string(side), result).Inc()
+}
+
+// connected counts a connection established to side at addr by its address
+// family.
+func (m *tunnelMetrics) connected(side connectSide, addr net.Addr) {
+	m.connections.WithLabelValues(string(side), network.AddrFamily(addr)).Inc()
+}
+
+// sessionEstablished marks the tunnel as up.
+func (m *tunnelMetrics) sessionEstablished() {
+	m.up.Set(1)
+}
+
+// sessionEnded counts a finished session and adds it to history. Established
+// sessions also mark the tunnel as down and record their duration.
+func (m *tunnelMetrics) sessionEnded(history *SessionHistory, s Session) {
+	m.disconnects.WithLabelValues(string(s.CloseReason)).Inc()
+	if s.Established {
+		m.up.Set(0)
+		m.sessionDuration.Observe(s.Duration().Seconds())
+	}
+	history.Add(s)
+}
+
+// trackBackoff reports the attempts counted by bo.
+func (m *tunnelMetrics) trackBackoff(bo *backoff.BackerOff) {
+	m.backoff.Store(bo)
+}
+
+// observeBackoff records the delay before a reconnection attempt.
+func (m *tunnelMetrics) observeBackoff(delay time.Duration) {
+	m.backoffDelay.Set(delay.Seconds())
+}
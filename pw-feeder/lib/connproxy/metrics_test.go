@@ -0,0 +1,124 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"net"
+	"pw-feeder/lib/backoff"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNewTunnelMetrics verifies lifecycle metric updates, naming conventions,
+// and cleanup.
+func TestNewTunnelMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ts := tunnelStats{}
+	m, unregister := newTunnelMetrics(reg, "MLAT", &ts, zerolog.Nop())
+
+	// No data has moved yet.
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.lastData))
+	ts.incrementByteCounter(1, 0, 0, 1)
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(m.lastData), 5)
+
+	m.connectAttempt(connectSideLocal, nil)
+	m.connectAttempt(connectSideRemote, assert.AnError)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.connectAttempts.WithLabelValues("local", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.connectAttempts.WithLabelValues("remote", "failure")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.connectAttempts.WithLabelValues("remote", "success")))
+
+	m.connected(connectSideLocal, &net.UnixAddr{Name: "/run/readsb.sock", Net: "unix"})
+	m.connected(connectSideRemote, &net.TCPAddr{IP: net.ParseIP("2001:db8::1")})
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.connections.WithLabelValues("local", "unix")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.connections.WithLabelValues("remote", "ipv6")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.connections.WithLabelValues("remote", "ipv4")))
+
+	m.observeBackoff(4 * time.Second)
+	assert.Equal(t, float64(4), testutil.ToFloat64(m.backoffDelay))
+
+	// Attempts are reported once a backoff is tracked.
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.backoffAttempts))
+	bo := backoff.New()
+	m.trackBackoff(bo)
+	bo.BackOff()
+	bo.BackOff()
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.backoffAttempts))
+
+	m.sessionEstablished()
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.up))
+
+	// Failed attempts do not affect the session gauge or duration.
+	history := NewSessionHistory(2)
+	m.sessionEnded(history, Session{CloseReason: CloseReasonDialTimeout})
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.up))
+
+	start := time.Now()
+	m.sessionEnded(history, Session{
+		Start:         start,
+		End:           start.Add(90 * time.Second),
+		Established:   true,
+		EstablishedAt: start.Add(30 * time.Second),
+		CloseReason:   CloseReasonLocalReset,
+	})
+	assert.Len(t, history.Sessions(), 2)
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.up))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.disconnects.WithLabelValues(string(CloseReasonLocalReset))))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.sessionDuration))
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Len(t, metricFamilies, 10)
+	problems, err := promlint.NewWithMetricFamilies(metricFamilies).Lint()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
+
+// TestForwardingStats verifies in-flight accounting and latency observations.
+func TestForwardingStats(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_latency_seconds"})
+	require.NoError(t, reg.Register(histogram))
+	fs := &forwardingStats{latency: histogram}
+
+	readAt := fs.read(100)
+	assert.Equal(t, int64(100), fs.inFlight.Load())
+	fs.written(100, readAt)
+	assert.Equal(t, int64(0), fs.inFlight.Load())
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, metricFamilies, 1)
+	assert.Equal(t, uint64(1), metricFamilies[0].GetMetric()[0].GetHistogram().GetSampleCount())
+
+	// A nil forwardingStats observes nothing.
+	var nilStats *forwardingStats
+	nilStats.written(1, nilStats.read(1))
+}
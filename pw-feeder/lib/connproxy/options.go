@@ -0,0 +1,281 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"pw-feeder/lib/backoff"
+	"pw-feeder/lib/network"
+	"pw-feeder/lib/stunnel"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+type (
+	// Option configures ProxyBEASTConnection and ProxyMLATConnection.
+	Option func(*proxyOptions)
+
+	// proxyOptions contains the optional settings shared by the proxy loops.
+	proxyOptions struct {
+		// history receives a record of each tunnel session, if set.
+		history *SessionHistory
+		// coalesceDelay is the longest data written to plane.watch may be
+		// buffered. Coalescing is disabled when it is not positive.
+		coalesceDelay time.Duration
+		// coalesceBytes is the buffered size that triggers an immediate flush.
+		coalesceBytes int
+		// queueDepth is the number of chunks queued between each direction's
+		// reader and writer. Queueing is disabled when it is not positive.
+		queueDepth int
+		// queuePolicy decides what happens to data read while a queue is full.
+		queuePolicy OverflowPolicy
+		// tlsOpts configures how the plane.watch certificate is verified.
+		tlsOpts []stunnel.Option
+		// localDialOpts configure connections to the local data source.
+		localDialOpts []network.DialOption
+		// endpointSeed shuffles the order the feed-in endpoints are
+		// preferred in, when it is not empty.
+		endpointSeed string
+		// heartbeatInterval is how long the local source must be quiet before
+		// a heartbeat is sent on the BEAST tunnel. Heartbeats are disabled
+		// when it is not positive.
+		heartbeatInterval time.Duration
+		// heartbeatMisses is the number of heartbeat intervals without
+		// progress from plane.watch after which the BEAST tunnel is closed.
+		heartbeatMisses int
+		// beastSettings are the receiver options sent to the BEAST source
+		// each time it is connected.
+		beastSettings BeastSettings
+		// sourceStallTimeout is how long a BEAST source may send nothing
+		// before the next source is tried, when there is more than one.
+		// Stalls are not detected when it is not positive.
+		sourceStallTimeout time.Duration
+		// sourceHoldDown is how long a more preferred BEAST source must stay
+		// healthy before the tunnel switches back to it.
+		sourceHoldDown time.Duration
+		// authRejectedBackoff is the delay between attempts while
+		// plane.watch is rejecting the API key.
+		authRejectedBackoff time.Duration
+		// authRejected, if set, is called each time plane.watch starts
+		// rejecting the API key.
+		authRejected func()
+		// backoffMaxDelay caps the delay between reconnection attempts.
+		backoffMaxDelay time.Duration
+		// backoffJitter randomises the delay between reconnection attempts.
+		backoffJitter backoff.Jitter
+		// breakers pause connections to plane.watch hosts that repeatedly
+		// fail, if set.
+		breakers *CircuitBreakers
+	}
+)
+
+// WithSessionHistory returns an Option that records each tunnel session in
+// history.
+func WithSessionHistory(history *SessionHistory) Option {
+	return func(o *proxyOptions) {
+		o.history = history
+	}
+}
+
+// WithCoalescing returns an Option that buffers small writes to plane.watch so
+// they are sent in fewer TLS records. Buffered data is flushed after maxDelay
+// or once maxBytes have been buffered; a non-positive maxBytes selects
+// DefaultCoalesceBytes. A non-positive maxDelay disables coalescing.
+func WithCoalescing(maxDelay time.Duration, maxBytes int) Option {
+	return func(o *proxyOptions) {
+		o.coalesceDelay = maxDelay
+		o.coalesceBytes = maxBytes
+	}
+}
+
+// WithQueue returns an Option that decouples reading from writing in each
+// tunnel direction with a queue of up to depth chunks. policy decides what
+// happens to BEAST data read while the queue is full; MLAT queues always
+// block. A non-positive depth disables queueing.
+func WithQueue(depth int, policy OverflowPolicy) Option {
+	return func(o *proxyOptions) {
+		o.queueDepth = depth
+		o.queuePolicy = policy
+	}
+}
+
+// WithTLSOptions returns an Option that applies opts when verifying the
+// plane.watch certificate, for example to use custom roots or pins.
+func WithTLSOptions(opts ...stunnel.Option) Option {
+	return func(o *proxyOptions) {
+		o.tlsOpts = append(o.tlsOpts, opts...)
+	}
+}
+
+// WithLocalDialOptions returns an Option that applies opts when connecting to
+// the local data source, for example to choose its address family.
+func WithLocalDialOptions(opts ...network.DialOption) Option {
+	return func(o *proxyOptions) {
+		o.localDialOpts = append(o.localDialOpts, opts...)
+	}
+}
+
+// WithEndpointShuffle returns an Option that prefers the feed-in endpoints in
+// an order chosen by seed, rather than the order they were given in. Feeders
+// with different seeds, such as their API keys, spread across the endpoints,
+// while each feeder keeps the same order across restarts. An empty seed keeps
+// the given order.
+func WithEndpointShuffle(seed string) Option {
+	return func(o *proxyOptions) {
+		o.endpointSeed = seed
+	}
+}
+
+// WithHeartbeat returns an Option that sends a BEAST heartbeat frame to
+// plane.watch whenever the local source has been quiet for interval. The
+// BEAST tunnel is closed when a heartbeat cannot be written within interval,
+// or when plane.watch has acknowledged nothing sent to it for misses
+// intervals, which is only checked where TCP_INFO can be read. A non-positive
+// misses selects DefaultHeartbeatMisses. A non-positive interval disables
+// heartbeats. MLAT tunnels are not affected.
+func WithHeartbeat(interval time.Duration, misses int) Option {
+	return func(o *proxyOptions) {
+		o.heartbeatInterval = interval
+		o.heartbeatMisses = misses
+	}
+}
+
+// WithBeastSettings returns an Option that sends settings to the local BEAST
+// source each time it is connected, and warns when the data it then sends
+// does not match them. MLAT tunnels are not affected.
+func WithBeastSettings(settings BeastSettings) Option {
+	return func(o *proxyOptions) {
+		o.beastSettings = settings
+	}
+}
+
+// WithSourceFailover returns an Option that controls switching between the
+// BEAST sources when more than one is given. A source that sends nothing for
+// stallTimeout is treated as failed, and a more preferred source is switched
+// back to once it has been healthy for holdDown. A non-positive stallTimeout
+// only fails over when a source cannot be connected to or closes the
+// connection, and a non-positive holdDown selects DefaultSourceHoldDown.
+func WithSourceFailover(stallTimeout, holdDown time.Duration) Option {
+	return func(o *proxyOptions) {
+		o.sourceStallTimeout = stallTimeout
+		o.sourceHoldDown = holdDown
+	}
+}
+
+// WithAuthRejection returns an Option that waits backoff between attempts
+// while plane.watch is rejecting the API key, and calls rejected, if it is not
+// nil, each time it starts to. A non-positive backoff selects
+// DefaultAuthRejectedBackoff. MLAT tunnels are not affected.
+func WithAuthRejection(backoff time.Duration, rejected func()) Option {
+	return func(o *proxyOptions) {
+		o.authRejectedBackoff = backoff
+		o.authRejected = rejected
+	}
+}
+
+// WithBackoff returns an Option that caps the delay between reconnection
+// attempts at maxDelay and randomises it with jitter, so feeders that lost
+// their tunnels at the same time do not all reconnect at once. A non-positive
+// maxDelay selects backoff.DefaultMaxDelay.
+func WithBackoff(maxDelay time.Duration, jitter backoff.Jitter) Option {
+	return func(o *proxyOptions) {
+		o.backoffMaxDelay = maxDelay
+		o.backoffJitter = jitter
+	}
+}
+
+// WithCircuitBreakers returns an Option that connects to plane.watch through
+// breakers, so tunnels sharing them stop connecting to a host that repeatedly
+// fails.
+func WithCircuitBreakers(breakers *CircuitBreakers) Option {
+	return func(o *proxyOptions) {
+		o.breakers = breakers
+	}
+}
+
+// newProxyOptions applies opts to the default proxy options.
+func newProxyOptions(opts []Option) proxyOptions {
+	o := proxyOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.heartbeatMisses <= 0 {
+		o.heartbeatMisses = DefaultHeartbeatMisses
+	}
+	if o.sourceHoldDown <= 0 {
+		o.sourceHoldDown = DefaultSourceHoldDown
+	}
+	if o.authRejectedBackoff <= 0 {
+		o.authRejectedBackoff = DefaultAuthRejectedBackoff
+	}
+	return o
+}
+
+// newBackoff returns the backoff between reconnection attempts, reporting
+// each delay to metrics and logger.
+func (o proxyOptions) newBackoff(metrics *tunnelMetrics, logger zerolog.Logger) *backoff.BackerOff {
+	bo := backoff.New(
+		backoff.WithResetAfter(5*time.Minute),
+		backoff.WithMaxDelay(o.backoffMaxDelay),
+		backoff.WithJitter(o.backoffJitter),
+		backoff.WithNotify(func(delay time.Duration) {
+			metrics.observeBackoff(delay)
+			logRetry(logger, delay)
+		}),
+	)
+	metrics.trackBackoff(bo)
+	return bo
+}
+
+// logRetry logs that a connection will be retried after delay.
+func logRetry(logger zerolog.Logger, delay time.Duration) {
+	if delay > 0 {
+		logger.Info().Msgf("retrying in %s", delay)
+	} else {
+		logger.Info().Msg("retrying")
+	}
+}
+
+// newCoalescer returns a function that wraps plane.watch connections in a
+// coalescing writer, and a function that unregisters the coalescing metrics.
+// Connections are returned unwrapped when coalescing is disabled.
+func (o proxyOptions) newCoalescer(reg prometheus.Registerer, protocol string, logger zerolog.Logger) (func(net.Conn) net.Conn, func()) {
+	if o.coalesceDelay <= 0 {
+		return func(conn net.Conn) net.Conn { return conn }, func() {}
+	}
+	metrics, unregister := newCoalesceMetrics(reg, protocol, logger)
+	return func(conn net.Conn) net.Conn {
+		return newCoalescingConn(conn, o.coalesceDelay, o.coalesceBytes, metrics)
+	}, unregister
+}
+
+// remoteTLSOptions returns the stunnel options for connections to plane.watch.
+// They add a session cache shared by the proxy's reconnects, so a reconnect
+// can resume the previous session, and record each handshake in metrics.
+func (o proxyOptions) remoteTLSOptions(metrics *handshakeMetrics) []stunnel.Option {
+	opts := make([]stunnel.Option, 0, len(o.tlsOpts)+2)
+	opts = append(opts, o.tlsOpts...)
+	return append(opts,
+		stunnel.WithSessionCache(tls.NewLRUClientSessionCache(0)),
+		stunnel.WithTrace(metrics.observe),
+	)
+}
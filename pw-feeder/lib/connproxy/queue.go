@@ -0,0 +1,386 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// OverflowPolicy selects what a tunnel queue does with data read while it is
+// full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading until the writer makes room.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued chunk to make room.
+	OverflowDropOldest
+	// OverflowDropNewest discards the chunk that was just read.
+	OverflowDropNewest
+)
+
+const (
+	tunnelQueueDepthMetricName = "queue_depth"
+	tunnelQueueDepthMetricHelp = "Chunks waiting in the queue between a tunnel direction's reader and writer."
+
+	tunnelQueueDroppedMetricName = "queue_dropped_total"
+	tunnelQueueDroppedMetricHelp = "Total number of chunks dropped because a tunnel queue was full."
+
+	tunnelQueueDroppedBytesMetricName = "queue_dropped_bytes_total"
+	tunnelQueueDroppedBytesMetricHelp = "Total number of bytes dropped because a tunnel queue was full."
+)
+
+// overflowPolicyNames maps each OverflowPolicy to its configuration name.
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OverflowBlock:      "block",
+	OverflowDropOldest: "drop-oldest",
+	OverflowDropNewest: "drop-newest",
+}
+
+// String returns the configuration name of p.
+func (p OverflowPolicy) String() string {
+	if name, ok := overflowPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy parses block, drop-oldest or drop-newest.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	for p, name := range overflowPolicyNames {
+		if strings.EqualFold(s, name) {
+			return p, nil
+		}
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy %q, expected block, drop-oldest or drop-newest", s)
+}
+
+// queueStats tracks one direction's queue for the metrics.
+type queueStats struct {
+	// queued counts the chunks currently in the queue.
+	queued atomic.Int64
+	// dropped counts chunks discarded by the overflow policy.
+	dropped prometheus.Counter
+	// droppedBytes counts bytes discarded by the overflow policy.
+	droppedBytes prometheus.Counter
+}
+
+// drop records a discarded chunk of n bytes.
+func (qs *queueStats) drop(n int) {
+	qs.dropped.Inc()
+	qs.droppedBytes.Add(float64(n))
+}
+
+// moverQueue configures the bounded queue between the reader and the writer of
+// one tunnel direction. A nil moverQueue copies data without a queue.
+type moverQueue struct {
+	// depth is the number of chunks the queue holds.
+	depth int
+	// policy decides what happens to data read while the queue is full.
+	policy OverflowPolicy
+	// frames splits the data read at BEAST frame boundaries, so the drop
+	// policies only ever discard whole frames.
+	frames bool
+	// stats tracks the queue for the metrics.
+	stats *queueStats
+}
+
+// queuedChunk is a chunk of data waiting to be written.
+type queuedChunk struct {
+	// data is the chunk's contents.
+	data []byte
+	// readAt records when the chunk was read.
+	readAt time.Time
+}
+
+// frameSplitter cuts the data read from a BEAST stream into chunks that end
+// between frames. A nil frameSplitter leaves chunks as they were read.
+type frameSplitter struct {
+	// scanner follows the frames in the data read.
+	scanner beastScanner
+	// held is the start of an incomplete frame, kept until the rest of it has
+	// been read.
+	held queuedChunk
+}
+
+// split returns the part of c that ends between frames, after any data held
+// back from earlier reads. The incomplete frame at the end of c, if any, is
+// held back to start the next chunk.
+func (s *frameSplitter) split(c queuedChunk) queuedChunk {
+	if s == nil {
+		return c
+	}
+	end := s.scanner.cut(c.data)
+	heldAt := c.readAt
+	if len(s.held.data) > 0 {
+		if end > 0 {
+			end += len(s.held.data)
+		} else {
+			heldAt = s.held.readAt
+		}
+		c = queuedChunk{data: append(s.held.data, c.data...), readAt: s.held.readAt}
+	}
+	s.held = queuedChunk{data: bytes.Clone(c.data[end:]), readAt: heldAt}
+	return queuedChunk{data: c.data[:end:end], readAt: c.readAt}
+}
+
+// flush returns and forgets any data held back.
+func (s *frameSplitter) flush() queuedChunk {
+	if s == nil {
+		return queuedChunk{}
+	}
+	c := s.held
+	s.held = queuedChunk{}
+	return c
+}
+
+// queuePair holds the queues for both directions of a tunnel. Both are nil
+// when queueing is disabled.
+type queuePair struct {
+	// upstream queues data flowing to plane.watch.
+	upstream *moverQueue
+	// downstream queues data flowing to the local peer.
+	downstream *moverQueue
+}
+
+// newQueues creates the queue configuration and metrics for protocol, and
+// registers the metrics with reg when it is not nil. frames splits the data
+// read at BEAST frame boundaries. The returned function unregisters the
+// metrics.
+func newQueues(
+	reg prometheus.Registerer,
+	protocol string,
+	depth int,
+	policy OverflowPolicy,
+	frames bool,
+	logger zerolog.Logger,
+) (queuePair, func()) {
+	if depth <= 0 {
+		return queuePair{}, func() {}
+	}
+
+	protocol = strings.ToLower(protocol)
+	constLabels := prometheus.Labels{"protocol": protocol}
+
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   tunnelMetricsSubsystem,
+		Name:        tunnelQueueDroppedMetricName,
+		Help:        tunnelQueueDroppedMetricHelp,
+		ConstLabels: constLabels,
+	}, []string{"direction"})
+	droppedBytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   tunnelMetricsSubsystem,
+		Name:        tunnelQueueDroppedBytesMetricName,
+		Help:        tunnelQueueDroppedBytesMetricHelp,
+		ConstLabels: constLabels,
+	}, []string{"direction"})
+
+	metrics := []metricSpec{
+		{name: tunnelQueueDroppedMetricName, collector: dropped},
+		{name: tunnelQueueDroppedBytesMetricName, collector: droppedBytes},
+	}
+
+	newQueue := func(direction string) *moverQueue {
+		qs := &queueStats{
+			dropped:      dropped.WithLabelValues(direction),
+			droppedBytes: droppedBytes.WithLabelValues(direction),
+		}
+		metrics = append(metrics, metricSpec{
+			name: tunnelQueueDepthMetricName,
+			collector: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Subsystem: tunnelMetricsSubsystem,
+				Name:      tunnelQueueDepthMetricName,
+				Help:      tunnelQueueDepthMetricHelp,
+				ConstLabels: prometheus.Labels{
+					"protocol":  protocol,
+					"direction": direction,
+				},
+			}, func() float64 {
+				return float64(qs.queued.Load())
+			}),
+		})
+		return &moverQueue{depth: depth, policy: policy, frames: frames, stats: qs}
+	}
+
+	queues := queuePair{
+		upstream:   newQueue(directionUpstream),
+		downstream: newQueue(directionDownstream),
+	}
+
+	return queues, registerMetrics(reg, tunnelMetricsSubsystem, protocol, metrics, logger)
+}
+
+// enqueue adds c to chunks, applying the overflow policy when chunks is full.
+// It returns false if the writer stopped, which is signalled by closing done,
+// before c could be queued.
+func (q *moverQueue) enqueue(chunks chan queuedChunk, c queuedChunk, done <-chan struct{}, fs *forwardingStats) bool {
+	// Count the chunk before sending it so the writer never sees a negative depth.
+	q.stats.queued.Add(1)
+
+	switch q.policy {
+	case OverflowDropNewest:
+		select {
+		case chunks <- c:
+			return true
+		case <-done:
+		default:
+			q.stats.drop(len(c.data))
+			fs.dropped(len(c.data))
+			q.stats.queued.Add(-1)
+			return true
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case chunks <- c:
+				return true
+			case <-done:
+				q.stats.queued.Add(-1)
+				return false
+			default:
+			}
+			select {
+			case old := <-chunks:
+				q.stats.drop(len(old.data))
+				fs.dropped(len(old.data))
+				q.stats.queued.Add(-1)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case chunks <- c:
+			return true
+		case <-done:
+		}
+	}
+
+	q.stats.queued.Add(-1)
+	return false
+}
+
+// queuedCopyLoop moves data from connIn to connOut like copyLoop, but reads
+// and writes in separate goroutines joined by q. A slow writer therefore no
+// longer stops the reader, unless the queue is full and its policy is
+// OverflowBlock. count is called with the size of each chunk read and each
+// chunk written.
+func queuedCopyLoop(
+	ctx context.Context,
+	connIn, connOut net.Conn,
+	q *moverQueue,
+	fs *forwardingStats,
+	log zerolog.Logger,
+	count func(bytesRead, bytesWritten int),
+) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = connIn.Close()
+		_ = connOut.Close()
+	})
+	defer stop()
+
+	chunks := make(chan queuedChunk, q.depth)
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, dataMoverBufferSize)
+		var frames *frameSplitter
+		if q.frames {
+			frames = &frameSplitter{}
+		}
+		// send queues c, returning false if the writer stopped first.
+		send := func(c queuedChunk) bool {
+			if len(c.data) == 0 || q.enqueue(chunks, c, done, fs) {
+				return true
+			}
+			fs.dropped(len(c.data))
+			return false
+		}
+		for {
+			bytesRead, err := connIn.Read(buf)
+			if bytesRead > 0 {
+				count(bytesRead, 0)
+				c := queuedChunk{data: bytes.Clone(buf[:bytesRead]), readAt: fs.read(bytesRead)}
+				if !send(frames.split(c)) {
+					fs.dropped(len(frames.flush().data))
+					readErr <- nil
+					return
+				}
+			}
+			if err != nil {
+				// Forward a frame cut short by the end of the stream as it is.
+				send(frames.flush())
+				if !errors.Is(err, net.ErrClosed) {
+					log.Err(err).Msg("error reading from socket")
+				}
+				readErr <- &transferError{read: true, err: err}
+				return
+			}
+		}
+	}()
+
+	var writeErr error
+	for c := range chunks {
+		q.stats.queued.Add(-1)
+		bytesWritten, err := writeForwarded(connOut, c.data, fs, c.readAt)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Err(err).Msg("error writing to socket")
+			}
+			writeErr = &transferError{err: err}
+			break
+		}
+		count(0, bytesWritten)
+	}
+
+	// Stop the reader if the writer failed, then discard anything still queued.
+	close(done)
+	if writeErr != nil {
+		_ = connIn.Close()
+	}
+	for c := range chunks {
+		q.stats.queued.Add(-1)
+		fs.dropped(len(c.data))
+	}
+
+	err := writeErr
+	if err == nil {
+		err = <-readErr
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,303 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledConn is a net.Conn whose writes block until release is closed.
+type stalledConn struct {
+	net.Conn
+	// started receives a value when a write starts.
+	started chan struct{}
+	// release unblocks writes when closed.
+	release chan struct{}
+	// writes receives a copy of each completed write.
+	writes chan []byte
+}
+
+// newStalledConn returns a stalledConn with its writes blocked.
+func newStalledConn() *stalledConn {
+	return &stalledConn{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		writes:  make(chan []byte, 16),
+	}
+}
+
+// Write blocks until the connection is released, then records p.
+func (c *stalledConn) Write(p []byte) (int, error) {
+	select {
+	case c.started <- struct{}{}:
+	default:
+	}
+	<-c.release
+	c.writes <- bytes.Clone(p)
+	return len(p), nil
+}
+
+// Close does nothing.
+func (c *stalledConn) Close() error {
+	return nil
+}
+
+// TestParseOverflowPolicy verifies policy names round trip and bad names are
+// rejected.
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{OverflowBlock, OverflowDropOldest, OverflowDropNewest} {
+		got, err := ParseOverflowPolicy(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, got)
+	}
+
+	got, err := ParseOverflowPolicy("Drop-Oldest")
+	require.NoError(t, err)
+	assert.Equal(t, OverflowDropOldest, got)
+
+	_, err = ParseOverflowPolicy("drop-all")
+	assert.Error(t, err)
+}
+
+// TestQueuedCopyLoop verifies data is forwarded through the queue and that each
+// overflow policy handles a stalled writer.
+func TestQueuedCopyLoop(t *testing.T) {
+	chunks := [][]byte{[]byte("one"), []byte("two"), []byte("three"), []byte("four"), []byte("five")}
+
+	// stall writes the first chunk and waits for the writer to block on it.
+	// Unless the policy blocks, it then writes the remaining chunks.
+	stall := func(t *testing.T, policy OverflowPolicy) (*moverQueue, *stalledConn, net.Conn, func()) {
+		src, srcPeer := net.Pipe()
+		dst := newStalledConn()
+		queues, _ := newQueues(nil, "BEAST", 2, policy, true, zerolog.Nop())
+		q := queues.upstream
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- queuedCopyLoop(ctx, src, dst, q, nil, zerolog.Nop(), func(int, int) {})
+		}()
+
+		_, err := srcPeer.Write(chunks[0])
+		require.NoError(t, err)
+		<-dst.started
+
+		stop := func() {
+			cancel()
+			assert.NoError(t, <-done)
+			_ = srcPeer.Close()
+		}
+
+		if policy == OverflowBlock {
+			return q, dst, srcPeer, stop
+		}
+
+		// The reader keeps reading while the writer is stalled.
+		for _, chunk := range chunks[1:] {
+			_, err := srcPeer.Write(chunk)
+			require.NoError(t, err)
+		}
+		return q, dst, srcPeer, stop
+	}
+
+	received := func(dst *stalledConn, n int) [][]byte {
+		got := make([][]byte, 0, n)
+		for range n {
+			got = append(got, <-dst.writes)
+		}
+		return got
+	}
+
+	t.Run("forwards data", func(t *testing.T) {
+		src, srcPeer := net.Pipe()
+		dst, dstPeer := net.Pipe()
+		queues, _ := newQueues(nil, "BEAST", 4, OverflowBlock, true, zerolog.Nop())
+
+		// Closing dst once the loop returns lets the test read to EOF.
+		done := make(chan error, 1)
+		go func() {
+			done <- queuedCopyLoop(context.Background(), src, dst, queues.upstream, nil, zerolog.Nop(), func(int, int) {})
+			_ = dst.Close()
+		}()
+
+		go func() {
+			for _, chunk := range chunks {
+				_, _ = srcPeer.Write(chunk)
+			}
+			_ = srcPeer.Close()
+		}()
+
+		got, err := io.ReadAll(dstPeer)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Join(chunks, nil), got)
+
+		err = <-done
+		assert.ErrorIs(t, err, io.EOF)
+		_ = src.Close()
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		q, dst, _, stop := stall(t, OverflowDropNewest)
+		defer stop()
+
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(q.stats.dropped) == 2
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, float64(len("four")+len("five")), testutil.ToFloat64(q.stats.droppedBytes))
+		assert.Equal(t, int64(2), q.stats.queued.Load())
+
+		close(dst.release)
+		assert.Equal(t, chunks[:3], received(dst, 3))
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		q, dst, _, stop := stall(t, OverflowDropOldest)
+		defer stop()
+
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(q.stats.dropped) == 2
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, float64(len("two")+len("three")), testutil.ToFloat64(q.stats.droppedBytes))
+
+		close(dst.release)
+		assert.Equal(t, [][]byte{chunks[0], chunks[3], chunks[4]}, received(dst, 3))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		q, dst, srcPeer, stop := stall(t, OverflowBlock)
+		defer stop()
+
+		// Once the queue is full the reader stops, so the source blocks.
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			for _, chunk := range chunks[1:] {
+				_, _ = srcPeer.Write(chunk)
+			}
+		}()
+		select {
+		case <-written:
+			t.Fatal("reader kept reading while the queue was full")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(dst.release)
+		<-written
+		assert.Equal(t, chunks, received(dst, len(chunks)))
+		assert.Equal(t, float64(0), testutil.ToFloat64(q.stats.dropped))
+	})
+
+	t.Run("write error stops reader", func(t *testing.T) {
+		src, srcPeer := net.Pipe()
+		dst, dstPeer := net.Pipe()
+		defer func() { _ = srcPeer.Close() }()
+		queues, _ := newQueues(nil, "BEAST", 4, OverflowBlock, true, zerolog.Nop())
+
+		// Writes to dst fail once its peer is closed.
+		_ = dstPeer.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- queuedCopyLoop(context.Background(), src, dst, queues.upstream, nil, zerolog.Nop(), func(int, int) {})
+		}()
+		_, err := srcPeer.Write(chunks[0])
+		require.NoError(t, err)
+
+		select {
+		case err := <-done:
+			var te *transferError
+			require.ErrorAs(t, err, &te)
+			assert.False(t, te.read)
+		case <-time.After(time.Second):
+			t.Fatal("queued copy loop did not stop after a write error")
+		}
+		assert.Equal(t, int64(0), queues.upstream.stats.queued.Load())
+	})
+}
+
+// TestFrameSplitter verifies BEAST data is only split between frames, and
+// that other data passes through as it was read.
+func TestFrameSplitter(t *testing.T) {
+	frame := []byte{0x1a, '2', 1, 2, 3, 4, 5, 6, 7, 1, 2, 3, 4, 5, 6, 7}
+	escaped := []byte{0x1a, '2', 0x1a, 0x1a, 2, 3, 4, 5, 6, 7, 1, 2, 3, 4, 5, 6, 7}
+	read := func(data []byte) queuedChunk {
+		return queuedChunk{data: data, readAt: time.Now()}
+	}
+
+	s := &frameSplitter{}
+	first := read(append(bytes.Clone(frame), escaped[:3]...))
+	c := s.split(first)
+	assert.Equal(t, frame, c.data)
+	assert.Equal(t, first.readAt, c.readAt)
+
+	// The held back start of a frame, ending on an escape byte, starts the
+	// next chunk.
+	c = s.split(read(append(bytes.Clone(escaped[3:]), 0x1a)))
+	assert.Equal(t, escaped, c.data)
+	assert.Equal(t, first.readAt, c.readAt)
+	assert.Equal(t, []byte{0x1a}, s.flush().data)
+	assert.Empty(t, s.flush().data)
+
+	// Data that is not BEAST is not held back.
+	s = &frameSplitter{}
+	assert.Equal(t, []byte("one"), s.split(read([]byte("one"))).data)
+
+	var nilSplitter *frameSplitter
+	assert.Equal(t, []byte("one"), nilSplitter.split(read([]byte("one"))).data)
+	assert.Empty(t, nilSplitter.flush().data)
+}
+
+// TestNewQueues verifies queueing is disabled without a depth, and checks
+// metric naming conventions and cleanup.
+func TestNewQueues(t *testing.T) {
+	queues, _ := newQueues(nil, "BEAST", 0, OverflowBlock, true, zerolog.Nop())
+	assert.Nil(t, queues.upstream)
+	assert.Nil(t, queues.downstream)
+
+	reg := prometheus.NewRegistry()
+	queues, unregister := newQueues(reg, "BEAST", 8, OverflowDropOldest, true, zerolog.Nop())
+	require.NotNil(t, queues.upstream)
+	assert.Equal(t, 8, queues.upstream.depth)
+	assert.Equal(t, OverflowDropOldest, queues.downstream.policy)
+	queues.downstream.stats.drop(10)
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Len(t, metricFamilies, 3)
+	problems, err := promlint.NewWithMetricFamilies(metricFamilies).Lint()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
@@ -0,0 +1,376 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CloseReason classifies why a tunnel session ended.
+type CloseReason string
+
+const (
+	// CloseReasonLocalEOF indicates that the local peer closed the connection.
+	CloseReasonLocalEOF CloseReason = "local_eof"
+	// CloseReasonLocalReset indicates that the local peer reset the connection.
+	CloseReasonLocalReset CloseReason = "local_reset"
+	// CloseReasonRemoteEOF indicates that plane.watch closed the connection.
+	CloseReasonRemoteEOF CloseReason = "remote_eof"
+	// CloseReasonRemoteReset indicates that the plane.watch connection was reset.
+	CloseReasonRemoteReset CloseReason = "remote_reset"
+	// CloseReasonPeerTimeout indicates that a peer stopped responding, as
+	// detected by TCP keepalive probes or the TCP user timeout.
+	CloseReasonPeerTimeout CloseReason = "peer_timeout"
+	// CloseReasonHeartbeatTimeout indicates that a heartbeat could not be
+	// written to plane.watch within the heartbeat interval, or that
+	// plane.watch acknowledged nothing for the configured number of
+	// intervals.
+	CloseReasonHeartbeatTimeout CloseReason = "heartbeat_timeout"
+	// CloseReasonSourceStalled indicates that the BEAST source sent nothing
+	// for the stall timeout, and another source was tried.
+	CloseReasonSourceStalled CloseReason = "source_stalled"
+	// CloseReasonWrongSourceFormat indicates that the local source sent data
+	// in a format other than BEAST, such as SBS or AVR, which was not
+	// forwarded.
+	CloseReasonWrongSourceFormat CloseReason = "wrong_source_format"
+	// CloseReasonTLSAlert indicates that plane.watch sent a TLS alert.
+	CloseReasonTLSAlert CloseReason = "tls_alert"
+	// CloseReasonDialTimeout indicates that a connection attempt timed out.
+	CloseReasonDialTimeout CloseReason = "dial_timeout"
+	// CloseReasonDNSFailure indicates that a host name could not be resolved.
+	CloseReasonDNSFailure CloseReason = "dns_failure"
+	// CloseReasonAuthRejected indicates that plane.watch rejected the feeder's
+	// credentials.
+	CloseReasonAuthRejected CloseReason = "auth_rejected"
+	// CloseReasonCircuitOpen indicates that no connection to plane.watch was
+	// attempted, because its circuit breaker is open after repeated failures.
+	CloseReasonCircuitOpen CloseReason = "circuit_open"
+	// CloseReasonFailback indicates that the tunnel was closed to reconnect
+	// to a more preferred feed-in endpoint or BEAST source that has
+	// recovered.
+	CloseReasonFailback CloseReason = "failback"
+	// CloseReasonContextCancel indicates that the feeder is shutting down.
+	CloseReasonContextCancel CloseReason = "context_cancel"
+	// CloseReasonError covers failures that fit no other reason.
+	CloseReasonError CloseReason = "error"
+)
+
+// defaultSessionHistorySize is the number of sessions kept when a history is
+// created with a non-positive size.
+const defaultSessionHistorySize = 64
+
+// Session records the lifetime and outcome of a single tunnel session. A
+// connection attempt that fails is recorded with equal start and end times.
+type Session struct {
+	// Protocol is the tunnel protocol, such as BEAST or MLAT.
+	Protocol string `json:"protocol"`
+	// Source is the local address that data was tunnelled from.
+	Source string `json:"source"`
+	// Destination is the plane.watch endpoint that data was tunnelled to.
+	Destination string `json:"destination"`
+	// Start records when the session was initiated.
+	Start time.Time `json:"start"`
+	// End records when the session finished.
+	End time.Time `json:"end"`
+	// BytesLocalToRemote counts bytes written to plane.watch.
+	BytesLocalToRemote uint64 `json:"bytes_local_to_remote"`
+	// BytesRemoteToLocal counts bytes written to the local peer.
+	BytesRemoteToLocal uint64 `json:"bytes_remote_to_local"`
+	// Established reports whether the tunnel was established before the
+	// session ended.
+	Established bool `json:"established"`
+	// EstablishedAt records when the tunnel was established, if it was.
+	EstablishedAt time.Time `json:"established_at,omitzero"`
+	// CloseReason classifies why the session ended.
+	CloseReason CloseReason `json:"close_reason"`
+	// Error is the error that ended the session, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Duration returns how long the tunnel was established for, or zero when it
+// never was.
+func (s Session) Duration() time.Duration {
+	if !s.Established {
+		return 0
+	}
+	return s.End.Sub(s.EstablishedAt)
+}
+
+// SessionHistory keeps the most recent tunnel sessions in a fixed-size ring
+// buffer. It is safe for concurrent use, and a nil history discards sessions.
+type SessionHistory struct {
+	// mu protects the ring buffer.
+	mu sync.Mutex
+	// sessions is the ring buffer storage.
+	sessions []Session
+	// next is the index that the next session is written to.
+	next int
+	// full reports whether the ring buffer has wrapped.
+	full bool
+}
+
+// NewSessionHistory returns a SessionHistory that retains up to size sessions.
+func NewSessionHistory(size int) *SessionHistory {
+	if size <= 0 {
+		size = defaultSessionHistorySize
+	}
+	return &SessionHistory{
+		sessions: make([]Session, size),
+	}
+}
+
+// Add records a session, replacing the oldest session when the history is full.
+func (h *SessionHistory) Add(s Session) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sessions[h.next] = s
+	h.next = (h.next + 1) % len(h.sessions)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Sessions returns the recorded sessions, newest first.
+func (h *SessionHistory) Sessions() []Session {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.sessions)
+	}
+
+	sessions := make([]Session, 0, count)
+	for i := 1; i <= count; i++ {
+		sessions = append(sessions, h.sessions[(h.next-i+len(h.sessions))%len(h.sessions)])
+	}
+	return sessions
+}
+
+// ServeHTTP writes the recorded sessions as JSON, newest first.
+func (h *SessionHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Sessions []Session `json:"sessions"`
+	}{
+		Sessions: h.Sessions(),
+	})
+}
+
+// closeCause retains the first classified reason a session ended. Later causes,
+// such as the peer data mover failing after its connection is closed, are
+// ignored.
+type closeCause struct {
+	// once ensures only the first cause is kept.
+	once sync.Once
+	// reason is the classified close reason.
+	reason CloseReason
+	// err is the error that ended the session, if any.
+	err error
+}
+
+// set records reason and err unless a cause was already recorded. An empty
+// reason is ignored.
+func (c *closeCause) set(reason CloseReason, err error) {
+	if reason == "" {
+		return
+	}
+	c.once.Do(func() {
+		c.reason = reason
+		c.err = err
+	})
+}
+
+// get returns the recorded reason and error.
+func (c *closeCause) get() (CloseReason, error) {
+	// Calling once.Do here gives the reads a happens-before edge with set.
+	c.once.Do(func() {
+		c.reason = CloseReasonError
+	})
+	return c.reason, c.err
+}
+
+// classifyDialError classifies an error returned while connecting.
+func classifyDialError(err error) CloseReason {
+	if errors.Is(err, context.Canceled) {
+		return CloseReasonContextCancel
+	}
+
+	if errors.Is(err, errCircuitOpen) {
+		return CloseReasonCircuitOpen
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && !dnsErr.IsTimeout {
+		return CloseReasonDNSFailure
+	}
+
+	if reason := classifyTLSAlert(err); reason != "" {
+		return reason
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return CloseReasonDialTimeout
+	}
+
+	return CloseReasonError
+}
+
+// classifyTransferError classifies an error returned while moving data. remote
+// reports whether the error was observed on the plane.watch connection. Errors
+// caused by the proxy closing its own connections are not classified.
+func classifyTransferError(err error, remote bool) CloseReason {
+	switch {
+	case err == nil, errors.Is(err, net.ErrClosed):
+		return ""
+
+	case errors.Is(err, context.Canceled):
+		return CloseReasonContextCancel
+
+	case errors.Is(err, io.EOF):
+		if remote {
+			return CloseReasonRemoteEOF
+		}
+		return CloseReasonLocalEOF
+
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		if remote {
+			return CloseReasonRemoteReset
+		}
+		return CloseReasonLocalReset
+
+	case errors.Is(err, syscall.ETIMEDOUT):
+		return CloseReasonPeerTimeout
+
+	case errors.Is(err, errWrongSourceFormat):
+		return CloseReasonWrongSourceFormat
+	}
+
+	if remote {
+		if reason := classifyTLSAlert(err); reason != "" {
+			return reason
+		}
+	}
+
+	return CloseReasonError
+}
+
+// classifyTLSAlert classifies an alert received from the TLS peer. It returns
+// an empty reason when err is not a received alert.
+func classifyTLSAlert(err error) CloseReason {
+	// crypto/tls reports received alerts as a net.OpError with this operation.
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return ""
+	}
+
+	switch opErr.Err.Error() {
+	case "tls: access denied", "tls: certificate required", "tls: bad certificate":
+		return CloseReasonAuthRejected
+	}
+	return CloseReasonTLSAlert
+}
+
+// classifyMoverError classifies an error returned by a data mover. srcRemote
+// reports whether the mover reads from the plane.watch connection.
+func classifyMoverError(err error, srcRemote bool) CloseReason {
+	remote := srcRemote
+	var te *transferError
+	if errors.As(err, &te) && !te.read {
+		remote = !srcRemote
+	}
+	return classifyTransferError(err, remote)
+}
+
+// sessionRecord builds the Session for a single tunnel attempt. It snapshots
+// the tunnel counters so the session's own byte counts can be derived when it
+// ends.
+type sessionRecord struct {
+	// session is the record being built.
+	session Session
+	// ts is the tunnel's cumulative byte counters.
+	ts *tunnelStats
+	// startTxRemote is the remote transmit counter when the session started.
+	startTxRemote uint64
+	// startTxLocal is the local transmit counter when the session started.
+	startTxLocal uint64
+}
+
+// newSessionRecord starts a session record.
+func newSessionRecord(protocol, src, dst string, ts *tunnelStats) *sessionRecord {
+	_, bytesTxLocal, _, bytesTxRemote := ts.readStats()
+	return &sessionRecord{
+		session: Session{
+			Protocol:    protocol,
+			Source:      src,
+			Destination: dst,
+			Start:       time.Now(),
+		},
+		ts:            ts,
+		startTxRemote: bytesTxRemote,
+		startTxLocal:  bytesTxLocal,
+	}
+}
+
+// localConnected records that the local data source at src is connected.
+func (r *sessionRecord) localConnected(src string) {
+	r.session.Source = src
+}
+
+// established marks the tunnel to the plane.watch endpoint at dst as
+// established.
+func (r *sessionRecord) established(dst string) {
+	r.session.Established = true
+	r.session.EstablishedAt = time.Now()
+	r.session.Destination = dst
+}
+
+// finish completes the session with reason and err and returns the record.
+func (r *sessionRecord) finish(reason CloseReason, err error) Session {
+	_, bytesTxLocal, _, bytesTxRemote := r.ts.readStats()
+	r.session.End = time.Now()
+	r.session.BytesLocalToRemote = bytesTxRemote - r.startTxRemote
+	r.session.BytesRemoteToLocal = bytesTxLocal - r.startTxLocal
+	r.session.CloseReason = reason
+	if err != nil {
+		r.session.Error = err.Error()
+	}
+	return r.session
+}
@@ -0,0 +1,237 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"pw-feeder/lib/stunnel"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestSessionHistory verifies ring buffer ordering and wrapping.
+func TestSessionHistory(t *testing.T) {
+	h := NewSessionHistory(3)
+	assert.Empty(t, h.Sessions())
+
+	for i := range 5 {
+		h.Add(Session{Source: fmt.Sprint(i)})
+	}
+
+	sessions := h.Sessions()
+	require.Len(t, sessions, 3)
+	assert.Equal(t, "4", sessions[0].Source)
+	assert.Equal(t, "3", sessions[1].Source)
+	assert.Equal(t, "2", sessions[2].Source)
+
+	// A nil history discards sessions.
+	var nilHistory *SessionHistory
+	nilHistory.Add(Session{})
+	assert.Nil(t, nilHistory.Sessions())
+}
+
+// TestSessionDuration verifies only the time a session was established for is
+// counted.
+func TestSessionDuration(t *testing.T) {
+	start := time.Now()
+	established := Session{
+		Start:         start,
+		End:           start.Add(90 * time.Second),
+		Established:   true,
+		EstablishedAt: start.Add(10 * time.Second),
+	}
+	assert.Equal(t, 80*time.Second, established.Duration())
+
+	failed := Session{Start: start, End: start.Add(10 * time.Second)}
+	assert.Zero(t, failed.Duration())
+}
+
+// TestSessionHistoryServeHTTP verifies the JSON sessions endpoint.
+func TestSessionHistoryServeHTTP(t *testing.T) {
+	h := NewSessionHistory(0)
+	h.Add(Session{Protocol: "BEAST", CloseReason: CloseReasonRemoteEOF, BytesLocalToRemote: 42})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var body struct {
+		Sessions []Session `json:"sessions"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Len(t, body.Sessions, 1)
+	assert.Equal(t, CloseReasonRemoteEOF, body.Sessions[0].CloseReason)
+	assert.Equal(t, uint64(42), body.Sessions[0].BytesLocalToRemote)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/sessions", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+// TestClassifyDialError verifies connection attempt classification.
+func TestClassifyDialError(t *testing.T) {
+	assert.Equal(t, CloseReasonContextCancel, classifyDialError(context.Canceled))
+	assert.Equal(t, CloseReasonDNSFailure, classifyDialError(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}))
+	assert.Equal(t, CloseReasonDialTimeout, classifyDialError(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}))
+	assert.Equal(t, CloseReasonAuthRejected, classifyDialError(&net.OpError{Op: "remote error", Err: errors.New("tls: access denied")}))
+	assert.Equal(t, CloseReasonTLSAlert, classifyDialError(&net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}))
+	assert.Equal(t, CloseReasonError, classifyDialError(syscall.ECONNREFUSED))
+}
+
+// TestClassifyMoverError verifies classification of data mover errors by the
+// connection they were observed on.
+func TestClassifyMoverError(t *testing.T) {
+	readEOF := &transferError{read: true, err: io.EOF}
+	writeReset := &transferError{err: &net.OpError{Op: "write", Err: syscall.ECONNRESET}}
+
+	assert.Equal(t, CloseReasonLocalEOF, classifyMoverError(readEOF, false))
+	assert.Equal(t, CloseReasonRemoteEOF, classifyMoverError(readEOF, true))
+	assert.Equal(t, CloseReasonRemoteReset, classifyMoverError(writeReset, false))
+	assert.Equal(t, CloseReasonLocalReset, classifyMoverError(writeReset, true))
+	assert.Equal(t, CloseReasonPeerTimeout, classifyMoverError(&transferError{err: &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ETIMEDOUT)}}, false))
+	assert.Equal(t, CloseReasonPeerTimeout, classifyMoverError(&transferError{read: true, err: &net.OpError{Op: "read", Err: syscall.ETIMEDOUT}}, true))
+	assert.Equal(t, CloseReasonTLSAlert, classifyMoverError(&transferError{read: true, err: &net.OpError{Op: "remote error", Err: errors.New("tls: internal error")}}, true))
+	assert.Equal(t, CloseReason(""), classifyMoverError(&transferError{read: true, err: net.ErrClosed}, true))
+	assert.Equal(t, CloseReason(""), classifyMoverError(nil, true))
+}
+
+// TestCloseCause verifies that only the first close reason is kept.
+func TestCloseCause(t *testing.T) {
+	c := closeCause{}
+	c.set("", nil)
+	c.set(CloseReasonRemoteEOF, io.EOF)
+	c.set(CloseReasonLocalEOF, nil)
+	reason, err := c.get()
+	assert.Equal(t, CloseReasonRemoteEOF, reason)
+	assert.Equal(t, io.EOF, err)
+
+	empty := closeCause{}
+	reason, err = empty.get()
+	assert.Equal(t, CloseReasonError, reason)
+	assert.NoError(t, err)
+}
+
+// TestProxyBEASTConnectionRecordsSessions verifies that a session closed by
+// plane.watch is recorded and counted with its close reason.
+func TestProxyBEASTConnectionRecordsSessions(t *testing.T) {
+
+	testData := []byte("Test BEAST data! 1234567890")
+
+	// Replace the remote connector for testing.
+	connectToPlaneWatchOriginal := connectToPlaneWatch
+	t.Cleanup(func() {
+		connectToPlaneWatch = connectToPlaneWatchOriginal
+	})
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return net.Dial("tcp4", addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	closed := make(chan struct{})
+
+	// Start a mock plane.watch server that closes the tunnel after reading.
+	nl, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = nl.Close()
+	}()
+	wg.Go(func() {
+		c, err := nl.Accept()
+		require.NoError(t, err)
+		buf := make([]byte, 1000)
+		_, err = c.Read(buf)
+		require.NoError(t, err)
+		_ = c.Close()
+		close(closed)
+	})
+
+	// Start a mock BEAST provider that sends data and waits for the test to end.
+	bp, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = bp.Close()
+	}()
+	wg.Go(func() {
+		c, err := bp.Accept()
+		require.NoError(t, err)
+		_, err = c.Write(testData)
+		require.NoError(t, err)
+		<-ctx.Done()
+		_ = c.Close()
+	})
+
+	reg := prometheus.NewRegistry()
+	history := NewSessionHistory(8)
+	wg.Go(func() {
+		ProxyBEASTConnection(ctx, "BEAST", bp.Addr().String(), nl.Addr().String(), TestClientAPIKey.String(), false, reg, WithSessionHistory(history))
+	})
+
+	// Wait for the session to be recorded.
+	<-closed
+	require.Eventually(t, func() bool {
+		return len(history.Sessions()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	session := history.Sessions()[0]
+	assert.Equal(t, "BEAST", session.Protocol)
+	assert.Equal(t, CloseReasonRemoteEOF, session.CloseReason)
+	assert.Equal(t, uint64(len(testData)), session.BytesLocalToRemote)
+	assert.False(t, session.End.Before(session.Start))
+	assert.True(t, session.Established)
+	assert.False(t, session.EstablishedAt.Before(session.Start))
+	assert.Equal(t, session.End.Sub(session.EstablishedAt), session.Duration())
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	disconnects := make(map[string]float64)
+	for _, metricFamily := range metricFamilies {
+		if metricFamily.GetName() != "pwfeeder_tunnel_disconnects_total" {
+			continue
+		}
+		for _, metric := range metricFamily.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" {
+					disconnects[label.GetValue()] = metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	assert.Len(t, disconnects, len(closeReasons))
+	assert.Equal(t, float64(1), disconnects[string(CloseReasonRemoteEOF)])
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,326 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	tunnelSourceFormatMetricName = "source_format"
+	tunnelSourceFormatMetricHelp = "The format recognised in the first data from the local source, with a value of 1."
+
+	// sniffBytes is the most data read from a new source connection before
+	// it is forwarded without recognising its format.
+	sniffBytes = 256
+)
+
+// sniffTimeout is how long the first data from a new source connection is
+// waited for before the tunnel is started. A source that is quiet for longer
+// has its format recognised once the tunnel is running.
+var sniffTimeout = 5 * time.Second
+
+// sourceFormat is the format recognised in the data from a local source.
+type sourceFormat string
+
+const (
+	// sourceFormatBEAST is the BEAST binary format plane.watch expects.
+	sourceFormatBEAST sourceFormat = "beast"
+	// sourceFormatSBS is SBS/BaseStation text, as output on port 30003.
+	sourceFormatSBS sourceFormat = "sbs"
+	// sourceFormatAVR is AVR or raw hex text, as output on port 30002.
+	sourceFormatAVR sourceFormat = "avr"
+	// sourceFormatHTTP is a web server, such as tar1090 or graphs1090.
+	sourceFormatHTTP sourceFormat = "http"
+	// sourceFormatJSON is JSON, as output on port 30047 or by a web server.
+	sourceFormatJSON sourceFormat = "json"
+	// sourceFormatUnknown is anything else. It is forwarded in case it is
+	// BEAST data that started part way through a frame.
+	sourceFormatUnknown sourceFormat = "unknown"
+)
+
+// sourceFormats lists every source format so each series is exported from
+// zero.
+var sourceFormats = []sourceFormat{
+	sourceFormatBEAST,
+	sourceFormatSBS,
+	sourceFormatAVR,
+	sourceFormatHTTP,
+	sourceFormatJSON,
+	sourceFormatUnknown,
+}
+
+// sourceFormatHints explains each format that is not forwarded.
+var sourceFormatHints = map[sourceFormat]string{
+	sourceFormatSBS:  "this looks like SBS/BaseStation output, usually on port 30003, please connect to the BEAST output instead, usually on port 30005",
+	sourceFormatAVR:  "this looks like AVR or raw output, usually on port 30002, please connect to the BEAST output instead, usually on port 30005",
+	sourceFormatHTTP: "this looks like a web server such as tar1090, please connect to the BEAST output of the decoder instead, usually on port 30005",
+	sourceFormatJSON: "this looks like JSON output, please connect to the BEAST output of the decoder instead, usually on port 30005",
+}
+
+// sbsMessageTypes are the message types that start each SBS/BaseStation line.
+var sbsMessageTypes = []string{"MSG,", "SEL,", "ID,", "AIR,", "STA,", "CLK,"}
+
+// httpPrefixes start an HTTP response or a web page.
+var httpPrefixes = []string{"HTTP/", "<!DOCTYPE", "<!doctype", "<html", "<HTML"}
+
+// errWrongSourceFormat is returned when reading from a local source whose
+// data is recognised as a format other than BEAST.
+var errWrongSourceFormat = errors.New("the local source is not sending BEAST data")
+
+// sourceFormatError reports the format of a local source that is not
+// forwarded.
+type sourceFormatError struct {
+	// format is the recognised format.
+	format sourceFormat
+}
+
+// Error describes the format.
+func (e *sourceFormatError) Error() string {
+	return fmt.Sprintf("%s: found %s", errWrongSourceFormat, strings.ToUpper(string(e.format)))
+}
+
+// Unwrap returns errWrongSourceFormat.
+func (e *sourceFormatError) Unwrap() error {
+	return errWrongSourceFormat
+}
+
+// recogniseSourceFormat returns the format of the data that starts with
+// prefix, and whether prefix is long enough to tell.
+func recogniseSourceFormat(prefix []byte) (sourceFormat, bool) {
+	if len(prefix) == 0 {
+		return "", false
+	}
+
+	possible := false
+	for format, prefixes := range map[sourceFormat][]string{
+		sourceFormatSBS:  sbsMessageTypes,
+		sourceFormatHTTP: httpPrefixes,
+	} {
+		for _, p := range prefixes {
+			switch {
+			case bytes.HasPrefix(prefix, []byte(p)):
+				return format, true
+			case bytes.HasPrefix([]byte(p), prefix):
+				possible = true
+			}
+		}
+	}
+
+	switch prefix[0] {
+	case beastEscape:
+		return sourceFormatBEAST, true
+	case '{', '[':
+		return sourceFormatJSON, true
+	case '*', '@':
+		// AVR messages are hex digits between the marker and a semicolon.
+		for i, b := range prefix[1:] {
+			switch {
+			case b == ';' && i > 0:
+				return sourceFormatAVR, true
+			case !isHexDigit(b):
+				return sourceFormatUnknown, true
+			}
+		}
+		return "", false
+	}
+
+	if possible {
+		return "", false
+	}
+	return sourceFormatUnknown, true
+}
+
+// isHexDigit reports whether b is a hexadecimal digit.
+func isHexDigit(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
+// newSourceFormatMetrics returns the gauge reporting the recognised source
+// format, and registers it with reg when it is not nil. The returned function
+// unregisters it.
+func newSourceFormatMetrics(reg prometheus.Registerer, protocol string, logger zerolog.Logger) (*prometheus.GaugeVec, func()) {
+	protocol = strings.ToLower(protocol)
+	formats := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   tunnelMetricsSubsystem,
+		Name:        tunnelSourceFormatMetricName,
+		Help:        tunnelSourceFormatMetricHelp,
+		ConstLabels: prometheus.Labels{"protocol": protocol},
+	}, []string{"format"})
+	for _, format := range sourceFormats {
+		formats.WithLabelValues(string(format))
+	}
+	return formats, registerMetrics(reg, tunnelMetricsSubsystem, protocol, []metricSpec{
+		{name: tunnelSourceFormatMetricName, collector: formats},
+	}, logger)
+}
+
+// sniffConn holds back the first data read from a local source until its
+// format is recognised. Data in another known format is not forwarded:
+// reading fails with a sourceFormatError instead. It is only read from by a
+// single goroutine.
+type sniffConn struct {
+	net.Conn
+
+	// src is the address of the source, for log messages.
+	src string
+	// formats reports the recognised format.
+	formats *prometheus.GaugeVec
+	// logger explains a format that is not forwarded.
+	logger zerolog.Logger
+	// buf holds the data read before the format was recognised, and then
+	// the part of it not yet returned.
+	buf []byte
+	// err is the read error to return once buf has been returned.
+	err error
+	// recognised is set once the format is known.
+	recognised bool
+}
+
+// newSniffConn wraps the local source conn at src.
+func newSniffConn(conn net.Conn, src string, formats *prometheus.GaugeVec, logger zerolog.Logger) *sniffConn {
+	return &sniffConn{
+		Conn:    conn,
+		src:     src,
+		formats: formats,
+		logger:  logger,
+		buf:     make([]byte, 0, sniffBytes),
+	}
+}
+
+// newBeastSource wraps the local source conn so its data is checked against
+// settings if any are set.
+func newBeastSource(conn net.Conn, settings BeastSettings, logger zerolog.Logger) net.Conn {
+	if len(settings.letters) > 0 {
+		return newBeastVerifier(conn, settings, logger)
+	}
+	return conn
+}
+
+// sniff recognises the format of the source before the tunnel is started,
+// waiting up to timeout for its first data. It returns the error a read would
+// return, such as a sourceFormatError, or ctx.Err() once ctx is cancelled. A
+// source that sends nothing within timeout has its format recognised when it
+// is first read instead.
+func (c *sniffConn) sniff(ctx context.Context, timeout time.Duration) error {
+	err := c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.Conn.SetReadDeadline(time.Now())
+	})
+	err = c.recognise()
+	stop()
+	_ = c.Conn.SetReadDeadline(time.Time{})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+// Read returns data from the source once its format is recognised as one
+// that is forwarded.
+func (c *sniffConn) Read(b []byte) (int, error) {
+	if !c.recognised {
+		if err := c.recognise(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// recognise reads until the format of the source is known, or the source
+// fails or has sent sniffBytes.
+func (c *sniffConn) recognise() error {
+	var format sourceFormat
+	for {
+		n, err := c.Conn.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+n]
+		var ok bool
+		format, ok = recogniseSourceFormat(c.buf)
+		if ok || len(c.buf) == cap(c.buf) {
+			break
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Keep what has been read for the next attempt.
+			return err
+		}
+		if err != nil {
+			c.err = err
+			if len(c.buf) == 0 {
+				if errors.Is(err, io.EOF) {
+					c.logger.Warn().Str("source", c.src).Msg("the local source closed the connection without sending anything, if this is a web port such as tar1090 please connect to the BEAST output instead, usually on port 30005")
+				}
+				return err
+			}
+			break
+		}
+	}
+	if format == "" {
+		format = sourceFormatUnknown
+	}
+
+	c.recognised = true
+	for _, f := range sourceFormats {
+		value := 0.0
+		if f == format {
+			value = 1
+		}
+		c.formats.WithLabelValues(string(f)).Set(value)
+	}
+
+	hint, refused := sourceFormatHints[format]
+	if !refused {
+		if format == sourceFormatUnknown {
+			c.logger.Warn().Str("source", c.src).Msg("the local source does not appear to be sending BEAST data, forwarding it anyway")
+		}
+		return nil
+	}
+	c.logger.Error().
+		Str("source", c.src).
+		Str("format", string(format)).
+		Msg("the local source is not sending BEAST data: " + hint)
+	c.buf = nil
+	c.err = &sourceFormatError{format: format}
+	return c.err
+}
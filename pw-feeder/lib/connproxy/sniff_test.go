@@ -0,0 +1,391 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"pw-feeder/lib/stunnel"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestRecogniseSourceFormat verifies the formats commonly connected to by
+// mistake are recognised, and that short prefixes wait for more data.
+func TestRecogniseSourceFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   sourceFormat
+		ok     bool
+	}{
+		{name: "nothing", prefix: ""},
+		{name: "beast", prefix: "\x1a2\x00\x01", want: sourceFormatBEAST, ok: true},
+		{name: "sbs", prefix: "MSG,3,1,1,7C7B4A,1,2024/01/01", want: sourceFormatSBS, ok: true},
+		{name: "sbs aircraft", prefix: "AIR,,333,", want: sourceFormatSBS, ok: true},
+		{name: "partial sbs", prefix: "MS"},
+		{name: "avr", prefix: "*8d7c7b4a58c38209a8f4d2e5a7e4;\n", want: sourceFormatAVR, ok: true},
+		{name: "avr with timestamp", prefix: "@0000123456788d7c7b4a;", want: sourceFormatAVR, ok: true},
+		{name: "partial avr", prefix: "*8d7c7b"},
+		{name: "not avr", prefix: "*hello", want: sourceFormatUnknown, ok: true},
+		{name: "http response", prefix: "HTTP/1.1 400 Bad Request\r\n", want: sourceFormatHTTP, ok: true},
+		{name: "web page", prefix: "<!DOCTYPE html>", want: sourceFormatHTTP, ok: true},
+		{name: "partial web page", prefix: "<!DOC"},
+		{name: "json object", prefix: `{"now":1700000000.0,`, want: sourceFormatJSON, ok: true},
+		{name: "json array", prefix: `[{"hex":"7c7b4a"}]`, want: sourceFormatJSON, ok: true},
+		{name: "unknown", prefix: "\x00\x01\x02", want: sourceFormatUnknown, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := recogniseSourceFormat([]byte(tt.prefix))
+			assert.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+// TestSniffConn verifies BEAST data is returned intact, other known formats
+// are refused, and the recognised format is reported.
+func TestSniffConn(t *testing.T) {
+	beast := bytes.Repeat(beastHeartbeat, 40)
+
+	tests := []struct {
+		name    string
+		writes  []string
+		want    sourceFormat
+		wantErr bool
+	}{
+		{name: "beast", writes: []string{string(beast[:1]), string(beast[1:])}, want: sourceFormatBEAST},
+		{name: "unknown is forwarded", writes: []string{string(beast[5:])}, want: sourceFormatUnknown},
+		{name: "sbs split across reads", writes: []string{"MS", "G,3,1,1,7C7B4A,1\r\n"}, want: sourceFormatSBS, wantErr: true},
+		{name: "avr", writes: []string{"*8d7c7b4a58c3", "8209a8f4d2e5a7e4;\n"}, want: sourceFormatAVR, wantErr: true},
+		{name: "short data before eof", writes: []string{"MS"}, want: sourceFormatUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formats, unregister := newSourceFormatMetrics(nil, "BEAST", zerolog.Nop())
+			defer unregister()
+
+			c1, c2 := net.Pipe()
+			defer func() {
+				_ = c1.Close()
+			}()
+			go func() {
+				for _, w := range tt.writes {
+					_, _ = c2.Write([]byte(w))
+				}
+				_ = c2.Close()
+			}()
+
+			sc := newSniffConn(c1, "127.0.0.1:30003", formats, zerolog.Nop())
+			data, err := io.ReadAll(sc)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errWrongSourceFormat)
+				assert.Equal(t, CloseReasonWrongSourceFormat, classifyTransferError(err, false))
+				assert.Empty(t, data)
+				_, err = sc.Read(make([]byte, 16))
+				assert.ErrorIs(t, err, errWrongSourceFormat, "later reads must fail too")
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, joinWrites(tt.writes), string(data))
+			}
+			for _, format := range sourceFormats {
+				want := 0.0
+				if format == tt.want {
+					want = 1
+				}
+				assert.Equal(t, want, testutil.ToFloat64(formats.WithLabelValues(string(format))), format)
+			}
+		})
+	}
+
+	// A source that closes without sending anything is reported as such.
+	formats, unregister := newSourceFormatMetrics(nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+	_, err := newSniffConn(c1, "127.0.0.1:8080", formats, zerolog.Nop()).Read(make([]byte, 16))
+	assert.True(t, errors.Is(err, io.EOF))
+}
+
+// TestSniffConnSniff verifies the format is recognised before the source is
+// read, that a quiet source is recognised when it is first read instead, and
+// that waiting stops when the context is cancelled.
+func TestSniffConnSniff(t *testing.T) {
+	formats, unregister := newSourceFormatMetrics(nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	frame := []byte{beastEscape, '1', 1, 2, 3, 4, 5, 6, 0x40, 0x12, 0x34}
+
+	c1, c2 := net.Pipe()
+	defer func() {
+		_ = c1.Close()
+	}()
+	go func() {
+		_, _ = c2.Write([]byte("MSG,3,1,1,7C7B4A,1\r\n"))
+		_ = c2.Close()
+	}()
+	err := newSniffConn(c1, "127.0.0.1:30003", formats, zerolog.Nop()).sniff(t.Context(), time.Second)
+	assert.ErrorIs(t, err, errWrongSourceFormat)
+
+	quiet, source := net.Pipe()
+	defer func() {
+		_ = quiet.Close()
+	}()
+	sc := newSniffConn(quiet, "127.0.0.1:30005", formats, zerolog.Nop())
+	require.NoError(t, sc.sniff(t.Context(), 10*time.Millisecond))
+	assert.False(t, sc.recognised)
+	go func() {
+		_, _ = source.Write(frame)
+		_ = source.Close()
+	}()
+	data, err := io.ReadAll(sc)
+	require.NoError(t, err)
+	assert.Equal(t, frame, data)
+	assert.Equal(t, 1.0, testutil.ToFloat64(formats.WithLabelValues(string(sourceFormatBEAST))))
+
+	cancelled, _ := net.Pipe()
+	defer func() {
+		_ = cancelled.Close()
+	}()
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = newSniffConn(cancelled, "127.0.0.1:30005", formats, zerolog.Nop()).sniff(ctx, time.Minute)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// TestNewBeastSource verifies the source is only checked against the
+// receiver options when there are some.
+func TestNewBeastSource(t *testing.T) {
+	settings, err := ParseBeastSettings("crc")
+	require.NoError(t, err)
+	c1, _ := net.Pipe()
+
+	_, ok := newBeastSource(c1, settings, zerolog.Nop()).(*beastVerifier)
+	assert.True(t, ok)
+	assert.Equal(t, c1, newBeastSource(c1, BeastSettings{}, zerolog.Nop()))
+}
+
+// joinWrites joins the writes made to a connection.
+func joinWrites(writes []string) string {
+	var b bytes.Buffer
+	for _, w := range writes {
+		b.WriteString(w)
+	}
+	return b.String()
+}
+
+// TestProxyBEASTConnectionWrongSourceFormat verifies the tunnel to
+// plane.watch is not started for a local source sending SBS data.
+func TestProxyBEASTConnectionWrongSourceFormat(t *testing.T) {
+	connectToPlaneWatchOriginal := connectToPlaneWatch
+	t.Cleanup(func() {
+		connectToPlaneWatch = connectToPlaneWatchOriginal
+	})
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return net.Dial("tcp4", addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	// Start a mock plane.watch server that records everything it receives.
+	nl, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = nl.Close()
+	}()
+	var accepted atomic.Int32
+	wg.Go(func() {
+		for {
+			c, err := nl.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			_ = c.Close()
+		}
+	})
+
+	// Start a mock SBS provider.
+	bp, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = bp.Close()
+	}()
+	wg.Go(func() {
+		c, err := bp.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, _ = c.Write([]byte("MSG,3,1,1,7C7B4A,1,2024/01/01,00:00:00.000,2024/01/01,00:00:00.000,,36000,,,-33.9,151.2,,,0,0,0,0\r\n"))
+		<-ctx.Done()
+		_ = c.Close()
+	})
+
+	reg := prometheus.NewRegistry()
+	history := NewSessionHistory(8)
+	wg.Go(func() {
+		ProxyBEASTConnection(ctx, "BEAST", bp.Addr().String(), nl.Addr().String(), TestClientAPIKey.String(), false, reg,
+			WithSessionHistory(history),
+		)
+	})
+
+	require.Eventually(t, func() bool {
+		return len(history.Sessions()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, CloseReasonWrongSourceFormat, history.Sessions()[0].CloseReason)
+	assert.False(t, history.Sessions()[0].Established)
+	assert.Zero(t, accepted.Load(), "the tunnel must not be started")
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	found := false
+	for _, mf := range metricFamilies {
+		if mf.GetName() != "pwfeeder_tunnel_source_format" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "format" && label.GetValue() == "sbs" {
+					found = true
+					assert.Equal(t, 1.0, m.GetGauge().GetValue())
+				}
+			}
+		}
+	}
+	assert.True(t, found, "the recognised format should be exported")
+
+	cancel()
+	_ = nl.Close()
+	_ = bp.Close()
+	wg.Wait()
+}
+
+// TestProxyBEASTConnectionWrongSourceFormatFailover verifies the next source
+// is used when the preferred one is not sending BEAST data, and that it is
+// not switched back to.
+func TestProxyBEASTConnectionWrongSourceFormatFailover(t *testing.T) {
+	connectToPlaneWatchOriginal := connectToPlaneWatch
+	sourceProbeIntervalOriginal := sourceProbeInterval
+	t.Cleanup(func() {
+		connectToPlaneWatch = connectToPlaneWatchOriginal
+		sourceProbeInterval = sourceProbeIntervalOriginal
+	})
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return net.Dial("tcp4", addr)
+	}
+	sourceProbeInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	// Start a mock plane.watch server that reports the first frame of each
+	// tunnel.
+	nl, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = nl.Close()
+	}()
+	received := make(chan []byte, 8)
+	wg.Go(func() {
+		for {
+			c, err := nl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = c.Close()
+				}()
+				data := make([]byte, len(beastHeartbeat))
+				if _, err := io.ReadFull(c, data); err == nil {
+					received <- data
+				}
+				_, _ = io.Copy(io.Discard, c)
+			}()
+		}
+	})
+
+	// Start a mock SBS provider and a mock BEAST provider that both keep
+	// sending.
+	serve := func(data []byte) net.Listener {
+		l, err := nettest.NewLocalListener("tcp4")
+		require.NoError(t, err)
+		wg.Go(func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer func() {
+						_ = c.Close()
+					}()
+					for {
+						if _, err := c.Write(data); err != nil {
+							return
+						}
+						time.Sleep(5 * time.Millisecond)
+					}
+				}()
+			}
+		})
+		return l
+	}
+	sbs := serve([]byte("MSG,3,1,1,7C7B4A,1\r\n"))
+	beast := serve(beastHeartbeat)
+
+	history := NewSessionHistory(8)
+	wg.Go(func() {
+		ProxyBEASTConnection(ctx, "BEAST", sbs.Addr().String()+","+beast.Addr().String(), nl.Addr().String(), TestClientAPIKey.String(), false, nil,
+			WithSessionHistory(history),
+			WithSourceFailover(time.Second, 20*time.Millisecond),
+		)
+	})
+
+	assert.Equal(t, beastHeartbeat, <-received)
+	sessions := history.Sessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, sbs.Addr().String(), sessions[0].Source)
+	assert.Equal(t, CloseReasonWrongSourceFormat, sessions[0].CloseReason)
+
+	// The SBS source is probed but never switched back to.
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, history.Sessions(), 1)
+
+	cancel()
+	_ = nl.Close()
+	_ = sbs.Close()
+	_ = beast.Close()
+	wg.Wait()
+}
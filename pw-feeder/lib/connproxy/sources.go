@@ -0,0 +1,307 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	beastMetricsSubsystem = "beast"
+
+	beastActiveSourceMetricName = "active_source"
+	beastActiveSourceMetricHelp = "The BEAST source data is being read from, with a value of 1."
+
+	// DefaultSourceHoldDown is how long a more preferred BEAST source must
+	// stay healthy before the feeder switches back to it.
+	DefaultSourceHoldDown = 5 * time.Minute
+)
+
+// sourceProbeInterval is how often a tunnel reading from a less preferred
+// BEAST source starts checking whether a more preferred one has recovered.
+var sourceProbeInterval = 30 * time.Second
+
+// ParseSources splits a comma-separated list of local BEAST sources, most
+// preferred first. Entries are not checked beyond being present.
+func ParseSources(s string) ([]string, error) {
+	var sources []string
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			sources = append(sources, entry)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no sources given")
+	}
+	return sources, nil
+}
+
+// sourceSet chooses which local BEAST source a proxy reads from. The most
+// preferred source is used until it fails to connect or stalls, then the next
+// one, and the tunnel switches back once a more preferred source has been
+// healthy for the hold-down time. It is safe for concurrent use.
+type sourceSet struct {
+	// sources are the addresses in order of preference.
+	sources []string
+	// stallTimeout is how long a source may send nothing before it is
+	// treated as failed. Stalls are not detected when it is not positive.
+	stallTimeout time.Duration
+	// holdDown is how long a more preferred source must stay healthy before
+	// it is switched back to.
+	holdDown time.Duration
+	// activeSource reports the source in use.
+	activeSource *prometheus.GaugeVec
+	// logger records source changes.
+	logger zerolog.Logger
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// next is the index of the source tried first on the next connection.
+	next int
+	// active is the address of the most recently connected source.
+	active string
+}
+
+// newSourceSet returns a sourceSet for the comma-separated sources in s. It
+// registers the source collector for protocol with reg when it is not nil,
+// and the returned function unregisters it.
+func newSourceSet(
+	s string,
+	stallTimeout, holdDown time.Duration,
+	reg prometheus.Registerer,
+	protocol string,
+	logger zerolog.Logger,
+) (*sourceSet, func()) {
+	sources, err := ParseSources(s)
+	if err != nil {
+		// Let the connection attempt report the bad address.
+		sources = []string{s}
+	}
+
+	protocol = strings.ToLower(protocol)
+	ss := &sourceSet{
+		sources:      sources,
+		stallTimeout: stallTimeout,
+		holdDown:     holdDown,
+		activeSource: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   beastMetricsSubsystem,
+			Name:        beastActiveSourceMetricName,
+			Help:        beastActiveSourceMetricHelp,
+			ConstLabels: prometheus.Labels{"protocol": protocol},
+		}, []string{"source"}),
+		logger: logger,
+	}
+	return ss, registerMetrics(reg, beastMetricsSubsystem, protocol, []metricSpec{
+		{name: beastActiveSourceMetricName, collector: ss.activeSource},
+	}, logger)
+}
+
+// failover reports whether there is more than one source to choose from.
+func (ss *sourceSet) failover() bool {
+	return len(ss.sources) > 1
+}
+
+// connect returns a connection to the source currently preferred, trying the
+// following sources and then the earlier ones in order when it fails. It
+// also returns the address that was connected to.
+func (ss *sourceSet) connect(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, string, error) {
+	ss.mu.Lock()
+	next := ss.next
+	ss.mu.Unlock()
+
+	var errs []error
+	for i := range ss.sources {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		addr := ss.sources[(next+i)%len(ss.sources)]
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			if ss.failover() {
+				ss.logger.Warn().Err(err).Str("source", addr).Msg("could not connect to BEAST source, trying the next one")
+			}
+			errs = append(errs, err)
+			continue
+		}
+		ss.mu.Lock()
+		ss.next = (next + i) % len(ss.sources)
+		ss.setActive(addr)
+		ss.mu.Unlock()
+		return conn, addr, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// markFailed records that the source at addr stopped sending data or sent
+// the wrong format, so the next connection starts with the source after it.
+func (ss *sourceSet) markFailed(addr string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.sources[ss.next] == addr {
+		ss.next = (ss.next + 1) % len(ss.sources)
+	}
+}
+
+// setActive records that the tunnel is reading from addr. ss.mu must be held.
+func (ss *sourceSet) setActive(addr string) {
+	if addr == ss.active {
+		return
+	}
+	if ss.active != "" {
+		ss.activeSource.DeleteLabelValues(ss.active)
+		ss.logger.Info().Str("source", addr).Str("previous", ss.active).Msg("switched BEAST source")
+	}
+	ss.activeSource.WithLabelValues(addr).Set(1)
+	ss.active = addr
+}
+
+// watchStall calls stall once nothing has been read from the source for the
+// stall timeout, according to lastRead. It returns when ctx is cancelled or
+// stall is called, or straight away when stalls are not detected.
+func (ss *sourceSet) watchStall(ctx context.Context, lastRead func() time.Time, stall func()) {
+	if ss.stallTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(ss.stallTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(lastRead()) >= ss.stallTimeout {
+			stall()
+			return
+		}
+	}
+}
+
+// watchFailback checks every sourceProbeInterval whether a source more
+// preferred than the one in use has recovered, by connecting to it and
+// reading from it for the hold-down time. Once one stays healthy that long
+// it becomes the preferred source and failback is called. It returns once
+// ctx is cancelled or failback has been called, or straight away when the
+// most preferred source is in use. Cancelling ctx also cancels any check in
+// progress.
+func (ss *sourceSet) watchFailback(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error), failback func()) {
+	ss.mu.Lock()
+	current := ss.next
+	ss.mu.Unlock()
+	if current == 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sourceProbeInterval):
+		}
+
+		for i, addr := range ss.sources[:current] {
+			if !ss.probe(ctx, dial, addr) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			ss.mu.Lock()
+			ss.next = i
+			ss.mu.Unlock()
+
+			ss.logger.Info().Str("source", addr).Dur("hold_down", ss.holdDown).Msg("preferred BEAST source has recovered, switching back")
+			failback()
+			return
+		}
+	}
+}
+
+// probe reports whether the source at addr accepts a connection and keeps
+// sending data, without stalling, for the hold-down time. A source whose
+// first data is in a format that is not forwarded is not healthy.
+func (ss *sourceSet) probe(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error), addr string) bool {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	healthyAt := time.Now().Add(ss.holdDown)
+	buf := make([]byte, 4096)
+	first := true
+	for {
+		deadline := healthyAt
+		if stallAt := time.Now().Add(ss.stallTimeout); ss.stallTimeout > 0 && stallAt.Before(deadline) {
+			deadline = stallAt
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return false
+		}
+		n, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(healthyAt) {
+			return true
+		}
+		if err != nil {
+			ss.logger.Debug().Err(err).Str("source", addr).Msg("preferred BEAST source is not healthy yet")
+			return false
+		}
+		if first {
+			first = false
+			format, _ := recogniseSourceFormat(buf[:n])
+			if _, refused := sourceFormatHints[format]; refused {
+				ss.logger.Debug().Str("source", addr).Str("format", string(format)).Msg("preferred BEAST source is not sending BEAST data")
+				return false
+			}
+		}
+	}
+}
+
+// localActivity returns a function reporting when data was last read from
+// the local source, sampled from ts when the function is called.
+func localActivity(ts *tunnelStats) func() time.Time {
+	last := time.Now()
+	received, _, _, _ := ts.readStats()
+	return func() time.Time {
+		rx, _, _, _ := ts.readStats()
+		if rx != received {
+			received = rx
+			last = time.Now()
+		}
+		return last
+	}
+}
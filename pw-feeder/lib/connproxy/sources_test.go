@@ -0,0 +1,363 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package connproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"pw-feeder/lib/stunnel"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// streamingSource is a dial function for BEAST sources that send a frame
+// every few milliseconds unless they are quiet.
+type streamingSource struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// quiet lists the addresses that accept connections but send nothing.
+	quiet map[string]bool
+	// down lists the addresses that refuse connections.
+	down map[string]bool
+}
+
+// dial returns a connection to addr that streams frames unless addr is
+// quiet, or an error when addr is down.
+func (s *streamingSource) dial(_ context.Context, addr string) (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down[addr] {
+		return nil, errors.New(addr + " refused")
+	}
+	c, peer := net.Pipe()
+	if s.quiet[addr] {
+		go func() {
+			_, _ = peer.Read(make([]byte, 1))
+			_ = peer.Close()
+		}()
+		return c, nil
+	}
+	go func() {
+		defer func() {
+			_ = peer.Close()
+		}()
+		for {
+			if _, err := peer.Write(beastHeartbeat); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	return c, nil
+}
+
+// set marks addr as quiet or down.
+func (s *streamingSource) set(addr string, quiet, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quiet[addr] = quiet
+	s.down[addr] = down
+}
+
+// TestParseSources verifies lists of sources are split and trimmed.
+func TestParseSources(t *testing.T) {
+	sources, err := ParseSources(" 127.0.0.1:30005, serial:///dev/ttyUSB0?baud=3000000&flow=none ,unix:///run/beast,")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:30005", "serial:///dev/ttyUSB0?baud=3000000&flow=none", "unix:///run/beast"}, sources)
+
+	for _, s := range []string{"", " , "} {
+		_, err := ParseSources(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// TestSourceSetConnect verifies sources are tried in order starting with the
+// preferred one, that a stall moves to the next, and that the active source
+// is reported in metrics.
+func TestSourceSetConnect(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ss, unregister := newSourceSet("a:1,b:1,c:1", time.Minute, time.Minute, reg, "BEAST", zerolog.Nop())
+	assert.True(t, ss.failover())
+	f := &fakeEndpoints{down: map[string]bool{}}
+	ctx := context.Background()
+
+	c, addr, err := ss.connect(ctx, f.dial)
+	require.NoError(t, err)
+	_ = c.Close()
+	assert.Equal(t, "a:1", addr)
+	assert.Equal(t, []string{"a:1"}, f.takeDialled())
+
+	// A source that cannot be connected to fails over to the next.
+	f.setDown("a:1", true)
+	_, addr, err = ss.connect(ctx, f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", addr)
+	assert.Equal(t, []string{"a:1", "b:1"}, f.takeDialled())
+
+	// The secondary stays in use even once the primary accepts connections.
+	f.setDown("a:1", false)
+	_, addr, err = ss.connect(ctx, f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", addr)
+	assert.Equal(t, []string{"b:1"}, f.takeDialled())
+	assert.Equal(t, float64(1), testutil.ToFloat64(ss.activeSource.WithLabelValues("b:1")))
+
+	// A stalled source is skipped on the next connection, wrapping around
+	// to the start of the list.
+	ss.markFailed("b:1")
+	f.setDown("c:1", true)
+	_, addr, err = ss.connect(ctx, f.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "a:1", addr)
+	assert.Equal(t, []string{"c:1", "a:1"}, f.takeDialled())
+
+	f.setDown("a:1", true)
+	f.setDown("b:1", true)
+	_, _, err = ss.connect(ctx, f.dial)
+	assert.ErrorContains(t, err, "a:1 refused")
+	assert.ErrorContains(t, err, "c:1 refused")
+
+	metricFamilies, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, metricFamilies, 1)
+	assert.Len(t, metricFamilies[0].GetMetric(), 1, "only the active source should be reported")
+	problems, err := promlint.NewWithMetricFamilies(metricFamilies).Lint()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	unregister()
+	metricFamilies, err = reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metricFamilies)
+}
+
+// TestSourceSetWatchStall verifies a stall is reported once nothing has been
+// read for the stall timeout.
+func TestSourceSetWatchStall(t *testing.T) {
+	ss, unregister := newSourceSet("a:1,b:1", 20*time.Millisecond, time.Minute, nil, "BEAST", zerolog.Nop())
+	defer unregister()
+
+	ts := tunnelStats{}
+	start := time.Now()
+	stalled := false
+	ss.watchStall(context.Background(), localActivity(&ts), func() { stalled = true })
+	assert.True(t, stalled)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// Nothing is watched without a stall timeout.
+	ss.stallTimeout = 0
+	ss.watchStall(context.Background(), localActivity(&ts), func() { t.Error("stall reported without a stall timeout") })
+}
+
+// TestSourceSetProbe verifies a source is only healthy once it has kept
+// sending data for the hold-down time.
+func TestSourceSetProbe(t *testing.T) {
+	ss, unregister := newSourceSet("a:1,b:1", 20*time.Millisecond, 50*time.Millisecond, nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	s := &streamingSource{quiet: map[string]bool{"b:1": true}, down: map[string]bool{"c:1": true}}
+	ctx := context.Background()
+
+	start := time.Now()
+	assert.True(t, ss.probe(ctx, s.dial, "a:1"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.False(t, ss.probe(ctx, s.dial, "b:1"), "a quiet source is stalled")
+	assert.False(t, ss.probe(ctx, s.dial, "c:1"), "a source that refuses connections is down")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, ss.probe(canceled, s.dial, "a:1"))
+
+	// Cancelling ctx also cancels a connection attempt in progress.
+	expiring, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, ss.probe(expiring, func(ctx context.Context, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, "a:1"))
+}
+
+// TestSourceSetFailback verifies the tunnel switches back to the preferred
+// source once it has recovered.
+func TestSourceSetFailback(t *testing.T) {
+	sourceProbeIntervalOriginal := sourceProbeInterval
+	t.Cleanup(func() {
+		sourceProbeInterval = sourceProbeIntervalOriginal
+	})
+	sourceProbeInterval = 10 * time.Millisecond
+
+	ss, unregister := newSourceSet("a:1,b:1", 20*time.Millisecond, 50*time.Millisecond, nil, "BEAST", zerolog.Nop())
+	defer unregister()
+	s := &streamingSource{quiet: map[string]bool{}, down: map[string]bool{"a:1": true}}
+
+	_, addr, err := ss.connect(context.Background(), s.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "b:1", addr)
+
+	s.set("a:1", false, false)
+	failedBack := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ss.watchFailback(context.Background(), s.dial, func() { close(failedBack) })
+	}()
+	select {
+	case <-failedBack:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not switch back to the preferred source")
+	}
+	<-done
+
+	_, addr, err = ss.connect(context.Background(), s.dial)
+	require.NoError(t, err)
+	assert.Equal(t, "a:1", addr)
+
+	// The watcher does nothing on the preferred source.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ss.watchFailback(ctx, s.dial, func() { t.Error("failback called on the preferred source") })
+}
+
+// TestProxyBEASTConnectionSourceFailover verifies a stalled primary source
+// fails over to the secondary, and that the tunnel switches back once the
+// primary is sending data again.
+func TestProxyBEASTConnectionSourceFailover(t *testing.T) {
+	connectToPlaneWatchOriginal := connectToPlaneWatch
+	sourceProbeIntervalOriginal := sourceProbeInterval
+	t.Cleanup(func() {
+		connectToPlaneWatch = connectToPlaneWatchOriginal
+		sourceProbeInterval = sourceProbeIntervalOriginal
+	})
+	connectToPlaneWatch = func(ctx context.Context, name, addr, sni string, insecure bool, opts ...stunnel.Option) (c net.Conn, err error) {
+		return net.Dial("tcp4", addr)
+	}
+	sourceProbeInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	// Start a mock plane.watch server that discards everything.
+	nl, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = nl.Close()
+	}()
+	wg.Go(func() {
+		for {
+			c, err := nl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, c)
+				_ = c.Close()
+			}()
+		}
+	})
+
+	// Start mock BEAST sources. The primary sends nothing to its first
+	// connection, then streams frames.
+	serve := func(quietFirst bool) net.Listener {
+		l, err := nettest.NewLocalListener("tcp4")
+		require.NoError(t, err)
+		wg.Go(func() {
+			quiet := quietFirst
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func(quiet bool) {
+					defer func() {
+						_ = c.Close()
+					}()
+					if quiet {
+						_, _ = io.Copy(io.Discard, c)
+						return
+					}
+					for {
+						if _, err := c.Write(beastHeartbeat); err != nil {
+							return
+						}
+						time.Sleep(5 * time.Millisecond)
+					}
+				}(quiet)
+				quiet = false
+			}
+		})
+		return l
+	}
+	primary := serve(true)
+	secondary := serve(false)
+
+	reg := prometheus.NewRegistry()
+	history := NewSessionHistory(8)
+	wg.Go(func() {
+		ProxyBEASTConnection(ctx, "BEAST", primary.Addr().String()+","+secondary.Addr().String(), nl.Addr().String(), TestClientAPIKey.String(), false, reg,
+			WithSessionHistory(history),
+			WithSourceFailover(50*time.Millisecond, 100*time.Millisecond),
+		)
+	})
+
+	require.Eventually(t, func() bool {
+		return len(history.Sessions()) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	// Sessions are listed newest first.
+	sessions := history.Sessions()
+	oldest := sessions[len(sessions)-1]
+	assert.Equal(t, primary.Addr().String(), oldest.Source)
+	assert.Equal(t, CloseReasonSourceStalled, oldest.CloseReason)
+	failedOver := sessions[len(sessions)-2]
+	assert.Equal(t, secondary.Addr().String(), failedOver.Source)
+	assert.Equal(t, CloseReasonFailback, failedOver.CloseReason)
+
+	require.Eventually(t, func() bool {
+		metricFamilies, err := reg.Gather()
+		require.NoError(t, err)
+		for _, mf := range metricFamilies {
+			if mf.GetName() != "pwfeeder_beast_active_source" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "source" {
+						return label.GetValue() == primary.Addr().String()
+					}
+				}
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	_ = nl.Close()
+	_ = primary.Close()
+	_ = secondary.Close()
+	wg.Wait()
+}
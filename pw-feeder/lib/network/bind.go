@@ -0,0 +1,124 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrSocketOptionUnsupported reports that binding to an interface or setting
+// a firewall mark is not supported on this platform.
+var ErrSocketOptionUnsupported = errors.New("binding to an interface and setting a firewall mark are only supported on Linux")
+
+// WithBindAddress returns a DialOption that sends outbound connections from
+// addr, which must be assigned to this host. Only hosts with addresses in the
+// same family as addr can be reached. A nil addr has no effect.
+func WithBindAddress(addr net.IP) DialOption {
+	return func(o *dialOptions) {
+		o.bindAddr = addr
+	}
+}
+
+// WithBindInterface returns a DialOption that sends outbound connections over
+// the named network interface using SO_BINDTODEVICE. An empty name has no
+// effect.
+func WithBindInterface(name string) DialOption {
+	return func(o *dialOptions) {
+		o.bindInterface = name
+	}
+}
+
+// WithFwmark returns a DialOption that marks outbound connections with mark
+// using SO_MARK, so policy routing rules can choose their route. A zero mark
+// has no effect.
+func WithFwmark(mark uint32) DialOption {
+	return func(o *dialOptions) {
+		o.fwmark = mark
+	}
+}
+
+// bound reports whether any bind option is set.
+func (o dialOptions) bound() bool {
+	return o.bindAddr != nil || o.bindInterface != "" || o.fwmark != 0
+}
+
+// bind applies the bind options to nd.
+func (o dialOptions) bind(nd *net.Dialer) {
+	if o.bindAddr != nil {
+		nd.LocalAddr = &net.TCPAddr{IP: o.bindAddr}
+	}
+	if o.bindInterface != "" || o.fwmark != 0 {
+		nd.Control = func(network, address string, c syscall.RawConn) error {
+			return setSocketOptions(c, o)
+		}
+	}
+}
+
+// bindFamily returns the addresses in addrs that can be reached from the bind
+// address, or addrs unchanged when no bind address is set.
+func (o dialOptions) bindFamily(addrs []net.IPAddr) []net.IPAddr {
+	if o.bindAddr == nil {
+		return addrs
+	}
+	v4 := o.bindAddr.To4() != nil
+	reachable := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == v4 {
+			reachable = append(reachable, addr)
+		}
+	}
+	return reachable
+}
+
+// allLoopback reports whether every address in addrs is a loopback address.
+func allLoopback(addrs []net.IPAddr) bool {
+	for _, addr := range addrs {
+		if !addr.IP.IsLoopback() {
+			return false
+		}
+	}
+	return len(addrs) > 0
+}
+
+// CheckBind verifies that the bind address, interface and firewall mark can
+// be applied, so a missing interface, address or capability is reported at
+// startup rather than on every connection attempt.
+func (d *Dialer) CheckBind() error {
+	if d == nil || !d.opts.bound() {
+		return nil
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setSocketOptions(c, d.opts)
+		},
+	}
+	addr := ":0"
+	if d.opts.bindAddr != nil {
+		addr = net.JoinHostPort(d.opts.bindAddr.String(), "0")
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return err
+	}
+	return pc.Close()
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestBindFamily verifies that only addresses reachable from the bind
+// address are kept.
+func TestBindFamily(t *testing.T) {
+	v4 := net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	v6 := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+
+	assert.Equal(t, []net.IPAddr{v4, v6}, dialOptions{}.bindFamily([]net.IPAddr{v4, v6}))
+	assert.Equal(t, []net.IPAddr{v4}, dialOptions{bindAddr: net.ParseIP("198.51.100.1")}.bindFamily([]net.IPAddr{v4, v6}))
+	assert.Equal(t, []net.IPAddr{v6}, dialOptions{bindAddr: net.ParseIP("2001:db8::2")}.bindFamily([]net.IPAddr{v4, v6}))
+
+	assert.True(t, allLoopback([]net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.IPv6loopback}}))
+	assert.False(t, allLoopback([]net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, v4}))
+	assert.False(t, allLoopback(nil))
+}
+
+// TestBindAddress verifies connections are made from the bind address.
+func TestBindAddress(t *testing.T) {
+	l, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	nd := net.Dialer{}
+	dialOptions{bindAddr: net.ParseIP("127.0.0.2")}.bind(&nd)
+	c, err := nd.DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	sc, err := l.Accept()
+	require.NoError(t, err)
+	defer func() { _ = sc.Close() }()
+	assert.Equal(t, "127.0.0.2", sc.RemoteAddr().(*net.TCPAddr).IP.String())
+}
+
+// TestDialerBindSkipsLoopback verifies that loopback hosts are reached
+// without the bind options, so a local data source keeps working.
+func TestDialerBindSkipsLoopback(t *testing.T) {
+	l, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	d := NewDialer(WithBindInterface("pwfeeder-test0"), WithFwmark(0x10))
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	_ = c.Close()
+
+	// The missing interface is reported when checking the options.
+	assert.Error(t, d.CheckBind())
+	assert.NoError(t, NewDialer().CheckBind())
+}
@@ -0,0 +1,248 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+)
+
+// DefaultDialTimeout bounds establishing a connection, including any proxy
+// handshake, when no timeout is configured.
+const DefaultDialTimeout = 10 * time.Second
+
+type (
+	// DialOption configures a Dialer created by NewDialer.
+	DialOption func(*dialOptions)
+
+	// dialOptions contains the settings applied to outbound connections.
+	dialOptions struct {
+		// timeout bounds establishing each connection. DefaultDialTimeout is
+		// used when it is not positive.
+		timeout time.Duration
+		// proxy carries every connection, overriding the proxy environment
+		// variables, if set.
+		proxy *url.URL
+		// proxyFromEnvironment selects a proxy using the HTTPS_PROXY,
+		// ALL_PROXY and NO_PROXY environment variables.
+		proxyFromEnvironment bool
+		// family selects which address families are connected to.
+		family IPFamily
+		// bindAddr is the local address connections are made from, if set.
+		bindAddr net.IP
+		// bindInterface is the interface connections are bound to, if set.
+		bindInterface string
+		// fwmark marks connections for policy routing, if not zero.
+		fwmark uint32
+		// resolver looks up the hosts dialled directly. The system resolver
+		// is used when it is nil.
+		resolver Resolver
+		// liveness is applied to each TCP connection.
+		liveness Liveness
+	}
+)
+
+// WithDialTimeout returns a DialOption that bounds establishing each
+// connection, including any proxy handshake.
+func WithDialTimeout(timeout time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithProxy returns a DialOption that connects through the proxy at u, which
+// may be an http://, https://, socks5:// or socks5h:// URL with optional
+// credentials. Hosts listed in NO_PROXY are still dialled directly. A nil u
+// has no effect.
+func WithProxy(u *url.URL) DialOption {
+	return func(o *dialOptions) {
+		o.proxy = u
+	}
+}
+
+// WithProxyFromEnvironment returns a DialOption that connects through the
+// proxy named by HTTPS_PROXY or, if that is not set, ALL_PROXY, except for
+// hosts listed in NO_PROXY. It is overridden by WithProxy.
+func WithProxyFromEnvironment() DialOption {
+	return func(o *dialOptions) {
+		o.proxyFromEnvironment = true
+	}
+}
+
+// WithIPFamily returns a DialOption that applies family when choosing which
+// of a host's addresses to connect to. It also applies to reaching a proxy.
+func WithIPFamily(family IPFamily) DialOption {
+	return func(o *dialOptions) {
+		o.family = family
+	}
+}
+
+// WithResolver returns a DialOption that looks up hosts dialled directly with
+// r instead of the system resolver, including a proxy's host name. Hosts
+// reached through a proxy are resolved by the proxy.
+func WithResolver(r Resolver) DialOption {
+	return func(o *dialOptions) {
+		o.resolver = r
+	}
+}
+
+// Dialer makes outbound TCP connections, optionally through a proxy. The zero
+// value dials directly with DefaultDialTimeout, racing connections to each of
+// a host's addresses as IPFamilyAuto describes.
+type Dialer struct {
+	// opts are the settings applied to each connection.
+	opts dialOptions
+}
+
+// NewDialer returns a Dialer configured by opts.
+func NewDialer(opts ...DialOption) *Dialer {
+	d := &Dialer{}
+	for _, opt := range opts {
+		opt(&d.opts)
+	}
+	return d
+}
+
+// DialTrace is notified as Dialer.DialContext progresses. Its functions may
+// be called from other goroutines and after DialContext has returned.
+type DialTrace struct {
+	// Resolved is called once the server's addresses have been resolved
+	// locally, before connecting. It is not called when a proxy resolves the
+	// address.
+	Resolved func()
+}
+
+// dialTraceKey is the context key of a *DialTrace.
+type dialTraceKey struct{}
+
+// WithDialTrace returns a copy of ctx that reports the progress of dials made
+// with it to trace.
+func WithDialTrace(ctx context.Context, trace *DialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, trace)
+}
+
+// DialContext connects to addr on the named network, through a proxy if one
+// applies to addr.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+
+	proxyURL, err := d.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		return d.dialProxy(ctx, proxyURL, network, addr)
+	}
+	return d.dialDirect(ctx, network, addr)
+}
+
+// timeout returns the configured dial timeout or DefaultDialTimeout.
+func (d *Dialer) timeout() time.Duration {
+	if d == nil || d.opts.timeout <= 0 {
+		return DefaultDialTimeout
+	}
+	return d.opts.timeout
+}
+
+// dialDirect connects to addr without a proxy. TCP hosts are resolved here so
+// the address family policy can choose which addresses to connect to.
+func (d *Dialer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	nd := net.Dialer{}
+	trace, _ := ctx.Value(dialTraceKey{}).(*DialTrace)
+	resolved := func() {
+		if trace != nil && trace.Resolved != nil {
+			trace.Resolved()
+		}
+	}
+
+	family := d.family()
+	switch network {
+	case "tcp":
+	case "tcp4":
+		family = IPFamily4
+	case "tcp6":
+		family = IPFamily6
+	default:
+		resolved()
+		return nd.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	ips, err := d.resolver().LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	resolved()
+
+	ips = family.order(ips)
+	if len(ips) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{
+			Err:  "no addresses allowed by address family " + family.String(),
+			Addr: host,
+		}}
+	}
+
+	// Loopback hosts, such as a local BEAST source, are never bound to the
+	// outbound link.
+	if d != nil && d.opts.bound() && !allLoopback(ips) {
+		ips = d.opts.bindFamily(ips)
+		if len(ips) == 0 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{
+				Err:  "no addresses in the same family as bind address " + d.opts.bindAddr.String(),
+				Addr: host,
+			}}
+		}
+		d.opts.bind(&nd)
+	}
+
+	conn, err := raceDial(ctx, &nd, network, ips, port)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		err = d.opts.liveness.apply(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: conn.RemoteAddr(), Err: err}
+		}
+	}
+	return conn, nil
+}
+
+// family returns the configured address family policy.
+func (d *Dialer) family() IPFamily {
+	if d == nil {
+		return IPFamilyAuto
+	}
+	return d.opts.family
+}
+
+// resolver returns the configured resolver or the system resolver.
+func (d *Dialer) resolver() Resolver {
+	if d == nil || d.opts.resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.opts.resolver
+}
@@ -0,0 +1,196 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// dohContentType is the media type of DNS messages sent over HTTPS, as
+	// defined by RFC 8484.
+	dohContentType = "application/dns-message"
+
+	// maxDNSMessageSize is the largest DNS message that can be framed over a
+	// stream.
+	maxDNSMessageSize = 65535
+)
+
+// errNoDoHQuery reports that a DNS-over-HTTPS connection was read from before
+// a whole query was written to it.
+var errNoDoHQuery = errors.New("no complete DNS query to send over HTTPS")
+
+// newDoHClient returns the HTTP client DNS-over-HTTPS queries are sent with,
+// connecting with dialer. The server's host name, if it is not an IP address,
+// is looked up with dialer's resolver.
+func newDoHClient(dialer *Dialer) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        1,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: DefaultDialTimeout,
+		},
+	}
+}
+
+// newDoHResolver returns a resolver that sends its queries to the
+// DNS-over-HTTPS server at serverURL with client.
+func newDoHResolver(serverURL string, client *http.Client) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, url: serverURL, client: client}, nil
+		},
+	}
+}
+
+// dohConn carries one DNS exchange over HTTPS for the pure Go resolver. It is
+// not a net.PacketConn, so the resolver frames the query and response with a
+// two byte length prefix, as it would over TCP.
+type dohConn struct {
+	// ctx bounds the exchange.
+	ctx context.Context
+	// url is the DNS-over-HTTPS server's URL.
+	url string
+	// client sends the query.
+	client *http.Client
+	// deadline bounds the exchange, if not zero.
+	deadline time.Time
+	// query holds the length-prefixed query written by the resolver.
+	query bytes.Buffer
+	// response holds the length-prefixed response once it has been received.
+	response *bytes.Reader
+}
+
+// Read reads the response, sending the query first if it has not been sent.
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response == nil {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+// Write buffers the query until the response is read.
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.query.Write(b)
+}
+
+// exchange posts the buffered query to the server and stores its response.
+func (c *dohConn) exchange() error {
+	msg := c.query.Bytes()
+	if len(msg) < 2 || len(msg)-2 < int(binary.BigEndian.Uint16(msg)) {
+		return errNoDoHQuery
+	}
+	msg = msg[2 : 2+int(binary.BigEndian.Uint16(msg))]
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS-over-HTTPS server returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxDNSMessageSize {
+		return fmt.Errorf("DNS-over-HTTPS response exceeds %d bytes", maxDNSMessageSize)
+	}
+
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(body)), uint16(len(body)))
+	c.response = bytes.NewReader(append(framed, body...))
+	return nil
+}
+
+// Close discards the exchange.
+func (c *dohConn) Close() error {
+	return nil
+}
+
+// LocalAddr returns the server's address, as no local socket is exposed.
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+// RemoteAddr returns the server's address.
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+// SetDeadline bounds the exchange.
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetReadDeadline bounds the exchange.
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// SetWriteDeadline has no effect, as writes are buffered.
+func (c *dohConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// dohAddr is the address of a DNS-over-HTTPS server.
+type dohAddr string
+
+// Network returns "https".
+func (a dohAddr) Network() string {
+	return "https"
+}
+
+// String returns the server's URL.
+func (a dohAddr) String() string {
+	return string(a)
+}
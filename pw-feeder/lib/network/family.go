@@ -0,0 +1,209 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// connectionAttemptDelay is how long a connection attempt is given before
+// the next address is tried alongside it, as recommended by RFC 8305.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// IPFamily selects which address families are used to reach a host, and in
+// what order.
+type IPFamily int
+
+const (
+	// IPFamilyAuto races connections to every address, alternating between
+	// families in the order the resolver prefers, as described by RFC 8305.
+	IPFamilyAuto IPFamily = iota
+	// IPFamily4 only connects over IPv4.
+	IPFamily4
+	// IPFamily6 only connects over IPv6.
+	IPFamily6
+	// IPFamilyPrefer4 tries every IPv4 address before any IPv6 address.
+	IPFamilyPrefer4
+	// IPFamilyPrefer6 tries every IPv6 address before any IPv4 address.
+	IPFamilyPrefer6
+)
+
+// ipFamilyNames maps each IPFamily to its configuration name.
+var ipFamilyNames = map[IPFamily]string{
+	IPFamilyAuto:    "auto",
+	IPFamily4:       "4",
+	IPFamily6:       "6",
+	IPFamilyPrefer4: "prefer4",
+	IPFamilyPrefer6: "prefer6",
+}
+
+// String returns the configuration name of the family policy.
+func (f IPFamily) String() string {
+	if name, ok := ipFamilyNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("IPFamily(%d)", int(f))
+}
+
+// ParseIPFamily parses an address family policy name: auto, 4, 6, prefer4 or
+// prefer6.
+func ParseIPFamily(s string) (IPFamily, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for f, name := range ipFamilyNames {
+		if s == name {
+			return f, nil
+		}
+	}
+	return IPFamilyAuto, fmt.Errorf("unknown address family %q, expected one of auto, 4, 6, prefer4 or prefer6", s)
+}
+
+// AddrFamily returns "ipv4" or "ipv6" for the IP address in addr, or its
+// network, such as "unix", for other addresses.
+func AddrFamily(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return "unknown"
+		}
+		return addr.Network()
+	}
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// order returns the addresses to try in order, leaving out families the
+// policy does not allow.
+func (f IPFamily) order(addrs []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	switch f {
+	case IPFamily4:
+		return v4
+	case IPFamily6:
+		return v6
+	case IPFamilyPrefer4:
+		return append(v4, v6...)
+	case IPFamilyPrefer6:
+		return append(v6, v4...)
+	}
+
+	// Alternate families, starting with the resolver's first choice.
+	first, second := v4, v6
+	if len(addrs) > 0 && addrs[0].IP.To4() == nil {
+		first, second = v6, v4
+	}
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// dialResult is the outcome of a single connection attempt.
+type dialResult struct {
+	// conn is the connection, if the attempt succeeded.
+	conn net.Conn
+	// err is why the attempt failed.
+	err error
+}
+
+// raceDial connects to port at each of addrs in turn, starting the next
+// attempt when the previous one fails or has not succeeded within
+// connectionAttemptDelay. The first connection established is returned and
+// the other attempts are abandoned.
+func raceDial(ctx context.Context, nd *net.Dialer, network string, addrs []net.IPAddr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := nd.DialContext(ctx, network, addr)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	var errs []error
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	for pending > 0 {
+		// Each attempt waits afresh before the next address is started.
+		var delay <-chan time.Time
+		if next < len(addrs) {
+			timer.Reset(connectionAttemptDelay)
+			delay = timer.C
+		} else {
+			timer.Stop()
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close any connections the abandoned attempts still make.
+				go func(pending int) {
+					for range pending {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestParseIPFamily verifies policy names round trip and bad names are
+// rejected.
+func TestParseIPFamily(t *testing.T) {
+	for _, f := range []IPFamily{IPFamilyAuto, IPFamily4, IPFamily6, IPFamilyPrefer4, IPFamilyPrefer6} {
+		got, err := ParseIPFamily(f.String())
+		require.NoError(t, err)
+		assert.Equal(t, f, got)
+	}
+
+	got, err := ParseIPFamily(" Prefer6 ")
+	require.NoError(t, err)
+	assert.Equal(t, IPFamilyPrefer6, got)
+
+	_, err = ParseIPFamily("46")
+	assert.Error(t, err)
+}
+
+// TestIPFamilyOrder verifies which addresses each policy tries, and in what
+// order.
+func TestIPFamilyOrder(t *testing.T) {
+	a4 := net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	b4 := net.IPAddr{IP: net.ParseIP("192.0.2.2")}
+	a6 := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	b6 := net.IPAddr{IP: net.ParseIP("2001:db8::2")}
+	addrs := []net.IPAddr{a6, b6, a4, b4}
+
+	assert.Equal(t, []net.IPAddr{a6, a4, b6, b4}, IPFamilyAuto.order(addrs))
+	assert.Equal(t, []net.IPAddr{a4, a6, b4, b6}, IPFamilyAuto.order([]net.IPAddr{a4, b4, a6, b6}))
+	assert.Equal(t, []net.IPAddr{a4, b4}, IPFamily4.order(addrs))
+	assert.Equal(t, []net.IPAddr{a6, b6}, IPFamily6.order(addrs))
+	assert.Equal(t, []net.IPAddr{a4, b4, a6, b6}, IPFamilyPrefer4.order(addrs))
+	assert.Equal(t, []net.IPAddr{a6, b6, a4, b4}, IPFamilyPrefer6.order(addrs))
+	assert.Empty(t, IPFamily6.order([]net.IPAddr{a4}))
+}
+
+// TestAddrFamily verifies the family reported for each kind of address.
+func TestAddrFamily(t *testing.T) {
+	assert.Equal(t, "ipv4", AddrFamily(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	assert.Equal(t, "ipv4", AddrFamily(&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}))
+	assert.Equal(t, "ipv6", AddrFamily(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+	assert.Equal(t, "unix", AddrFamily(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}))
+	assert.Equal(t, "unknown", AddrFamily(nil))
+}
+
+// TestRaceDial verifies that a slow address does not hold up the next one,
+// and that a failed address is followed straight away.
+func TestRaceDial(t *testing.T) {
+	l, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	working := net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	stalled := net.IPAddr{IP: net.ParseIP("127.0.0.2")}
+
+	// Attempts to the stalled address hang until they are abandoned.
+	abandoned := make(chan struct{})
+	nd := &net.Dialer{
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if address != net.JoinHostPort(stalled.IP.String(), port) {
+				return nil
+			}
+			<-ctx.Done()
+			close(abandoned)
+			return ctx.Err()
+		},
+	}
+
+	start := time.Now()
+	c, err := raceDial(context.Background(), nd, "tcp", []net.IPAddr{stalled, working}, port)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", c.RemoteAddr().(*net.TCPAddr).IP.String())
+	assert.GreaterOrEqual(t, time.Since(start), connectionAttemptDelay)
+	_ = c.Close()
+	<-abandoned
+
+	// A refused attempt is followed without waiting for the attempt delay.
+	refused := &net.Dialer{
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if address == net.JoinHostPort(stalled.IP.String(), port) {
+				return syscall.ECONNREFUSED
+			}
+			return nil
+		},
+	}
+	start = time.Now()
+	c, err = raceDial(context.Background(), refused, "tcp", []net.IPAddr{stalled, working}, port)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), connectionAttemptDelay)
+	_ = c.Close()
+
+	// Every failure is reported when no address works.
+	_, err = raceDial(context.Background(), refused, "tcp", []net.IPAddr{stalled, stalled}, port)
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED))
+}
+
+// TestDialerIPFamily verifies the policy limits the addresses dialled.
+func TestDialerIPFamily(t *testing.T) {
+	l, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	c, err := NewDialer(WithIPFamily(IPFamily4)).DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "ipv4", AddrFamily(c.RemoteAddr()))
+	_ = c.Close()
+
+	_, err = NewDialer(WithIPFamily(IPFamily6)).DialContext(context.Background(), "tcp", l.Addr().String())
+	var addrErr *net.AddrError
+	require.ErrorAs(t, err, &addrErr)
+	assert.Contains(t, addrErr.Err, "address family 6")
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrUserTimeoutUnsupported reports that TCP_USER_TIMEOUT is not supported on
+// this platform.
+var ErrUserTimeoutUnsupported = errors.New("TCP_USER_TIMEOUT is only supported on Linux")
+
+// Liveness configures how quickly a dead peer is detected on a TCP
+// connection, such as after a NAT mapping expires or a mobile link changes.
+// Keepalive probes detect a dead peer on an idle connection, while the user
+// timeout detects one while sent data is waiting to be acknowledged. A failed
+// connection reports syscall.ETIMEDOUT. The zero value leaves the system
+// defaults in place.
+type Liveness struct {
+	// KeepAlive configures TCP keepalive probes. It is not applied when
+	// KeepAlive.Enable is false.
+	KeepAlive net.KeepAliveConfig
+	// UserTimeout bounds how long sent data may remain unacknowledged before
+	// the connection is closed. It is not applied when zero.
+	UserTimeout time.Duration
+}
+
+// Check reports whether l can be applied on this platform.
+func (l Liveness) Check() error {
+	if l.UserTimeout > 0 && !userTimeoutSupported {
+		return ErrUserTimeoutUnsupported
+	}
+	return nil
+}
+
+// apply sets l on c. Connections other than TCP are left unchanged.
+func (l Liveness) apply(c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if l.KeepAlive.Enable {
+		err := tc.SetKeepAliveConfig(l.KeepAlive)
+		if err != nil {
+			return err
+		}
+	}
+	if l.UserTimeout > 0 {
+		rc, err := tc.SyscallConn()
+		if err != nil {
+			return err
+		}
+		return setUserTimeout(rc, l.UserTimeout)
+	}
+	return nil
+}
+
+// WithLiveness returns a DialOption that applies l to each TCP connection,
+// including the connection to a proxy.
+func WithLiveness(l Liveness) DialOption {
+	return func(o *dialOptions) {
+		o.liveness = l
+	}
+}
+
+// WithListenLiveness returns a ListenOption that applies l to each TCP
+// connection accepted by the listener. It has no effect on unix domain
+// sockets.
+func WithListenLiveness(l Liveness) ListenOption {
+	return func(o *listenOptions) {
+		o.liveness = l
+	}
+}
+
+// livenessListener applies liveness settings to accepted connections. The
+// TCP listener's other methods, such as SetDeadline, remain available.
+type livenessListener struct {
+	*net.TCPListener
+	// liveness is applied to each accepted connection.
+	liveness Liveness
+}
+
+// Accept waits for the next connection and applies the liveness settings to
+// it. A connection they cannot be applied to is closed and its error
+// returned.
+func (l livenessListener) Accept() (net.Conn, error) {
+	c, err := l.TCPListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	err = l.liveness.apply(c)
+	if err != nil {
+		_ = c.Close()
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: err}
+	}
+	return c, nil
+}
+
+// configured reports whether l changes any setting.
+func (l Liveness) configured() bool {
+	return l.KeepAlive.Enable || l.UserTimeout > 0
+}
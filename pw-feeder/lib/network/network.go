@@ -19,30 +19,199 @@
 package network
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"strings"
+	"syscall"
 	"time"
 
+	"pw-feeder/lib/serial"
+
 	"github.com/rs/zerolog/log"
 )
 
-// ConnectToHost establishes a TCP connection to addr using the supplied name
-// for log context.
-func ConnectToHost(name, addr string) (c net.Conn, err error) {
+const (
+	// unixScheme prefixes addresses that refer to a unix domain socket path.
+	unixScheme = "unix://"
+
+	// staleSocketDialTimeout bounds the check for a live process behind an
+	// existing socket file.
+	staleSocketDialTimeout = time.Second
+)
+
+type (
+	// ListenOption configures a listener created by Listen.
+	ListenOption func(*listenOptions)
+
+	// listenOptions contains the settings applied to unix domain sockets.
+	listenOptions struct {
+		// socketMode is applied to the socket file when non-zero.
+		socketMode os.FileMode
+		// socketUID is the socket file owner, or -1 to leave it unchanged.
+		socketUID int
+		// socketGID is the socket file group, or -1 to leave it unchanged.
+		socketGID int
+		// liveness is applied to each accepted TCP connection.
+		liveness Liveness
+	}
+)
+
+// WithSocketMode returns a ListenOption that sets the permissions of a unix
+// domain socket file. It has no effect on TCP listeners.
+func WithSocketMode(mode os.FileMode) ListenOption {
+	return func(o *listenOptions) {
+		o.socketMode = mode
+	}
+}
+
+// WithSocketOwner returns a ListenOption that sets the owner and group of a
+// unix domain socket file. An ID of -1 leaves that value unchanged. It has no
+// effect on TCP listeners.
+func WithSocketOwner(uid, gid int) ListenOption {
+	return func(o *listenOptions) {
+		o.socketUID = uid
+		o.socketGID = gid
+	}
+}
+
+// IsUnixAddress reports whether addr refers to a unix domain socket.
+func IsUnixAddress(addr string) bool {
+	return strings.HasPrefix(addr, unixScheme)
+}
+
+// SplitAddress returns the network and address used to dial or listen on addr.
+// Addresses of the form unix:///path select a unix domain socket, and all other
+// addresses are treated as TCP host:port pairs.
+func SplitAddress(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// Listen creates a listener for addr. Unix domain socket files left behind by
+// a previous process are removed before listening, and the configured
+// permissions and ownership are applied once the socket exists.
+func Listen(addr string, opts ...ListenOption) (net.Listener, error) {
+	o := listenOptions{
+		socketUID: -1,
+		socketGID: -1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	network, address := SplitAddress(addr)
+	if network != "unix" {
+		listener, err := net.Listen(network, address)
+		if err != nil || !o.liveness.configured() {
+			return listener, err
+		}
+		return livenessListener{TCPListener: listener.(*net.TCPListener), liveness: o.liveness}, nil
+	}
+
+	err := removeStaleSocket(address)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.socketMode != 0 {
+		err = os.Chmod(address, o.socketMode)
+		if err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("could not set permissions on socket %s: %w", address, err)
+		}
+	}
+
+	if o.socketUID != -1 || o.socketGID != -1 {
+		err = os.Chown(address, o.socketUID, o.socketGID)
+		if err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("could not set ownership of socket %s: %w", address, err)
+		}
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket removes a socket file at path when connecting to it is
+// refused, as no process is accepting connections on it. Files that are not
+// sockets, and sockets that cannot be checked, are never removed.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %s: file exists and is not a socket", path)
+	}
+
+	// A successful connection means another process still owns the socket.
+	c, err := net.DialTimeout("unix", path, staleSocketDialTimeout)
+	if err == nil {
+		_ = c.Close()
+		return fmt.Errorf("socket %s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("could not check whether socket %s is in use: %w", path, err)
+	}
+
+	log.Debug().Str("path", path).Msg("removing stale socket")
+	return os.Remove(path)
+}
+
+// ConnectToHost establishes a connection to addr using the supplied name for
+// log context. Addresses of the form unix:///path connect to a unix domain
+// socket, addresses of the form serial:///path open a serial port as
+// serial.ParseAddress describes, and all other addresses use TCP. opts
+// configure the Dialer used for TCP connections.
+func ConnectToHost(name, addr string, opts ...DialOption) (c net.Conn, err error) {
+	return ConnectToHostContext(context.Background(), name, addr, opts...)
+}
+
+// ConnectToHostContext is like ConnectToHost, but gives up when ctx is
+// cancelled before a TCP or unix domain socket connection is established.
+func ConnectToHostContext(ctx context.Context, name, addr string, opts ...DialOption) (c net.Conn, err error) {
 
 	// Add the connection details to the logger context.
 	logger := log.With().Str("name", name).Str("addr", addr).Logger()
 
-	// Prepare a dialer with a connection timeout.
-	d := net.Dialer{
-		Timeout: 10 * time.Second,
+	if serial.IsAddress(addr) {
+		cfg, err := serial.ParseAddress(addr)
+		if err == nil {
+			c, err = serial.Open(cfg)
+		}
+		if err != nil {
+			logger.Err(err).Msg("error opening serial port")
+			return nil, err
+		}
+		logger.Debug().Int("baud", cfg.Baud).Stringer("flow", cfg.Flow).Msg("serial port opened")
+		return c, nil
 	}
 
+	// Prepare a dialer with a connection timeout.
+	d := NewDialer(append([]DialOption{WithDialTimeout(10 * time.Second)}, opts...)...)
+
 	// Dial the remote endpoint.
-	c, err = d.Dial("tcp", addr)
+	network, address := SplitAddress(addr)
+	c, err = d.DialContext(ctx, network, address)
 	if err != nil {
 		logger.Err(err).Msg("error establishing connection")
+		return c, err
 	}
-	logger.Debug().Msg("endpoint connected")
+	logger.Debug().Str("remote", c.RemoteAddr().String()).Msg("endpoint connected")
 
 	return c, err
 }
@@ -19,7 +19,11 @@
 package network
 
 import (
+	"context"
+	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -27,6 +31,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -70,4 +75,133 @@ func TestConnectToHost(t *testing.T) {
 		require.Error(t, err)
 	})
 
+	t.Run("working unix socket", func(t *testing.T) {
+		// Set up a test unix socket listener.
+		path := filepath.Join(t.TempDir(), "beast.sock")
+		tl, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		defer func() {
+			_ = tl.Close()
+		}()
+
+		// Attempt to connect.
+		c, err := ConnectToHost("test", "unix://"+path)
+		require.NoError(t, err)
+		defer func() {
+			_ = c.Close()
+		}()
+		assert.Equal(t, "unix", c.RemoteAddr().Network())
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := ConnectToHostContext(ctx, "test", "192.0.2.1:30005")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("serial port error", func(t *testing.T) {
+		// Files that are not serial ports, and malformed addresses, are
+		// rejected rather than dialled.
+		_, err := ConnectToHost("test", "serial://"+os.DevNull)
+		require.Error(t, err)
+		_, err = ConnectToHost("test", "serial:///dev/ttyUSB0?baud=fast")
+		require.ErrorContains(t, err, "baud")
+	})
+
+}
+
+// TestSplitAddress verifies network selection for TCP and unix addresses.
+func TestSplitAddress(t *testing.T) {
+	network, address := SplitAddress("127.0.0.1:30005")
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:30005", address)
+
+	network, address = SplitAddress("unix:///run/readsb/beast.sock")
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/readsb/beast.sock", address)
+}
+
+// TestListen verifies TCP and unix listeners, socket permissions, and stale
+// socket cleanup.
+func TestListen(t *testing.T) {
+
+	t.Run("tcp", func(t *testing.T) {
+		l, err := Listen("127.0.0.1:0")
+		require.NoError(t, err)
+		assert.Equal(t, "tcp", l.Addr().Network())
+		require.NoError(t, l.Close())
+	})
+
+	t.Run("unix with mode", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "mlat.sock")
+		l, err := Listen("unix://"+path, WithSocketMode(0600), WithSocketOwner(-1, -1))
+		require.NoError(t, err)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		// Closing the listener removes the socket file.
+		require.NoError(t, l.Close())
+		_, err = os.Stat(path)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("stale socket removed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "mlat.sock")
+
+		// Leave a socket file behind without a listener.
+		stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		require.NoError(t, err)
+		stale.SetUnlinkOnClose(false)
+		require.NoError(t, stale.Close())
+
+		l, err := Listen("unix://" + path)
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+	})
+
+	t.Run("socket not accessible", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root can connect to any socket")
+		}
+		path := filepath.Join(t.TempDir(), "mlat.sock")
+		stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		require.NoError(t, err)
+		stale.SetUnlinkOnClose(false)
+		require.NoError(t, stale.Close())
+		require.NoError(t, os.Chmod(path, 0))
+
+		_, err = Listen("unix://" + path)
+		require.ErrorIs(t, err, syscall.EACCES)
+
+		// A socket that could not be checked must be left in place.
+		_, err = os.Lstat(path)
+		require.NoError(t, err)
+	})
+
+	t.Run("socket in use", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "mlat.sock")
+		inUse, err := Listen("unix://" + path)
+		require.NoError(t, err)
+		defer func() {
+			_ = inUse.Close()
+		}()
+
+		_, err = Listen("unix://" + path)
+		require.ErrorContains(t, err, "in use")
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "mlat.sock")
+		require.NoError(t, os.WriteFile(path, nil, 0600))
+
+		_, err := Listen("unix://" + path)
+		require.ErrorContains(t, err, "not a socket")
+
+		// The existing file must be left in place.
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+	})
 }
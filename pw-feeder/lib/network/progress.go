@@ -0,0 +1,61 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrTCPInfoUnsupported reports that TCP_INFO cannot be read on this platform.
+var ErrTCPInfoUnsupported = errors.New("TCP_INFO is only supported on Linux")
+
+// TCPProgress describes how far a TCP connection's peer has got with the data
+// exchanged with it.
+type TCPProgress struct {
+	// Acked grows with each sent byte the peer acknowledges. It may also
+	// count the connection's SYN.
+	Acked uint64
+	// Received is the number of bytes received from the peer.
+	Received uint64
+	// Outstanding is set while sent data waits to be acknowledged, or data
+	// waits to be sent.
+	Outstanding bool
+}
+
+// ReadTCPProgress returns the TCPProgress of conn, which must be a TCP
+// connection or wrap one, as a *tls.Conn does. Through a proxy, it describes
+// the connection to the proxy.
+func ReadTCPProgress(conn net.Conn) (TCPProgress, error) {
+	for {
+		switch c := conn.(type) {
+		case syscall.Conn:
+			rc, err := c.SyscallConn()
+			if err != nil {
+				return TCPProgress{}, err
+			}
+			return tcpProgress(rc)
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return TCPProgress{}, errors.New("not a TCP connection")
+		}
+	}
+}
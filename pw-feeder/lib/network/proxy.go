@@ -0,0 +1,257 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ParseProxyURL parses a proxy URL of the form scheme://[user:password@]host[:port],
+// where scheme is http, https, socks5 or socks5h.
+func ParseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if err := checkProxyURL(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// checkProxyURL reports whether u names a supported proxy.
+func checkProxyURL(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q in %s, expected http, https, socks5 or socks5h", u.Scheme, u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("proxy URL %s has no host", u.Redacted())
+	}
+	return nil
+}
+
+// ProxyCredentials returns the user name and password in u, if any.
+func ProxyCredentials(u *url.URL) (username, password string) {
+	if u == nil || u.User == nil {
+		return "", ""
+	}
+	password, _ = u.User.Password()
+	return u.User.Username(), password
+}
+
+// EnvironmentProxies returns the proxies named by the proxy environment
+// variables, so their credentials can be kept out of logs. Invalid URLs are
+// skipped.
+func EnvironmentProxies() []*url.URL {
+	var proxies []*url.URL
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy"} {
+		if u, err := url.Parse(os.Getenv(name)); err == nil && u.Host != "" {
+			proxies = append(proxies, u)
+		}
+	}
+	return proxies
+}
+
+// getenvAny returns the value of the first of names that is set.
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// proxyFor returns the proxy to use for a connection to addr, or nil to dial
+// it directly. Loopback addresses and hosts listed in NO_PROXY are always
+// dialled directly.
+func (d *Dialer) proxyFor(addr string) (*url.URL, error) {
+	if d == nil || (d.opts.proxy == nil && !d.opts.proxyFromEnvironment) {
+		return nil, nil
+	}
+
+	cfg := httpproxy.FromEnvironment()
+	cfg.HTTPProxy = ""
+	switch {
+	case d.opts.proxy != nil:
+		cfg.HTTPSProxy = d.opts.proxy.String()
+	case cfg.HTTPSProxy == "":
+		cfg.HTTPSProxy = getenvAny("ALL_PROXY", "all_proxy")
+	}
+	if cfg.HTTPSProxy == "" {
+		return nil, nil
+	}
+
+	// The tunnel is not HTTP, but the https scheme selects HTTPS_PROXY.
+	u, err := cfg.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	if err != nil || u == nil {
+		return nil, err
+	}
+	if err := checkProxyURL(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// dialProxy connects to addr through the proxy at proxyURL.
+func (d *Dialer) dialProxy(ctx context.Context, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	// Resolving the proxy's own address is not traced.
+	ctx = WithDialTrace(ctx, nil)
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		conn, err = d.dialSOCKS5(ctx, proxyURL, network, addr)
+	default:
+		conn, err = d.dialHTTPConnect(ctx, proxyURL, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s through proxy %s: %w", addr, proxyURL.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// directDialer dials without a proxy for the SOCKS5 client.
+type directDialer struct {
+	// d supplies the connection settings.
+	d *Dialer
+}
+
+// Dial connects to addr without a proxy.
+func (dd directDialer) Dial(network, addr string) (net.Conn, error) {
+	return dd.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr without a proxy.
+func (dd directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dd.d.dialDirect(ctx, network, addr)
+}
+
+// dialSOCKS5 connects to addr through the SOCKS5 proxy at proxyURL. The proxy
+// resolves host names.
+func (d *Dialer) dialSOCKS5(ctx context.Context, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if username, password := ProxyCredentials(proxyURL); username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	socks, err := proxy.SOCKS5("tcp", proxyHostPort(proxyURL), auth, directDialer{d: d})
+	if err != nil {
+		return nil, err
+	}
+	return socks.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// dialHTTPConnect opens a tunnel to addr with an HTTP CONNECT request to the
+// proxy at proxyURL.
+func (d *Dialer) dialHTTPConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := d.dialDirect(ctx, "tcp", proxyHostPort(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+
+	// Abort the exchange if the context ends first.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if username, password := ProxyCredentials(proxyURL); username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused the connection: %s", resp.Status)
+	}
+
+	if ctx.Err() != nil || !stop() {
+		_ = conn.Close()
+		return nil, context.Cause(ctx)
+	}
+
+	// Keep any data the proxy sent after its response.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// proxyHostPort returns the address of the proxy at u, adding the scheme's
+// default port when none is given.
+func proxyHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// bufferedConn is a net.Conn whose reads are served from r first.
+type bufferedConn struct {
+	net.Conn
+	// r buffers data read from the connection.
+	r *bufio.Reader
+}
+
+// Read reads from the buffer, then the connection.
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// dnsPort is the port plain DNS servers listen on by default.
+	dnsPort = "53"
+
+	// staleLookupTimeout bounds a lookup when last known good addresses could
+	// be used instead, leaving time to connect to them.
+	staleLookupTimeout = 3 * time.Second
+)
+
+// Resolver looks up a host's IP addresses. *net.Resolver implements it.
+type Resolver interface {
+	// LookupIPAddr returns the IP addresses of host.
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ParseResolver returns the resolver described by s. An empty string selects
+// the system resolver. An IP address, optionally with a port or a udp://
+// prefix, selects that DNS server, and an https:// URL selects a
+// DNS-over-HTTPS server. opts configure the connections made to a
+// DNS-over-HTTPS server. Plain DNS queries are not affected by them.
+func ParseResolver(s string, opts ...DialOption) (Resolver, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return net.DefaultResolver, nil
+	}
+
+	if strings.HasPrefix(s, "https://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("DNS-over-HTTPS URL %q has no host", s)
+		}
+		return newDoHResolver(u.String(), newDoHClient(NewDialer(opts...))), nil
+	}
+
+	server := strings.TrimPrefix(s, "udp://")
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, dnsPort
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("DNS server %q must be an IP address, or an https:// DNS-over-HTTPS URL", s)
+	}
+	server = net.JoinHostPort(host, port)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var nd net.Dialer
+			return nd.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+// cachedAddrs are the addresses a host last resolved to.
+type cachedAddrs struct {
+	// addrs are the resolved addresses.
+	addrs []net.IPAddr
+	// resolved is when the addresses were resolved.
+	resolved time.Time
+}
+
+// CachingResolver remembers the addresses each host last resolved to, and
+// returns them when a later lookup fails, so connections survive an outage of
+// the DNS resolver. It is safe for concurrent use.
+type CachingResolver struct {
+	// resolver performs the lookups.
+	resolver Resolver
+	// maxAge is how long after a successful lookup its addresses are used.
+	maxAge time.Duration
+	// mu protects cache.
+	mu sync.Mutex
+	// cache maps host names to their last known good addresses.
+	cache map[string]cachedAddrs
+}
+
+// NewCachingResolver returns a CachingResolver that looks hosts up with
+// resolver, or the system resolver when it is nil. The last known good
+// addresses are used for up to maxAge after they were resolved.
+func NewCachingResolver(resolver Resolver, maxAge time.Duration) *CachingResolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &CachingResolver{
+		resolver: resolver,
+		maxAge:   maxAge,
+		cache:    make(map[string]cachedAddrs),
+	}
+}
+
+// LookupIPAddr returns the IP addresses of host. When the lookup fails, the
+// addresses from the last successful lookup are returned instead, unless they
+// are older than the cache's maximum age.
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if net.ParseIP(host) != nil {
+		return r.resolver.LookupIPAddr(ctx, host)
+	}
+
+	cached, ok := r.get(host)
+	lookupCtx := ctx
+	if ok {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, staleLookupTimeout)
+		defer cancel()
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(lookupCtx, host)
+	if err == nil {
+		r.mu.Lock()
+		r.cache[host] = cachedAddrs{addrs: slices.Clone(addrs), resolved: time.Now()}
+		r.mu.Unlock()
+		return addrs, nil
+	}
+	if !ok || ctx.Err() != nil {
+		return nil, err
+	}
+
+	log.Warn().
+		Err(err).
+		Str("host", host).
+		Time("resolved", cached.resolved).
+		Msg("could not resolve host, using its last known addresses")
+	return slices.Clone(cached.addrs), nil
+}
+
+// get returns the last known good addresses of host, if they are not too
+// old.
+func (r *CachingResolver) get(host string) (cachedAddrs, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cached, ok := r.cache[host]
+	if ok && time.Since(cached.resolved) > r.maxAge {
+		delete(r.cache, host)
+		return cachedAddrs{}, false
+	}
+	return cached, ok
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers lookups with addrs until failing is set.
+type fakeResolver struct {
+	// addrs are returned by successful lookups.
+	addrs []net.IPAddr
+	// failing makes lookups fail.
+	failing bool
+	// lookups counts the lookups made.
+	lookups int
+}
+
+// LookupIPAddr returns addrs, or an error when failing is set.
+func (r *fakeResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	r.lookups++
+	if r.failing {
+		return nil, &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+	}
+	return r.addrs, nil
+}
+
+// TestParseResolver verifies which resolver specifications are accepted.
+func TestParseResolver(t *testing.T) {
+	r, err := ParseResolver("")
+	require.NoError(t, err)
+	assert.Equal(t, net.DefaultResolver, r)
+
+	for _, s := range []string{"192.0.2.53", "192.0.2.53:5353", "[2001:db8::53]:53", "udp://192.0.2.53", "https://dns.example/dns-query"} {
+		r, err := ParseResolver(s)
+		require.NoError(t, err, s)
+		assert.IsType(t, &net.Resolver{}, r, s)
+	}
+
+	for _, s := range []string{"dns.example", "dns.example:53", "https://"} {
+		_, err := ParseResolver(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// TestCachingResolver verifies the last known good addresses are returned
+// when a lookup fails, until they are too old.
+func TestCachingResolver(t *testing.T) {
+	addrs := []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}
+	fake := &fakeResolver{addrs: addrs}
+	r := NewCachingResolver(fake, time.Hour)
+
+	got, err := r.LookupIPAddr(t.Context(), "feed.example")
+	require.NoError(t, err)
+	assert.Equal(t, addrs, got)
+
+	fake.failing = true
+	got, err = r.LookupIPAddr(t.Context(), "feed.example")
+	require.NoError(t, err)
+	assert.Equal(t, addrs, got)
+	assert.Equal(t, 2, fake.lookups, "the resolver should still be asked first")
+
+	_, err = r.LookupIPAddr(t.Context(), "other.example")
+	assert.Error(t, err, "hosts never resolved have nothing to fall back to")
+
+	r.cache["feed.example"] = cachedAddrs{addrs: addrs, resolved: time.Now().Add(-2 * time.Hour)}
+	_, err = r.LookupIPAddr(t.Context(), "feed.example")
+	var dnsErr *net.DNSError
+	assert.ErrorAs(t, err, &dnsErr, "expired addresses should not be used")
+	assert.NotContains(t, r.cache, "feed.example")
+}
+
+// TestCachingResolverCanceled verifies cached addresses are not returned once
+// the caller has given up.
+func TestCachingResolverCanceled(t *testing.T) {
+	fake := &fakeResolver{addrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}}
+	r := NewCachingResolver(fake, time.Hour)
+	_, err := r.LookupIPAddr(t.Context(), "feed.example")
+	require.NoError(t, err)
+
+	fake.failing = true
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = r.LookupIPAddr(ctx, "feed.example")
+	assert.Error(t, err)
+}
+
+// newDoHServer starts a DNS-over-HTTPS server answering A queries with addr.
+func newDoHServer(t *testing.T, addr [4]byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(body); err != nil || len(query.Questions) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		q := query.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		if q.Type == dnsmessage.TypeA {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: addr},
+			}}
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(packed)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestDoHResolver verifies lookups are answered over HTTPS.
+func TestDoHResolver(t *testing.T) {
+	srv := newDoHServer(t, [4]byte{192, 0, 2, 7})
+	r := newDoHResolver(srv.URL+"/dns-query", srv.Client())
+
+	addrs, err := r.LookupIPAddr(t.Context(), "feed.example")
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "192.0.2.7", addrs[0].IP.String())
+}
+
+// TestDoHResolverError verifies a failing server fails the lookup.
+func TestDoHResolverError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	r := newDoHResolver(srv.URL, srv.Client())
+
+	_, err := r.LookupIPAddr(t.Context(), "feed.example")
+	var dnsErr *net.DNSError
+	assert.True(t, errors.As(err, &dnsErr), "got %v", err)
+}
+
+// TestDialerResolver verifies the dialer looks hosts up with the configured
+// resolver.
+func TestDialerResolver(t *testing.T) {
+	_, port, err := net.SplitHostPort(newEchoServer(t))
+	require.NoError(t, err)
+
+	fake := &fakeResolver{addrs: []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}}
+	d := NewDialer(WithResolver(fake))
+	conn, err := d.DialContext(t.Context(), "tcp", net.JoinHostPort("feed.invalid", port))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	assertEcho(t, conn)
+	assert.Equal(t, 1, fake.lookups)
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSocketOptions binds the socket to o's interface and sets its firewall
+// mark. Missing capabilities are named in the returned error.
+func setSocketOptions(c syscall.RawConn, o dialOptions) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if o.bindInterface != "" {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, o.bindInterface)
+			switch {
+			case errors.Is(err, syscall.EPERM):
+				err = fmt.Errorf("binding to interface %s needs the CAP_NET_RAW capability: %w", o.bindInterface, err)
+				return
+			case errors.Is(err, syscall.ENODEV):
+				err = fmt.Errorf("binding to interface %s: no such interface: %w", o.bindInterface, err)
+				return
+			case err != nil:
+				err = fmt.Errorf("binding to interface %s: %w", o.bindInterface, err)
+				return
+			}
+		}
+		if o.fwmark != 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(o.fwmark))
+			switch {
+			case errors.Is(err, syscall.EPERM):
+				err = fmt.Errorf("setting firewall mark %#x needs the CAP_NET_ADMIN capability: %w", o.fwmark, err)
+			case err != nil:
+				err = fmt.Errorf("setting firewall mark %#x: %w", o.fwmark, err)
+			}
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// tcpUserTimeout is the Linux TCP_USER_TIMEOUT socket option, which the
+// syscall package does not define.
+const tcpUserTimeout = 0x12
+
+// userTimeoutSupported reports whether setUserTimeout can be used.
+const userTimeoutSupported = true
+
+// setUserTimeout sets TCP_USER_TIMEOUT on the socket to timeout, rounded up
+// to whole milliseconds.
+func setUserTimeout(c syscall.RawConn, timeout time.Duration) error {
+	ms := int((timeout + time.Millisecond - 1) / time.Millisecond)
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, ms)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	if err != nil {
+		return fmt.Errorf("setting TCP_USER_TIMEOUT: %w", err)
+	}
+	return nil
+}
+
+// tcpProgress reads the TCPProgress of the socket from TCP_INFO.
+func tcpProgress(c syscall.RawConn) (TCPProgress, error) {
+	var (
+		info *unix.TCPInfo
+		err  error
+	)
+	controlErr := c.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if controlErr != nil {
+		return TCPProgress{}, controlErr
+	}
+	if err != nil {
+		return TCPProgress{}, err
+	}
+	return TCPProgress{
+		Acked:       info.Bytes_acked,
+		Received:    info.Bytes_received,
+		Outstanding: info.Unacked > 0 || info.Notsent_bytes > 0,
+	}, nil
+}
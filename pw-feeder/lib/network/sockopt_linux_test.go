@@ -0,0 +1,151 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCheckBindLinux verifies interface and firewall mark errors name the
+// problem, including a missing capability.
+func TestCheckBindLinux(t *testing.T) {
+	err := NewDialer(WithBindInterface("pwfeeder-test0")).CheckBind()
+	if os.Geteuid() == 0 {
+		assert.ErrorIs(t, err, syscall.ENODEV)
+		assert.ErrorContains(t, err, "no such interface")
+	} else {
+		assert.Error(t, err)
+	}
+
+	err = NewDialer(WithFwmark(0x10)).CheckBind()
+	if os.Geteuid() == 0 {
+		assert.NoError(t, err)
+	} else {
+		assert.ErrorContains(t, err, "CAP_NET_ADMIN")
+	}
+
+	assert.ErrorContains(t, NewDialer(WithBindAddress(net.ParseIP("192.0.2.1"))).CheckBind(), "assign requested address")
+}
+
+// testLiveness is a Liveness with values distinct from the system defaults.
+var testLiveness = Liveness{
+	KeepAlive:   net.KeepAliveConfig{Enable: true, Idle: 7 * time.Second, Interval: 3 * time.Second, Count: 4},
+	UserTimeout: 19 * time.Second,
+}
+
+// assertLiveness verifies testLiveness was applied to c.
+func assertLiveness(t *testing.T, c net.Conn) {
+	t.Helper()
+
+	rc, err := c.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var keepAlive, idle, interval, count, userTimeout int
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		get := func(level, opt int, v *int) {
+			if sockErr == nil {
+				*v, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+			}
+		}
+		get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, &keepAlive)
+		get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, &idle)
+		get(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, &interval)
+		get(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, &count)
+		get(syscall.IPPROTO_TCP, tcpUserTimeout, &userTimeout)
+	})
+	require.NoError(t, err)
+	require.NoError(t, sockErr)
+
+	assert.Equal(t, 1, keepAlive)
+	assert.Equal(t, 7, idle)
+	assert.Equal(t, 3, interval)
+	assert.Equal(t, 4, count)
+	assert.Equal(t, 19000, userTimeout)
+}
+
+// TestDialLiveness verifies keepalive and user timeout settings are applied
+// to dialled connections.
+func TestDialLiveness(t *testing.T) {
+	conn, err := NewDialer(WithLiveness(testLiveness)).DialContext(t.Context(), "tcp", newEchoServer(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	assertLiveness(t, conn)
+}
+
+// TestListenLiveness verifies keepalive and user timeout settings are applied
+// to accepted connections, and accept deadlines remain available.
+func TestListenLiveness(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", WithListenLiveness(testLiveness))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	require.Implements(t, (*interface{ SetDeadline(time.Time) error })(nil), l)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	assertLiveness(t, conn)
+}
+
+// wrappedConn wraps a connection the way a *tls.Conn does.
+type wrappedConn struct {
+	net.Conn
+}
+
+// NetConn returns the wrapped connection.
+func (c wrappedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// TestReadTCPProgress verifies the acknowledged and received byte counts are
+// read through a wrapping connection.
+func TestReadTCPProgress(t *testing.T) {
+	conn, err := net.Dial("tcp", newEchoServer(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	wrapped := wrappedConn{Conn: conn}
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		p, err := ReadTCPProgress(wrapped)
+		require.NoError(t, err)
+		return p.Acked >= 5 && !p.Outstanding
+	}, 5*time.Second, 10*time.Millisecond)
+	p, err := ReadTCPProgress(wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), p.Received)
+
+	_, err = ReadTCPProgress(&net.UDPConn{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package network
+
+import (
+	"syscall"
+	"time"
+)
+
+// setSocketOptions returns ErrSocketOptionUnsupported when an interface or
+// firewall mark is configured, as neither can be applied on this platform.
+func setSocketOptions(c syscall.RawConn, o dialOptions) error {
+	if o.bindInterface != "" || o.fwmark != 0 {
+		return ErrSocketOptionUnsupported
+	}
+	return nil
+}
+
+// userTimeoutSupported reports whether setUserTimeout can be used.
+const userTimeoutSupported = false
+
+// setUserTimeout returns ErrUserTimeoutUnsupported, as TCP_USER_TIMEOUT
+// cannot be set on this platform.
+func setUserTimeout(c syscall.RawConn, timeout time.Duration) error {
+	return ErrUserTimeoutUnsupported
+}
+
+// tcpProgress returns ErrTCPInfoUnsupported, as TCP_INFO cannot be read on
+// this platform.
+func tcpProgress(c syscall.RawConn) (TCPProgress, error) {
+	return TCPProgress{}, ErrTCPInfoUnsupported
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// scheme prefixes addresses that refer to a serial port.
+	scheme = "serial://"
+
+	// DefaultBaud is the speed of a Mode-S Beast's FTDI serial port, used
+	// when an address does not set one.
+	DefaultBaud = 3000000
+)
+
+// ErrUnsupported reports that serial ports cannot be opened on this platform.
+var ErrUnsupported = errors.New("serial ports are only supported on Linux")
+
+// FlowControl selects how the flow of data over a serial port is paused.
+type FlowControl int
+
+const (
+	// FlowRTSCTS uses the RTS and CTS lines, as a Mode-S Beast does.
+	FlowRTSCTS FlowControl = iota
+	// FlowNone does not pause the flow of data.
+	FlowNone
+	// FlowXONXOFF uses the XON and XOFF characters.
+	FlowXONXOFF
+)
+
+// String returns the name ParseFlowControl accepts for f.
+func (f FlowControl) String() string {
+	switch f {
+	case FlowRTSCTS:
+		return "rtscts"
+	case FlowNone:
+		return "none"
+	case FlowXONXOFF:
+		return "xonxoff"
+	default:
+		return "FlowControl(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// ParseFlowControl returns the flow control named s: rtscts, none or xonxoff.
+func ParseFlowControl(s string) (FlowControl, error) {
+	for _, f := range []FlowControl{FlowRTSCTS, FlowNone, FlowXONXOFF} {
+		if strings.EqualFold(strings.TrimSpace(s), f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown flow control %q, expected rtscts, none or xonxoff", s)
+}
+
+// Config describes a serial port and how it is configured.
+type Config struct {
+	// Path is the serial device, such as /dev/ttyUSB0.
+	Path string
+	// Baud is the speed of the port in bits per second.
+	Baud int
+	// Flow is the flow control used on the port.
+	Flow FlowControl
+}
+
+// IsAddress reports whether addr refers to a serial port.
+func IsAddress(addr string) bool {
+	return strings.HasPrefix(addr, scheme)
+}
+
+// ParseAddress returns the serial port configuration in addr, which has the
+// form serial:///dev/ttyUSB0?baud=3000000&flow=rtscts. The baud rate defaults
+// to DefaultBaud and flow control to RTS/CTS.
+func ParseAddress(addr string) (Config, error) {
+	if !IsAddress(addr) {
+		return Config{}, fmt.Errorf("%q is not a %s address", addr, scheme)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return Config{}, err
+	}
+	if u.Host != "" || u.Path == "" {
+		return Config{}, fmt.Errorf("serial address %q must name a device, such as %s/dev/ttyUSB0", addr, scheme)
+	}
+
+	cfg := Config{Path: u.Path, Baud: DefaultBaud, Flow: FlowRTSCTS}
+	query := u.Query()
+	for key := range query {
+		switch key {
+		case "baud", "flow":
+		default:
+			return Config{}, fmt.Errorf("unknown serial option %q, expected baud or flow", key)
+		}
+	}
+	if s := query.Get("baud"); s != "" {
+		cfg.Baud, err = strconv.Atoi(s)
+		if err != nil || cfg.Baud <= 0 {
+			return Config{}, fmt.Errorf("baud rate %q must be a positive number", s)
+		}
+	}
+	if s := query.Get("flow"); s != "" {
+		cfg.Flow, err = ParseFlowControl(s)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// Addr is the address of a serial port, its device path.
+type Addr string
+
+// Network returns "serial".
+func (a Addr) Network() string {
+	return "serial"
+}
+
+// String returns the device path.
+func (a Addr) String() string {
+	return string(a)
+}
+
+// Port is an open serial port. It implements net.Conn, so it can stand in for
+// a network connection to a data source. Closing it unblocks pending reads
+// and writes.
+type Port struct {
+	// f is the open device.
+	f *os.File
+}
+
+// Read reads data from the port.
+func (p *Port) Read(b []byte) (int, error) {
+	return p.f.Read(b)
+}
+
+// Write writes data to the port.
+func (p *Port) Write(b []byte) (int, error) {
+	return p.f.Write(b)
+}
+
+// Close closes the port.
+func (p *Port) Close() error {
+	return p.f.Close()
+}
+
+// LocalAddr returns the device path.
+func (p *Port) LocalAddr() net.Addr {
+	return Addr(p.f.Name())
+}
+
+// RemoteAddr returns the device path.
+func (p *Port) RemoteAddr() net.Addr {
+	return Addr(p.f.Name())
+}
+
+// SetDeadline sets the read and write deadlines.
+func (p *Port) SetDeadline(t time.Time) error {
+	return p.f.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline.
+func (p *Port) SetReadDeadline(t time.Time) error {
+	return p.f.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline.
+func (p *Port) SetWriteDeadline(t time.Time) error {
+	return p.f.SetWriteDeadline(t)
+}
@@ -0,0 +1,155 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Linux serial port definitions the syscall package lacks. The ioctl numbers
+// use the generic encoding shared by the architectures this file builds for.
+const (
+	// tcgets2 reads a termios2.
+	tcgets2 = 0x802c542a
+	// tcsets2 writes a termios2.
+	tcsets2 = 0x402c542b
+	// tcflsh discards queued data.
+	tcflsh = 0x540b
+	// tcioflush discards both received and unsent data.
+	tcioflush = 2
+	// cbaud masks the baud rate bits of the control flags.
+	cbaud = 0x100f
+	// bother selects the baud rate in the termios2 speed fields.
+	bother = 0x1000
+	// crtscts enables RTS/CTS flow control.
+	crtscts = 0x80000000
+)
+
+// termios2 is the Linux struct termios2, which carries any baud rate.
+type termios2 struct {
+	// Iflag holds the input modes.
+	Iflag uint32
+	// Oflag holds the output modes.
+	Oflag uint32
+	// Cflag holds the control modes.
+	Cflag uint32
+	// Lflag holds the local modes.
+	Lflag uint32
+	// Line is the line discipline.
+	Line uint8
+	// Cc holds the control characters.
+	Cc [19]uint8
+	// Ispeed is the input baud rate.
+	Ispeed uint32
+	// Ospeed is the output baud rate.
+	Ospeed uint32
+}
+
+// Open opens the serial port described by cfg for exclusive use, in raw mode
+// with 8 data bits, no parity and one stop bit.
+func Open(cfg Config) (*Port, error) {
+	// A non-blocking descriptor lets the runtime poller wait for data, so
+	// deadlines and Close interrupt blocked reads.
+	f, err := os.OpenFile(cfg.Path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := f.SyscallConn()
+	if err == nil {
+		controlErr := rc.Control(func(fd uintptr) {
+			err = configure(fd, cfg)
+		})
+		if controlErr != nil {
+			err = controlErr
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not configure serial port %s: %w", cfg.Path, err)
+	}
+	return &Port{f: f}, nil
+}
+
+// configure claims the port on fd and applies cfg to it, discarding any data
+// queued before it was opened.
+func configure(fd uintptr, cfg Config) error {
+	err := ioctlValue(fd, syscall.TIOCEXCL, 0)
+	if err != nil {
+		return fmt.Errorf("claiming exclusive use: %w", err)
+	}
+
+	var t termios2
+	err = ioctl(fd, tcgets2, unsafe.Pointer(&t))
+	if err != nil {
+		if errors.Is(err, syscall.ENOTTY) {
+			return errors.New("not a serial port")
+		}
+		return err
+	}
+
+	// Raw mode, as cfmakeraw sets it.
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF | syscall.IXANY
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | crtscts | cbaud
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | bother
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	t.Ispeed = uint32(cfg.Baud)
+	t.Ospeed = uint32(cfg.Baud)
+
+	switch cfg.Flow {
+	case FlowRTSCTS:
+		t.Cflag |= crtscts
+	case FlowXONXOFF:
+		t.Iflag |= syscall.IXON | syscall.IXOFF
+	}
+
+	err = ioctl(fd, tcsets2, unsafe.Pointer(&t))
+	if err != nil {
+		return fmt.Errorf("setting %d baud with %s flow control: %w", cfg.Baud, cfg.Flow, err)
+	}
+	return ioctlValue(fd, tcflsh, tcioflush)
+}
+
+// ioctl performs the ioctl req on fd with a pointer argument.
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ioctlValue performs the ioctl req on fd with an integer argument.
+func ioctlValue(fd uintptr, req uintptr, value uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, value)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
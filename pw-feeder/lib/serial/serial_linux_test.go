@@ -0,0 +1,142 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package serial
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openPTY opens a pseudo-terminal pair, returning the controlling side and
+// the path of the terminal, which stands in for a serial port.
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals are unavailable: %s", err)
+	}
+	t.Cleanup(func() { _ = ptmx.Close() })
+
+	var unlock int32
+	require.NoError(t, ioctl(ptmx.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)))
+	var n uint32
+	require.NoError(t, ioctl(ptmx.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)))
+	return ptmx, "/dev/pts/" + strconv.FormatUint(uint64(n), 10)
+}
+
+// getTermios returns the settings of p.
+func getTermios(t *testing.T, p *Port) termios2 {
+	t.Helper()
+
+	rc, err := p.f.SyscallConn()
+	require.NoError(t, err)
+	var tio termios2
+	var ioctlErr error
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		ioctlErr = ioctl(fd, tcgets2, unsafe.Pointer(&tio))
+	}))
+	require.NoError(t, ioctlErr)
+	return tio
+}
+
+// TestOpen verifies the port is configured as requested and carries data
+// in both directions without translation.
+func TestOpen(t *testing.T) {
+	ptmx, path := openPTY(t)
+
+	p, err := Open(Config{Path: path, Baud: DefaultBaud, Flow: FlowRTSCTS})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = p.Close() })
+	assert.Equal(t, "serial", p.RemoteAddr().Network())
+	assert.Equal(t, path, p.RemoteAddr().String())
+
+	tio := getTermios(t, p)
+	assert.Equal(t, uint32(DefaultBaud), tio.Ospeed)
+	assert.Equal(t, uint32(bother), tio.Cflag&cbaud)
+	assert.Equal(t, uint32(crtscts), tio.Cflag&crtscts)
+	assert.Equal(t, uint32(syscall.CS8), tio.Cflag&syscall.CSIZE)
+	assert.Zero(t, tio.Lflag&(syscall.ICANON|syscall.ECHO))
+
+	// Escape and line ending bytes must pass through untouched.
+	frame := []byte{0x1a, '3', 0, 1, 2, 3, 4, 5, 0xa0, '\r', '\n', 0x1a, 0x1a, 0x11, 0x13}
+	_, err = ptmx.Write(frame)
+	require.NoError(t, err)
+	got := make([]byte, len(frame))
+	require.NoError(t, p.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(p, got)
+	require.NoError(t, err)
+	assert.Equal(t, frame, got)
+
+	_, err = p.Write([]byte("\n"))
+	require.NoError(t, err)
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(ptmx, reply)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\n"), reply)
+
+	// Exclusive use does not apply to root.
+	if os.Geteuid() != 0 {
+		_, err = Open(Config{Path: path, Baud: DefaultBaud})
+		assert.ErrorIs(t, err, syscall.EBUSY, "the port is held exclusively")
+	}
+}
+
+// TestOpenClose verifies closing the port unblocks a pending read.
+func TestOpenClose(t *testing.T) {
+	_, path := openPTY(t)
+
+	p, err := Open(Config{Path: path, Baud: 115200, Flow: FlowNone})
+	require.NoError(t, err)
+	assert.Zero(t, getTermios(t, p).Cflag&crtscts)
+
+	done := make(chan error)
+	go func() {
+		_, err := p.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, p.Close())
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, os.ErrClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not unblocked by Close")
+	}
+}
+
+// TestOpenNotTerminal verifies files that are not serial ports are
+// rejected.
+func TestOpenNotTerminal(t *testing.T) {
+	_, err := Open(Config{Path: os.DevNull, Baud: DefaultBaud})
+	assert.Error(t, err)
+
+	_, err = Open(Config{Path: "/dev/ttyUSB-pwfeeder-missing", Baud: DefaultBaud})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
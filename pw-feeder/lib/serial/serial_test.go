@@ -0,0 +1,65 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package serial
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseAddress verifies serial addresses and their options are parsed,
+// and malformed ones rejected.
+func TestParseAddress(t *testing.T) {
+	cfg, err := ParseAddress("serial:///dev/ttyUSB0")
+	require.NoError(t, err)
+	assert.Equal(t, Config{Path: "/dev/ttyUSB0", Baud: DefaultBaud, Flow: FlowRTSCTS}, cfg)
+
+	cfg, err = ParseAddress("serial:///dev/serial/by-id/usb-FTDI-if00?baud=921600&flow=none")
+	require.NoError(t, err)
+	assert.Equal(t, Config{Path: "/dev/serial/by-id/usb-FTDI-if00", Baud: 921600, Flow: FlowNone}, cfg)
+
+	for _, addr := range []string{
+		"/dev/ttyUSB0",
+		"serial://",
+		"serial://dev/ttyUSB0",
+		"serial:///dev/ttyUSB0?baud=fast",
+		"serial:///dev/ttyUSB0?baud=0",
+		"serial:///dev/ttyUSB0?flow=dtrdsr",
+		"serial:///dev/ttyUSB0?parity=even",
+	} {
+		_, err := ParseAddress(addr)
+		assert.Error(t, err, addr)
+	}
+
+	assert.True(t, IsAddress("serial:///dev/ttyUSB0"))
+	assert.False(t, IsAddress("unix:///run/beast.sock"))
+}
+
+// TestParseFlowControl verifies flow control names round trip.
+func TestParseFlowControl(t *testing.T) {
+	for _, f := range []FlowControl{FlowRTSCTS, FlowNone, FlowXONXOFF} {
+		got, err := ParseFlowControl(f.String())
+		require.NoError(t, err)
+		assert.Equal(t, f, got)
+	}
+	_, err := ParseFlowControl("dtrdsr")
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AuthALPN is the ALPN protocol a feed-in server selects to accept the API key
+// inside the encrypted channel. After the handshake, the client sends the key
+// followed by a newline before any other data.
+const AuthALPN = "pw-feeder-auth/1"
+
+// ErrInBandAuthUnsupported is returned in AuthInBand mode when the server does
+// not select AuthALPN.
+var ErrInBandAuthUnsupported = errors.New("server does not support in-band authentication")
+
+// AuthMode selects how Connect presents the API key to the server.
+type AuthMode int
+
+const (
+	// AuthSNI sends the API key as the TLS server name. Unless the ClientHello
+	// is encrypted with ECH, the key is visible to on-path observers.
+	AuthSNI AuthMode = iota
+	// AuthAuto offers AuthALPN and sends the API key in-band when the server
+	// selects it. Otherwise it reconnects and falls back to AuthSNI.
+	AuthAuto
+	// AuthInBand only sends the API key in-band, and fails with
+	// ErrInBandAuthUnsupported when the server does not select AuthALPN.
+	AuthInBand
+)
+
+// authModeNames maps each AuthMode to its configuration name.
+var authModeNames = map[AuthMode]string{
+	AuthSNI:    "sni",
+	AuthAuto:   "auto",
+	AuthInBand: "inband",
+}
+
+// String returns the configuration name of m.
+func (m AuthMode) String() string {
+	if name, ok := authModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("AuthMode(%d)", int(m))
+}
+
+// ParseAuthMode returns the AuthMode named s, ignoring case.
+func ParseAuthMode(s string) (AuthMode, error) {
+	for mode, name := range authModeNames {
+		if strings.EqualFold(s, name) {
+			return mode, nil
+		}
+	}
+	return AuthSNI, fmt.Errorf("unknown auth mode %q, expected sni, auto or inband", s)
+}
+
+// sendAPIKey sends apiKey over c once the server has selected AuthALPN.
+func sendAPIKey(c *tls.Conn, apiKey string) error {
+	_, err := c.Write([]byte(apiKey + "\n"))
+	if err != nil {
+		return fmt.Errorf("could not send API key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseAuthMode verifies mode names round trip and bad names are rejected.
+func TestParseAuthMode(t *testing.T) {
+	for _, mode := range []AuthMode{AuthSNI, AuthAuto, AuthInBand} {
+		got, err := ParseAuthMode(mode.String())
+		require.NoError(t, err)
+		assert.Equal(t, mode, got)
+	}
+
+	got, err := ParseAuthMode("InBand")
+	require.NoError(t, err)
+	assert.Equal(t, AuthInBand, got)
+
+	_, err = ParseAuthMode("header")
+	assert.Error(t, err)
+}
+
+// TestConnectInBandAuth verifies the API key is sent in-band to servers that
+// select AuthALPN, and that older servers still receive it as the server name.
+func TestConnectInBandAuth(t *testing.T) {
+	apiKey := testSNI.String()
+
+	t.Run("supported", func(t *testing.T) {
+		listener, conns, _ := newTestTLSServer(t, func(c *tls.Config) {
+			c.NextProtos = []string{AuthALPN}
+		})
+
+		for _, mode := range []AuthMode{AuthAuto, AuthInBand} {
+			c, err := Connect("TEST", listener.Addr().String(), apiKey, true, WithAuthMode(mode))
+			require.NoError(t, err)
+			_ = c.Close()
+
+			sc := <-conns
+			assert.Equal(t, AuthALPN, sc.state.NegotiatedProtocol)
+			assert.NotEqual(t, apiKey, sc.state.ServerName)
+			assert.Equal(t, apiKey+"\n", sc.firstLine)
+		}
+	})
+
+	t.Run("legacy server", func(t *testing.T) {
+		listener, conns, _ := newTestTLSServer(t, nil)
+
+		c, err := Connect("TEST", listener.Addr().String(), apiKey, true, WithAuthMode(AuthAuto))
+		require.NoError(t, err)
+		_ = c.Close()
+
+		// The first connection offered in-band authentication and was closed.
+		sc := <-conns
+		assert.Empty(t, sc.state.ServerName)
+		sc = <-conns
+		assert.Equal(t, apiKey, sc.state.ServerName)
+
+		_, err = Connect("TEST", listener.Addr().String(), apiKey, true, WithAuthMode(AuthInBand))
+		assert.ErrorIs(t, err, ErrInBandAuthUnsupported)
+		sc = <-conns
+		assert.Empty(t, sc.state.ServerName)
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fileVersion identifies the contents of a file by its size and modification
+// time.
+type fileVersion struct {
+	// size is the file size in bytes.
+	size int64
+	// modTime is when the file was last modified.
+	modTime time.Time
+}
+
+// statFile returns the current version of the file at path.
+func statFile(path string) (fileVersion, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+// ClientCertificate is a client certificate and private key loaded from PEM
+// files. The files are checked for changes whenever the certificate is used,
+// and reloaded when they change so certificates can be rotated without a
+// restart. If a reload fails, the previous certificate is kept.
+type ClientCertificate struct {
+	// certFile is the path of the PEM certificate chain.
+	certFile string
+	// keyFile is the path of the PEM private key.
+	keyFile string
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// cert is the most recently loaded certificate.
+	cert *tls.Certificate
+	// certVersion is the version of certFile last loaded or attempted.
+	certVersion fileVersion
+	// keyVersion is the version of keyFile last loaded or attempted.
+	keyVersion fileVersion
+}
+
+// LoadClientCertificate loads a client certificate chain and its private key
+// from PEM files.
+func LoadClientCertificate(certFile, keyFile string) (*ClientCertificate, error) {
+	c := &ClientCertificate{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the certificate and key if either file has changed since it was
+// last read.
+func (c *ClientCertificate) load() error {
+	certVersion, err := statFile(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyVersion, err := statFile(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certVersion == c.certVersion && keyVersion == c.keyVersion {
+		return nil
+	}
+
+	// Record the attempt so a bad file is reported once rather than on every
+	// use.
+	c.certVersion, c.keyVersion = certVersion, keyVersion
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load client certificate %s: %w", c.certFile, err)
+	}
+	c.cert = &cert
+	return nil
+}
+
+// current returns the certificate, reloading it first if its files changed.
+func (c *ClientCertificate) current() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := c.cert
+	err := c.load()
+	switch {
+	case err != nil:
+		log.Warn().Err(err).Msg("could not reload client certificate, keeping the previous certificate")
+	case c.cert != previous:
+		log.Info().Str("file", c.certFile).Time("expires", c.cert.Leaf.NotAfter).Msg("reloaded client certificate")
+	}
+	return c.cert
+}
+
+// GetClientCertificate returns the certificate to present to a server. It is
+// suitable for tls.Config.GetClientCertificate.
+func (c *ClientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current(), nil
+}
+
+// NotAfter returns when the certificate expires.
+func (c *ClientCertificate) NotAfter() time.Time {
+	return c.current().Leaf.NotAfter
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyPair writes a new self-signed certificate and key to certPath and
+// keyPath, and gives both files the modification time modTime.
+func writeKeyPair(t *testing.T, certPath, keyPath string, modTime time.Time) {
+	t.Helper()
+
+	certFile, err := os.Create(certPath)
+	require.NoError(t, err)
+	keyFile, err := os.Create(keyPath)
+	require.NoError(t, err)
+	require.NoError(t, GenerateSelfSignedTLSCertAndKey(keyFile, certFile))
+	_ = certFile.Close()
+	_ = keyFile.Close()
+
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+}
+
+// TestClientCertificateReload verifies that a changed certificate is reloaded
+// and that a bad replacement keeps the previous certificate.
+func TestClientCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client.key")
+	modTime := time.Now().Add(-time.Hour)
+	writeKeyPair(t, certPath, keyPath, modTime)
+
+	cert, err := LoadClientCertificate(certPath, keyPath)
+	require.NoError(t, err)
+	first, err := cert.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Leaf.NotAfter, cert.NotAfter())
+
+	// Unchanged files are not reloaded.
+	again, err := cert.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, first, again)
+
+	// Rotated files are.
+	writeKeyPair(t, certPath, keyPath, modTime.Add(time.Minute))
+	second, err := cert.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Certificate[0], second.Certificate[0])
+
+	// A bad file keeps the last good certificate.
+	require.NoError(t, os.WriteFile(certPath, []byte("not a certificate"), 0600))
+	third, err := cert.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, second, third)
+
+	_, err = LoadClientCertificate(certPath, keyPath)
+	assert.ErrorContains(t, err, certPath)
+	_, err = LoadClientCertificate(filepath.Join(dir, "missing.pem"), keyPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// TestConnectClientCertificate verifies that Connect presents the client
+// certificate to a server that requires one.
+func TestConnectClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client.key")
+	writeKeyPair(t, certPath, keyPath, time.Now())
+	cert, err := LoadClientCertificate(certPath, keyPath)
+	require.NoError(t, err)
+
+	listener, conns, _ := newTestTLSServer(t, func(c *tls.Config) {
+		c.ClientAuth = tls.RequireAnyClientCert
+	})
+
+	c, err := Connect("TEST", listener.Addr().String(), testSNI.String(), true, WithClientCertificate(cert))
+	require.NoError(t, err)
+	_ = c.Close()
+
+	sc := <-conns
+	require.Len(t, sc.state.PeerCertificates, 1)
+	assert.Equal(t, cert.NotAfter(), sc.state.PeerCertificates[0].NotAfter)
+}
@@ -0,0 +1,261 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// echLookupTimeout bounds the DNS lookup of an ECHConfigList.
+	echLookupTimeout = 5 * time.Second
+
+	// dnsUDPSize is the largest DNS response accepted over UDP. Larger
+	// responses are retried over TCP.
+	dnsUDPSize = 4096
+)
+
+// ErrECHUnavailable is returned instead of sending the API key as a cleartext
+// server name when ECH was asked for but the server's configuration could not
+// be found or was rejected.
+var ErrECHUnavailable = errors.New("ECH is unavailable, not sending the API key in cleartext")
+
+var (
+	// errNoECHConfig is returned when a host publishes no ECH configuration.
+	errNoECHConfig = errors.New("no ECH configuration published")
+
+	// resolvConfPath is read for the nameservers used to look up HTTPS records.
+	resolvConfPath = "/etc/resolv.conf"
+
+	// lookupECHConfigList wraps resolveECHConfigList so tests can replace it.
+	lookupECHConfigList = resolveECHConfigList
+)
+
+// resolveECHConfigList returns the ECHConfigList published in host's DNS
+// HTTPS record, asking each nameserver in resolvConfPath in turn.
+func resolveECHConfigList(ctx context.Context, host string) ([]byte, error) {
+	if net.ParseIP(host) != nil {
+		return nil, errNoECHConfig
+	}
+
+	var err error
+	for _, server := range nameservers(resolvConfPath) {
+		var list []byte
+		list, err = queryECHConfigList(ctx, server, host)
+		if err == nil || errors.Is(err, errNoECHConfig) {
+			return list, err
+		}
+	}
+	return nil, err
+}
+
+// nameservers returns the nameserver addresses listed in the resolv.conf file
+// at path, or the local resolver when none can be read.
+func nameservers(path string) []string {
+	var servers []string
+	f, err := os.Open(path)
+	if err == nil {
+		defer func() { _ = f.Close() }()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return servers
+}
+
+// queryECHConfigList asks server for host's HTTPS records and returns the
+// ECHConfigList of the most preferred record that has one.
+func queryECHConfigList(ctx context.Context, server, host string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, echLookupTimeout)
+	defer cancel()
+
+	query, id, err := newHTTPSQuery(host)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	var h dnsmessage.Header
+	if h, err = parseDNSHeader(resp); err == nil && h.Truncated {
+		resp, err = exchangeDNS(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return echConfigFromResponse(resp, id)
+}
+
+// newHTTPSQuery returns a recursive HTTPS query for host and its message ID.
+func newHTTPSQuery(host string) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid host name %q: %w", host, err)
+	}
+
+	var idBytes [2]byte
+	_, _ = rand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeHTTPS, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	query, err := b.Finish()
+	return query, id, err
+}
+
+// exchangeDNS sends query to server over network and returns the response.
+// TCP messages are framed with a two byte length as required by RFC 1035.
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, dnsUDPSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseDNSHeader returns the header of the DNS message msg.
+func parseDNSHeader(msg []byte) (dnsmessage.Header, error) {
+	var p dnsmessage.Parser
+	return p.Start(msg)
+}
+
+// echConfigFromResponse returns the ECHConfigList of the most preferred HTTPS
+// record in resp, which must answer the query with the given ID. Alias mode
+// records are not followed.
+func echConfigFromResponse(resp []byte, id uint16) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS response: %w", err)
+	}
+	if h.ID != id || !h.Response {
+		return nil, errors.New("DNS response does not match the query")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("DNS query failed: %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("invalid DNS response: %w", err)
+	}
+
+	var (
+		list     []byte
+		priority uint16
+	)
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS response: %w", err)
+		}
+		if rh.Type != dnsmessage.TypeHTTPS {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, fmt.Errorf("invalid DNS response: %w", err)
+			}
+			continue
+		}
+		r, err := p.HTTPSResource()
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTPS record: %w", err)
+		}
+		if r.Priority == 0 || (list != nil && r.Priority >= priority) {
+			continue
+		}
+		if ech, ok := r.GetParam(dnsmessage.SVCParamECH); ok && len(ech) > 0 {
+			list, priority = ech, r.Priority
+		}
+	}
+
+	if list == nil {
+		return nil, errNoECHConfig
+	}
+	return list, nil
+}
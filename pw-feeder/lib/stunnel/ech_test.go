@@ -0,0 +1,405 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/nettest"
+)
+
+// newECHKey returns an X25519 ECH key for publicName, and an ECHConfigList
+// containing its configuration.
+func newECHKey(t *testing.T, id uint8, publicName string) (tls.EncryptedClientHelloKey, []byte) {
+	t.Helper()
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pub := priv.PublicKey().Bytes()
+
+	// ECHConfigContents: config ID, KEM, public key, HKDF-SHA256 with
+	// AES-128-GCM, maximum name length, public name and no extensions.
+	contents := []byte{id, 0x00, 0x20}
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = append(contents, 0x00, 0x04, 0x00, 0x01, 0x00, 0x01, 0x00, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = append(contents, 0x00, 0x00)
+
+	config := []byte{0xfe, 0x0d}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	list = append(list, config...)
+
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: priv.Bytes(), SendAsRetry: true}, list
+}
+
+// newTestTLSServer starts a TLS server with a self-signed certificate for
+// localhost. Each connection's state and first line are sent to the returned
+// channel. It also returns a pool that trusts the certificate.
+func newTestTLSServer(t *testing.T, configure func(*tls.Config)) (net.Listener, <-chan serverConn, []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	certFile, err := os.Create(filepath.Join(dir, "cert.pem"))
+	require.NoError(t, err)
+	keyFile, err := os.Create(filepath.Join(dir, "key.pem"))
+	require.NoError(t, err)
+	require.NoError(t, GenerateSelfSignedTLSCertAndKey(keyFile, certFile))
+	_ = certFile.Close()
+	_ = keyFile.Close()
+	cert, err := tls.LoadX509KeyPair(certFile.Name(), keyFile.Name())
+	require.NoError(t, err)
+	certPEM, err := os.ReadFile(certFile.Name())
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if configure != nil {
+		configure(tlsConfig)
+	}
+
+	listener, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	conns := make(chan serverConn, 4)
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = c.Close() }()
+				tc := tls.Server(c, tlsConfig)
+				if err := tc.Handshake(); err != nil {
+					return
+				}
+				sc := serverConn{state: tc.ConnectionState()}
+				if sc.state.NegotiatedProtocol == AuthALPN {
+					line := make([]byte, 100)
+					n, _ := io.ReadAtLeast(tc, line, 1)
+					sc.firstLine = string(line[:n])
+				}
+				conns <- sc
+			}()
+		}
+	}()
+
+	return listener, conns, certPEM
+}
+
+// serverConn records what a test server saw of a connection.
+type serverConn struct {
+	// state is the server's view of the handshake.
+	state tls.ConnectionState
+	// firstLine is the data first read after an in-band handshake.
+	firstLine string
+}
+
+// trustPEM returns options that trust the PEM certificate certPEM.
+func trustPEM(t *testing.T, certPEM []byte) Option {
+	t.Helper()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, certPEM, 0600))
+	roots, err := LoadRootCAs(caFile, true)
+	require.NoError(t, err)
+	return WithRootCAs(roots)
+}
+
+// TestConnectECH verifies the server name is encrypted with a configured or
+// looked up ECHConfigList, and that a rejected configuration is replaced.
+func TestConnectECH(t *testing.T) {
+	key, list := newECHKey(t, 1, "ech.localhost")
+	listener, conns, certPEM := newTestTLSServer(t, func(c *tls.Config) {
+		c.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{key}
+	})
+	addr := listener.Addr().String()
+	roots := trustPEM(t, certPEM)
+
+	t.Run("configured", func(t *testing.T) {
+		c, err := Connect("TEST", addr, testSNI.String(), false, roots, WithECHConfigList(list))
+		require.NoError(t, err)
+		assert.True(t, c.ConnectionState().ECHAccepted)
+		_ = c.Close()
+
+		sc := <-conns
+		assert.True(t, sc.state.ECHAccepted)
+		assert.Equal(t, testSNI.String(), sc.state.ServerName)
+	})
+
+	t.Run("looked up", func(t *testing.T) {
+		lookupECHConfigList = func(_ context.Context, host string) ([]byte, error) {
+			assert.Equal(t, "127.0.0.1", host)
+			return list, nil
+		}
+		t.Cleanup(func() {
+			lookupECHConfigList = resolveECHConfigList
+		})
+
+		c, err := Connect("TEST", addr, testSNI.String(), false, roots, WithECHLookup())
+		require.NoError(t, err)
+		assert.True(t, c.ConnectionState().ECHAccepted)
+		_ = c.Close()
+		<-conns
+	})
+
+	t.Run("stale configuration", func(t *testing.T) {
+		_, staleList := newECHKey(t, 2, "ech.localhost")
+
+		c, err := Connect("TEST", addr, testSNI.String(), false, roots, WithECHConfigList(staleList))
+		require.NoError(t, err)
+		assert.True(t, c.ConnectionState().ECHAccepted)
+		_ = c.Close()
+		<-conns
+	})
+
+	t.Run("untrusted public name", func(t *testing.T) {
+		_, staleList := newECHKey(t, 2, "other.localhost")
+
+		// The retry configuration is only trusted when the server holds a
+		// certificate for the public name.
+		_, err := Connect("TEST", addr, testSNI.String(), false, roots, WithECHConfigList(staleList))
+		var hostnameErr x509.HostnameError
+		assert.ErrorAs(t, err, &hostnameErr)
+	})
+}
+
+// TestConnectECHUnavailable verifies the API key is not sent as a cleartext
+// server name when ECH was asked for but is unavailable, unless the fallback
+// is allowed.
+func TestConnectECHUnavailable(t *testing.T) {
+	apiKey := testSNI.String()
+	_, list := newECHKey(t, 1, "ech.localhost")
+	legacy, legacyConns, certPEM := newTestTLSServer(t, nil)
+	inBand, inBandConns, inBandCertPEM := newTestTLSServer(t, func(c *tls.Config) {
+		c.NextProtos = []string{AuthALPN}
+	})
+
+	// A server without ECH keys completes the outer handshake, which only
+	// carries the public name, before the client gives up on it.
+	t.Run("rejected", func(t *testing.T) {
+		roots := trustPEM(t, certPEM)
+
+		_, err := Connect("TEST", legacy.Addr().String(), apiKey, false, roots, WithECHConfigList(list))
+		assert.ErrorIs(t, err, ErrECHUnavailable)
+		_, err = Connect("TEST", legacy.Addr().String(), apiKey, false, roots, WithECHConfigList(list), WithAuthMode(AuthAuto))
+		assert.ErrorIs(t, err, ErrECHUnavailable)
+
+		for _, sc := range receiveConns(t, legacyConns, 4) {
+			assert.NotEqual(t, apiKey, sc.state.ServerName)
+		}
+	})
+
+	t.Run("in-band", func(t *testing.T) {
+		roots := trustPEM(t, inBandCertPEM)
+
+		c, err := Connect("TEST", inBand.Addr().String(), apiKey, false, roots, WithECHConfigList(list), WithAuthMode(AuthAuto))
+		require.NoError(t, err)
+		_ = c.Close()
+
+		var lines []string
+		for _, sc := range receiveConns(t, inBandConns, 2) {
+			assert.NotEqual(t, apiKey, sc.state.ServerName)
+			lines = append(lines, sc.firstLine)
+		}
+		assert.Contains(t, lines, apiKey+"\n")
+	})
+
+	t.Run("lookup failed", func(t *testing.T) {
+		lookupECHConfigList = func(context.Context, string) ([]byte, error) {
+			return nil, errNoECHConfig
+		}
+		t.Cleanup(func() {
+			lookupECHConfigList = resolveECHConfigList
+		})
+
+		_, err := Connect("TEST", legacy.Addr().String(), apiKey, true, WithECHLookup())
+		assert.ErrorIs(t, err, ErrECHUnavailable)
+	})
+
+	t.Run("fallback allowed", func(t *testing.T) {
+		roots := trustPEM(t, certPEM)
+
+		c, err := Connect("TEST", legacy.Addr().String(), apiKey, false, roots, WithECHConfigList(list), WithECHFallback())
+		require.NoError(t, err)
+		assert.False(t, c.ConnectionState().ECHAccepted)
+		_ = c.Close()
+
+		var names []string
+		for _, sc := range receiveConns(t, legacyConns, 2) {
+			names = append(names, sc.state.ServerName)
+		}
+		assert.Contains(t, names, apiKey)
+	})
+}
+
+// receiveConns returns the next n connections seen by a test server.
+func receiveConns(t *testing.T, conns <-chan serverConn, n int) []serverConn {
+	t.Helper()
+
+	var scs []serverConn
+	for range n {
+		select {
+		case sc := <-conns:
+			scs = append(scs, sc)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "the test server did not see enough connections", "saw %d of %d", len(scs), n)
+		}
+	}
+	return scs
+}
+
+// TestEchConfigFromResponse verifies the ECHConfigList is taken from the most
+// preferred service mode record.
+func TestEchConfigFromResponse(t *testing.T) {
+	name := dnsmessage.MustNewName("feed.example.")
+
+	response := func(t *testing.T, id uint16, records ...dnsmessage.HTTPSResource) []byte {
+		t.Helper()
+
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true})
+		require.NoError(t, b.StartAnswers())
+		for _, r := range records {
+			require.NoError(t, b.HTTPSResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 60}, r))
+		}
+		msg, err := b.Finish()
+		require.NoError(t, err)
+		return msg
+	}
+
+	record := func(priority uint16, ech []byte) dnsmessage.HTTPSResource {
+		r := dnsmessage.HTTPSResource{SVCBResource: dnsmessage.SVCBResource{Priority: priority, Target: dnsmessage.MustNewName(".")}}
+		if ech != nil {
+			r.SetParam(dnsmessage.SVCParamECH, ech)
+		}
+		return r
+	}
+
+	list, err := echConfigFromResponse(response(t, 7, record(2, []byte("second")), record(0, []byte("alias")), record(1, []byte("first")), record(1, nil)), 7)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), list)
+
+	_, err = echConfigFromResponse(response(t, 7, record(1, nil)), 7)
+	assert.ErrorIs(t, err, errNoECHConfig)
+
+	_, err = echConfigFromResponse(response(t, 8, record(1, []byte("first"))), 7)
+	assert.ErrorContains(t, err, "does not match")
+}
+
+// TestQueryECHConfigList verifies the HTTPS record is fetched over UDP, and
+// over TCP when the UDP response is truncated.
+func TestQueryECHConfigList(t *testing.T) {
+	list := bytes.Repeat([]byte{0xec}, 64)
+
+	// answer returns a response to query, truncated if truncate is set.
+	answer := func(t *testing.T, query []byte, truncate bool) []byte {
+		var p dnsmessage.Parser
+		h, err := p.Start(query)
+		require.NoError(t, err)
+		q, err := p.Question()
+		require.NoError(t, err)
+		assert.Equal(t, dnsmessage.TypeHTTPS, q.Type)
+
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Truncated: truncate})
+		require.NoError(t, b.StartQuestions())
+		require.NoError(t, b.Question(q))
+		if !truncate {
+			require.NoError(t, b.StartAnswers())
+			r := dnsmessage.HTTPSResource{SVCBResource: dnsmessage.SVCBResource{Priority: 1, Target: dnsmessage.MustNewName(".")}}
+			r.SetParam(dnsmessage.SVCParamECH, list)
+			require.NoError(t, b.HTTPSResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET}, r))
+		}
+		msg, err := b.Finish()
+		require.NoError(t, err)
+		return msg
+	}
+
+	// Serve UDP and TCP on the same port.
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tcpListener.Close() })
+	udpConn, err := net.ListenPacket("udp4", tcpListener.Addr().String())
+	if err != nil {
+		t.Skipf("could not listen for UDP on the TCP port: %v", err)
+	}
+	t.Cleanup(func() { _ = udpConn.Close() })
+
+	go func() {
+		buf := make([]byte, dnsUDPSize)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteTo(answer(t, buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			if _, err := io.ReadFull(c, length[:]); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(c, query); err == nil {
+					resp := answer(t, query, false)
+					_, _ = c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}
+			_ = c.Close()
+		}
+	}()
+
+	got, err := queryECHConfigList(context.Background(), tcpListener.Addr().String(), "feed.example")
+	require.NoError(t, err)
+	assert.Equal(t, list, got)
+}
+
+// TestNameservers verifies nameservers are read from resolv.conf, with the
+// local resolver as a fallback.
+func TestNameservers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nsearch example\nnameserver 192.0.2.1\nnameserver 2001:db8::1\n"), 0600))
+	assert.Equal(t, []string{"192.0.2.1:53", "[2001:db8::1]:53"}, nameservers(path))
+
+	assert.Equal(t, []string{"127.0.0.1:53", "[::1]:53"}, nameservers(filepath.Join(t.TempDir(), "missing")))
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"pw-feeder/lib/network"
+)
+
+type (
+	// Option configures how Connect and NewTLSConfig verify and authenticate
+	// to servers.
+	Option func(*options)
+
+	// options contains the optional connection settings.
+	options struct {
+		// roots verifies the server's certificate chain. The system roots are
+		// used when it is nil.
+		roots *x509.CertPool
+		// pins restricts the accepted chains to those containing one of these
+		// public keys.
+		pins []Pin
+		// authMode selects how Connect presents the API key.
+		authMode AuthMode
+		// echConfigList is the ECHConfigList used to encrypt the ClientHello,
+		// if set.
+		echConfigList []byte
+		// echLookup fetches the ECHConfigList from the server's DNS HTTPS
+		// record when echConfigList is not set.
+		echLookup bool
+		// echFallback allows the API key to be sent as a cleartext server
+		// name when ECH was asked for but is unavailable.
+		echFallback bool
+		// clientCert is presented to servers that request a client
+		// certificate, if set.
+		clientCert *ClientCertificate
+		// sessionCache stores sessions so later connections can resume them,
+		// if set.
+		sessionCache tls.ClientSessionCache
+		// trace is called with the timing of each completed handshake, if
+		// set.
+		trace func(ConnectTrace)
+		// dialer connects to servers, possibly through a proxy. Connections
+		// are made directly when it is nil.
+		dialer *network.Dialer
+	}
+)
+
+// WithRootCAs returns an Option that verifies certificate chains against roots
+// instead of the system roots. A nil pool keeps the system roots.
+func WithRootCAs(roots *x509.CertPool) Option {
+	return func(o *options) {
+		o.roots = roots
+	}
+}
+
+// WithPins returns an Option that only accepts a server whose verified chain
+// contains a certificate with one of pins as its public key.
+func WithPins(pins ...Pin) Option {
+	return func(o *options) {
+		o.pins = append(o.pins, pins...)
+	}
+}
+
+// WithAuthMode returns an Option that selects how Connect presents the API
+// key. The default is AuthSNI.
+func WithAuthMode(mode AuthMode) Option {
+	return func(o *options) {
+		o.authMode = mode
+	}
+}
+
+// WithECHConfigList returns an Option that encrypts the ClientHello, including
+// the server name, using list. An empty list disables it.
+func WithECHConfigList(list []byte) Option {
+	return func(o *options) {
+		o.echConfigList = list
+	}
+}
+
+// WithECHLookup returns an Option that fetches an ECHConfigList from the
+// server's DNS HTTPS record when one has not been configured.
+func WithECHLookup() Option {
+	return func(o *options) {
+		o.echLookup = true
+	}
+}
+
+// WithECHFallback returns an Option that lets Connect send the API key as a
+// cleartext server name when ECH was asked for but is unavailable, rather than
+// returning ErrECHUnavailable.
+func WithECHFallback() Option {
+	return func(o *options) {
+		o.echFallback = true
+	}
+}
+
+// WithClientCertificate returns an Option that presents cert to servers that
+// request a client certificate.
+func WithClientCertificate(cert *ClientCertificate) Option {
+	return func(o *options) {
+		o.clientCert = cert
+	}
+}
+
+// WithSessionCache returns an Option that resumes TLS sessions stored in
+// cache. Sharing a cache between connections lets reconnects skip a full
+// handshake.
+func WithSessionCache(cache tls.ClientSessionCache) Option {
+	return func(o *options) {
+		o.sessionCache = cache
+	}
+}
+
+// WithTrace returns an Option that calls trace with the timing of each
+// completed handshake.
+func WithTrace(trace func(ConnectTrace)) Option {
+	return func(o *options) {
+		o.trace = trace
+	}
+}
+
+// WithDialer returns an Option that connects to servers using dialer, which
+// may route connections through a proxy.
+func WithDialer(dialer *network.Dialer) Option {
+	return func(o *options) {
+		o.dialer = dialer
+	}
+}
+
+// newOptions applies opts to the default options.
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -19,16 +19,38 @@
 package stunnel
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"pw-feeder/lib/network"
+
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// connectTimeout bounds connecting to and completing the handshake with a
+// server.
+const connectTimeout = 10 * time.Second
+
+// ConnectTrace describes how long each step of establishing a connection took.
+type ConnectTrace struct {
+	// DNS is how long resolving the server's host name took. It is zero when
+	// the server address is an IP address.
+	DNS time.Duration
+	// Connect is how long establishing the TCP connection took.
+	Connect time.Duration
+	// Handshake is how long the TLS handshake took.
+	Handshake time.Duration
+	// State is the state of the established connection.
+	State tls.ConnectionState
+}
+
 var (
 	// systemCertPoolOnce ensures the system roots are loaded only once.
 	systemCertPoolOnce sync.Once
@@ -49,11 +71,76 @@ func getSystemCertPool() (*x509.CertPool, error) {
 	return systemCertPool, systemCertPoolErr
 }
 
-// Connect establishes a TLS connection to addr using sni as the server name.
-// Unless insecure mode is enabled, it verifies the certificate for addr's host.
-func Connect(name, addr, sni string, insecure bool) (c *tls.Conn, err error) {
+// NewTLSConfig returns a client TLS configuration that verifies the server's
+// certificate chain for host, then checks any configured pins. When host is
+// empty the server name sent in the handshake is verified instead. Nothing is
+// verified in insecure mode.
+func NewTLSConfig(host string, insecure bool, opts ...Option) (*tls.Config, error) {
+	o := newOptions(opts)
+
+	// Load the system root certificate authorities unless roots were supplied.
+	roots := o.roots
+	if !insecure && roots == nil {
+		var err error
+		roots, err = getSystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Verification is done in VerifyConnection so the certificate can be
+	// checked against host rather than the server name, which carries the API
+	// key on feed-in connections.
+	tlsConfig := &tls.Config{
+		// A server that rejects ECH must prove it holds a certificate for the
+		// public name in the ECH configuration before its retry configuration
+		// is trusted. The tls package verifies it against RootCAs.
+		RootCAs:            roots,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if insecure {
+				return nil
+			}
+
+			dnsName := host
+			if dnsName == "" {
+				dnsName = cs.ServerName
+			}
+			return verifyPeerCertificates(cs.PeerCertificates, roots, dnsName, o.pins...)
+		},
+	}
+	if o.sessionCache != nil {
+		tlsConfig.ClientSessionCache = o.sessionCache
+	}
+	if o.clientCert != nil {
+		tlsConfig.GetClientCertificate = o.clientCert.GetClientCertificate
+	}
+	if insecure {
+		tlsConfig.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error {
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Connect establishes a TLS connection to addr and presents sni, the API key,
+// as selected by the AuthMode option: as the server name, or inside the
+// encrypted channel when the server supports it. The ClientHello is encrypted
+// when an ECHConfigList is configured or found. When ECH was asked for but is
+// unavailable, the key is only sent in-band, and ErrECHUnavailable is
+// returned if that is not possible, unless WithECHFallback is used.
+// Unless insecure mode is enabled, it verifies the certificate for addr's
+// host.
+func Connect(name, addr, sni string, insecure bool, opts ...Option) (c *tls.Conn, err error) {
+	return ConnectContext(context.Background(), name, addr, sni, insecure, opts...)
+}
+
+// ConnectContext is like Connect, but gives up when ctx is cancelled before
+// the connection is established.
+func ConnectContext(ctx context.Context, name, addr, sni string, insecure bool, opts ...Option) (c *tls.Conn, err error) {
 
 	logger := log.With().Str("name", name).Str("addr", addr).Logger()
+	o := newOptions(opts)
 
 	// Extract the remote host from addr.
 	remoteHost, _, err := net.SplitHostPort(addr)
@@ -62,59 +149,166 @@ func Connect(name, addr, sni string, insecure bool) (c *tls.Conn, err error) {
 		return c, err
 	}
 
-	// Load the system root certificate authorities.
-	var scp *x509.CertPool
-	if !insecure {
-		scp, err = getSystemCertPool()
+	// Find the ECH configuration, if any.
+	echConfigList := o.echConfigList
+	if len(echConfigList) == 0 && o.echLookup {
+		echConfigList, err = lookupECHConfigList(ctx, remoteHost)
 		if err != nil {
-			// log.Err(err).Caller().Msg("could not use system cert pool")
-			return c, err
+			logger.Warn().Err(err).Str("host", remoteHost).Msg("could not find an ECH configuration for the server")
 		}
 	}
 
-	// Configure TLS verification.
-	tlsConfig := tls.Config{
-		ServerName:         sni,
-		InsecureSkipVerify: true,
-		VerifyConnection: func(cs tls.ConnectionState) error {
-			if insecure {
-				return nil
-			}
+	// Once ECH has been asked for, the API key is only sent as a cleartext
+	// server name if the user accepts it.
+	cleartextKey := (len(o.echConfigList) == 0 && !o.echLookup) || o.echFallback
 
-			err := verifyPeerCertificates(cs.PeerCertificates, scp, remoteHost)
+	// Offer in-band authentication, which sends the host rather than the API
+	// key as the server name.
+	if o.authMode != AuthSNI {
+		c, err = dial(ctx, logger, addr, remoteHost, remoteHost, []string{AuthALPN}, echConfigList, true, insecure, opts)
+		if err != nil {
+			return c, err
+		}
+		if c.ConnectionState().NegotiatedProtocol == AuthALPN {
+			err = sendAPIKey(c, sni)
 			if err != nil {
-				logger.Err(err).Str("host", remoteHost).Msg("could not verify server certificate")
+				_ = c.Close()
+				return nil, err
 			}
-			return err
-		},
+			return c, nil
+		}
+		_ = c.Close()
+		if o.authMode == AuthInBand {
+			return nil, ErrInBandAuthUnsupported
+		}
+		logger.Debug().Msg("server does not support in-band authentication, falling back to the server name")
+	}
+
+	if len(echConfigList) == 0 && !cleartextKey {
+		return nil, ErrECHUnavailable
+	}
+	return dial(ctx, logger, addr, remoteHost, sni, nil, echConfigList, cleartextKey, insecure, opts)
+
+}
+
+// dial connects to addr and completes a TLS handshake using serverName and
+// nextProtos, verifying the certificate for remoteHost. When echConfigList is
+// set and the server rejects it, the handshake is retried once with the
+// server's retry configuration. If it offered none, the handshake is retried
+// without ECH when cleartext is set, and ErrECHUnavailable is returned
+// otherwise.
+func dial(ctx context.Context, logger zerolog.Logger, addr, remoteHost, serverName string, nextProtos []string, echConfigList []byte, cleartext, insecure bool, opts []Option) (*tls.Conn, error) {
+
+	// Configure TLS verification.
+	tlsConfig, err := NewTLSConfig(remoteHost, insecure, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = serverName
+	tlsConfig.NextProtos = nextProtos
+	tlsConfig.EncryptedClientHelloConfigList = echConfigList
+	verifyConnection := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		err := verifyConnection(cs)
+		if err != nil {
+			logger.Err(err).Str("host", remoteHost).Msg("could not verify server certificate")
+		}
+		return err
+	}
+
+	o := newOptions(opts)
+	c, err := handshake(ctx, o.dialer, addr, tlsConfig, o.trace)
+
+	var echErr *tls.ECHRejectionError
+	if errors.As(err, &echErr) {
+		switch {
+		case len(echErr.RetryConfigList) > 0:
+			logger.Debug().Msg("server rejected the ECH configuration, retrying with its replacement")
+		case cleartext:
+			logger.Warn().Msg("server rejected ECH, the server name will be sent in cleartext")
+		default:
+			return nil, fmt.Errorf("%w: %w", ErrECHUnavailable, err)
+		}
+		tlsConfig.EncryptedClientHelloConfigList = echErr.RetryConfigList
+		c, err = handshake(ctx, o.dialer, addr, tlsConfig, o.trace)
 	}
 
-	d := net.Dialer{
-		Timeout: 10 * time.Second,
+	return c, err
+}
+
+// handshake dials addr using dialer, or directly when dialer is nil, and
+// performs the TLS handshake using tlsConfig, within connectTimeout or until
+// ctx is cancelled. When trace is set, it is called with the timing of a
+// successful handshake.
+func handshake(ctx context.Context, dialer *network.Dialer, addr string, tlsConfig *tls.Config, trace func(ConnectTrace)) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var (
+		resolvedOnce sync.Once
+		resolved     time.Time
+	)
+	ctx = network.WithDialTrace(ctx, &network.DialTrace{
+		Resolved: func() {
+			resolvedOnce.Do(func() {
+				resolved = time.Now()
+			})
+		},
+	})
+	if dialer == nil {
+		dialer = &network.Dialer{}
 	}
 
 	// Dial the remote endpoint.
-	c, err = tls.DialWithDialer(&d, "tcp", addr, &tlsConfig)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		// log.Err(err).Caller().Msg("could not connect")
-		return c, err
+		return nil, err
+	}
+	connected := time.Now()
+
+	// As tls.Dial does, send the host as the server name if none was set.
+	if tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
 	}
 
 	// Perform the TLS handshake.
-	err = c.Handshake()
+	c := tls.Client(conn, tlsConfig)
+	err = c.HandshakeContext(ctx)
 	if err != nil {
-		// log.Err(err).Caller().Msg("handshake error")
-		return c, err
+		_ = c.Close()
+		return nil, err
 	}
 
-	// log.Debug().Msg("endpoint connected")
-	return c, err
+	if trace != nil {
+		// Synchronise with the dialer's sockets before reading resolved. A
+		// proxy resolves the host itself, so no lookup time is recorded.
+		resolvedOnce.Do(func() {
+			resolved = start
+		})
+		t := ConnectTrace{
+			Connect:   connected.Sub(start),
+			Handshake: time.Since(connected),
+			State:     c.ConnectionState(),
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) == nil {
+			t.DNS = resolved.Sub(start)
+			t.Connect = connected.Sub(resolved)
+		}
+		trace(t)
+	}
 
+	return c, nil
 }
 
 // verifyPeerCertificates verifies the presented certificate chain for dnsName
-// using the supplied root certificate pool.
-func verifyPeerCertificates(peerCertificates []*x509.Certificate, roots *x509.CertPool, dnsName string) error {
+// using the supplied root certificate pool. When pins are supplied, the
+// verified chain must also contain a certificate with one of their public
+// keys. Failures are reported as a *ChainError or *PinError.
+func verifyPeerCertificates(peerCertificates []*x509.Certificate, roots *x509.CertPool, dnsName string, pins ...Pin) error {
 
 	if len(peerCertificates) == 0 {
 		return errors.New("server presented no certificates")
@@ -132,7 +326,16 @@ func verifyPeerCertificates(peerCertificates []*x509.Certificate, roots *x509.Ce
 		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
 
-	_, err := peerCertificates[0].Verify(verifyOptions)
-	return err
+	chains, err := peerCertificates[0].Verify(verifyOptions)
+	if err != nil {
+		return &ChainError{
+			Host:    dnsName,
+			Subject: peerCertificates[0].Subject.String(),
+			Issuer:  peerCertificates[0].Issuer.String(),
+			Err:     err,
+		}
+	}
+
+	return checkPins(chains, pins, dnsName)
 
 }
@@ -60,8 +60,9 @@ func init() {
 func GenerateSelfSignedTLSCertAndKey(keyFile, certFile *os.File) error {
 	// Based on: https://go.dev/src/crypto/tls/generate_cert.go
 
-	// Prepare the certificate details.
-	hosts := []string{"localhost"}
+	// Prepare the certificate details. ech.localhost is the ECH public name
+	// used by the ECH tests.
+	hosts := []string{"localhost", "ech.localhost"}
 	ipAddrs := []net.IP{net.IPv4(127, 0, 0, 1)}
 	notBefore := time.Now()
 	notAfter := time.Now().Add(time.Minute * 15)
@@ -371,6 +372,26 @@ func TestStunnel_Error_CantConnect(t *testing.T) {
 
 }
 
+// TestConnectContext_Cancelled verifies that cancelling the context stops a
+// handshake the server never answers.
+func TestConnectContext_Cancelled(t *testing.T) {
+
+	// Create a TCP listener that never completes a handshake.
+	listener, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = ConnectContext(ctx, "TEST", listener.Addr().String(), testSNI.String(), true)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), connectTimeout)
+
+}
+
 // TestStunnel_Error_TLSError verifies that a non-TLS endpoint causes a TLS error.
 func TestStunnel_Error_TLSError(t *testing.T) {
 
@@ -425,3 +446,45 @@ func TestStunnel_Error_TLSError(t *testing.T) {
 	wgOuter.Wait()
 
 }
+
+// TestConnectSessionResumption verifies that connections sharing a session
+// cache resume the previous session, and that each handshake is traced.
+func TestConnectSessionResumption(t *testing.T) {
+	listener, conns, certPEM := newTestTLSServer(t, nil)
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	var traces []ConnectTrace
+	opts := []Option{
+		trustPEM(t, certPEM),
+		WithSessionCache(tls.NewLRUClientSessionCache(0)),
+		WithTrace(func(trace ConnectTrace) {
+			traces = append(traces, trace)
+		}),
+	}
+
+	for range 2 {
+		c, err := Connect("TEST", net.JoinHostPort("localhost", port), testSNI.String(), false, opts...)
+		require.NoError(t, err)
+		// Reading processes the session ticket sent after the handshake.
+		_, _ = c.Read(make([]byte, 1))
+		_ = c.Close()
+		<-conns
+	}
+
+	require.Len(t, traces, 2)
+	assert.False(t, traces[0].State.DidResume)
+	assert.True(t, traces[1].State.DidResume)
+	for _, trace := range traces {
+		assert.Positive(t, trace.DNS)
+		assert.Positive(t, trace.Connect)
+		assert.Positive(t, trace.Handshake)
+	}
+
+	// Without a cache, every handshake is a full one.
+	c, err := Connect("TEST", listener.Addr().String(), testSNI.String(), false, trustPEM(t, certPEM))
+	require.NoError(t, err)
+	assert.False(t, c.ConnectionState().DidResume)
+	_ = c.Close()
+	<-conns
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// pinPrefix is the optional prefix of a pin's text form.
+const pinPrefix = "sha256/"
+
+// Pin is the SHA-256 hash of a certificate's DER-encoded SubjectPublicKeyInfo.
+// Pinning the public key rather than the certificate lets a pin survive
+// certificate renewals that reuse the key.
+type Pin [sha256.Size]byte
+
+// ParsePin parses a pin written as base64, optionally prefixed with "sha256/",
+// as produced by:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func ParsePin(s string) (Pin, error) {
+	var pin Pin
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(s), pinPrefix))
+	if err != nil {
+		return pin, fmt.Errorf("pin %q is not valid base64: %w", s, err)
+	}
+	if len(b) != len(pin) {
+		return pin, fmt.Errorf("pin %q is %d bytes, expected a %d byte SHA-256 hash", s, len(b), len(pin))
+	}
+	copy(pin[:], b)
+	return pin, nil
+}
+
+// SPKIPin returns the pin for cert's public key.
+func SPKIPin(cert *x509.Certificate) Pin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// String returns the pin in its "sha256/<base64>" form.
+func (p Pin) String() string {
+	return pinPrefix + base64.StdEncoding.EncodeToString(p[:])
+}
+
+// PinError reports that none of the certificates presented by a server match
+// the configured pins.
+type PinError struct {
+	// Host is the server that was verified.
+	Host string
+	// Pins are the configured pins.
+	Pins []Pin
+	// Presented are the pins of the certificates in the server's verified
+	// chain, leaf first.
+	Presented []Pin
+}
+
+// Error describes both the configured and the presented pins.
+func (e *PinError) Error() string {
+	return fmt.Sprintf("certificate pinning failed for %s: chain presented %s, expected one of %s",
+		e.Host, joinPins(e.Presented), joinPins(e.Pins))
+}
+
+// joinPins returns pins as a comma-separated list.
+func joinPins(pins []Pin) string {
+	s := make([]string, len(pins))
+	for i, pin := range pins {
+		s[i] = pin.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// ChainError reports that a server's certificate chain could not be verified
+// against the trusted roots.
+type ChainError struct {
+	// Host is the server that was verified.
+	Host string
+	// Subject is the subject of the server's leaf certificate.
+	Subject string
+	// Issuer is the issuer of the server's leaf certificate.
+	Issuer string
+	// Err is the verification error.
+	Err error
+}
+
+// Error names the certificate that failed and why.
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("certificate chain for %s failed verification (subject %q, issuer %q): %s",
+		e.Host, e.Subject, e.Issuer, e.Err)
+}
+
+// Unwrap returns the verification error.
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
+
+// checkPins returns a PinError unless a certificate in one of chains matches
+// one of pins. Every chain is accepted when pins is empty.
+func checkPins(chains [][]*x509.Certificate, pins []Pin, host string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+
+	var presented []Pin
+	seen := make(map[Pin]bool)
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := SPKIPin(cert)
+			for _, want := range pins {
+				if pin == want {
+					return nil
+				}
+			}
+			if !seen[pin] {
+				seen[pin] = true
+				presented = append(presented, pin)
+			}
+		}
+	}
+
+	return &PinError{Host: host, Pins: pins, Presented: presented}
+}
+
+// LoadRootCAs reads PEM-encoded certificates from path. Unless replace is set,
+// they are added to a copy of the system roots; otherwise they are the only
+// roots trusted.
+func LoadRootCAs(path string, replace bool) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !replace {
+		systemRoots, err := getSystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("could not load system roots to add %s to: %w", path, err)
+		}
+		pool = systemRoots.Clone()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM certificates found in " + path)
+	}
+	return pool, nil
+}
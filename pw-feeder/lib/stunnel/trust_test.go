@@ -0,0 +1,168 @@
+// Copyright (C) 2024 Plane Watch
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// This file is part of pw-feeder.
+//
+// pw-feeder is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// pw-feeder is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with pw-feeder. If not, see <https://www.gnu.org/licenses/>.
+
+package stunnel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// TestParsePin verifies the accepted pin formats and rejected input.
+func TestParsePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("public key"))
+	encoded := base64.StdEncoding.EncodeToString(sum[:])
+
+	pin, err := ParsePin(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, Pin(sum), pin)
+
+	pin, err = ParsePin(" sha256/" + encoded + " ")
+	require.NoError(t, err)
+	assert.Equal(t, Pin(sum), pin)
+	assert.Equal(t, "sha256/"+encoded, pin.String())
+
+	_, err = ParsePin("sha256/not base64!")
+	assert.ErrorContains(t, err, "not valid base64")
+
+	_, err = ParsePin(base64.StdEncoding.EncodeToString(sum[:16]))
+	assert.ErrorContains(t, err, "16 bytes")
+}
+
+// TestVerifyPeerCertificatesPins verifies that any certificate in the verified
+// chain can satisfy a pin, and that failures name the pin or chain at fault.
+func TestVerifyPeerCertificatesPins(t *testing.T) {
+	rootCert, intermediateCert, leafCert := GenerateTLSCertificateChain(t)
+	presented := []*x509.Certificate{leafCert, intermediateCert}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+
+	for _, cert := range []*x509.Certificate{rootCert, intermediateCert, leafCert} {
+		require.NoError(t, verifyPeerCertificates(presented, roots, "localhost", SPKIPin(cert)))
+	}
+
+	// A pin that matches nothing reports both the expected and presented pins.
+	wrongPin := Pin(sha256.Sum256([]byte("some other key")))
+	err := verifyPeerCertificates(presented, roots, "localhost", wrongPin)
+	var pinErr *PinError
+	require.ErrorAs(t, err, &pinErr)
+	assert.Equal(t, "localhost", pinErr.Host)
+	assert.Equal(t, []Pin{SPKIPin(leafCert), SPKIPin(intermediateCert), SPKIPin(rootCert)}, pinErr.Presented)
+	assert.ErrorContains(t, err, wrongPin.String())
+	assert.ErrorContains(t, err, SPKIPin(leafCert).String())
+
+	// Chain failures are reported before pins are checked.
+	err = verifyPeerCertificates(presented, x509.NewCertPool(), "localhost", SPKIPin(leafCert))
+	var chainErr *ChainError
+	require.ErrorAs(t, err, &chainErr)
+	assert.Equal(t, "CN=localhost", chainErr.Subject)
+	assert.Equal(t, "CN=test intermediate", chainErr.Issuer)
+	var unknownAuthority x509.UnknownAuthorityError
+	assert.ErrorAs(t, err, &unknownAuthority)
+}
+
+// TestLoadRootCAs verifies that a CA file can add to or replace the system
+// roots.
+func TestLoadRootCAs(t *testing.T) {
+	rootCert, intermediateCert, leafCert := GenerateTLSCertificateChain(t)
+	presented := []*x509.Certificate{leafCert, intermediateCert}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCert.Raw}), 0600))
+
+	for _, replace := range []bool{false, true} {
+		roots, err := LoadRootCAs(caFile, replace)
+		require.NoError(t, err)
+		require.NoError(t, verifyPeerCertificates(presented, roots, "localhost"))
+	}
+
+	systemRoots, err := getSystemCertPool()
+	require.NoError(t, err)
+	added, err := LoadRootCAs(caFile, false)
+	require.NoError(t, err)
+	assert.False(t, added.Equal(systemRoots), "system roots must not be modified")
+
+	emptyFile := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(emptyFile, nil, 0600))
+	_, err = LoadRootCAs(emptyFile, true)
+	assert.ErrorContains(t, err, "no PEM certificates")
+
+	_, err = LoadRootCAs(filepath.Join(t.TempDir(), "missing.pem"), true)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// TestConnectWithRootCAsAndPins verifies that Connect applies its trust
+// options.
+func TestConnectWithRootCAsAndPins(t *testing.T) {
+	dir := t.TempDir()
+	certFile, err := os.Create(filepath.Join(dir, "cert.pem"))
+	require.NoError(t, err)
+	keyFile, err := os.Create(filepath.Join(dir, "key.pem"))
+	require.NoError(t, err)
+	require.NoError(t, GenerateSelfSignedTLSCertAndKey(keyFile, certFile))
+	_ = certFile.Close()
+	_ = keyFile.Close()
+
+	cert, err := tls.LoadX509KeyPair(certFile.Name(), keyFile.Name())
+	require.NoError(t, err)
+
+	listener, err := nettest.NewLocalListener("tcp4")
+	require.NoError(t, err)
+	tlsListener := tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	t.Cleanup(func() {
+		_ = tlsListener.Close()
+	})
+	go func() {
+		for {
+			c, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.(*tls.Conn).Handshake()
+			_ = c.Close()
+		}
+	}()
+
+	roots, err := LoadRootCAs(certFile.Name(), true)
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+
+	// The self-signed certificate is not in the system roots.
+	_, err = Connect("TEST", addr, testSNI.String(), false)
+	require.Error(t, err)
+
+	c, err := Connect("TEST", addr, testSNI.String(), false, WithRootCAs(roots), WithPins(SPKIPin(cert.Leaf)))
+	require.NoError(t, err)
+	_ = c.Close()
+
+	wrongPin := Pin(sha256.Sum256([]byte("some other key")))
+	_, err = Connect("TEST", addr, testSNI.String(), false, WithRootCAs(roots), WithPins(wrongPin))
+	var pinErr *PinError
+	require.ErrorAs(t, err, &pinErr)
+}